@@ -1,54 +1,139 @@
 // fetch_checksums.go is a tool that generates .sha512 files under checksums/ based on config.json.
+//
+// By default, the checksums of the secrets of each project version the
+// nodes run are fetched from the secret service and merged into the
+// existing files.
+//
+// With -project and -version, the complete checksums of one project
+// version are written, taking those of its files from the SHA512SUMS of
+// the release once its signature is verified against the keys in -keys:
+//
+//	go run fetch_checksums.go -project hkjninfra -version 1.5.14
+//
+// With -release, they're computed from a local directory of its release
+// artifacts instead:
+//
+//	go run fetch_checksums.go -release ~/build/hkjninfra -project hkjninfra -version 1.5.14
 package main
 
 import (
-	"fmt"
-	"io"
+	"flag"
 	"log"
 	"os"
-	"path/filepath"
+	"time"
 
 	"hkjn.me/src/infra/ignite"
 	"hkjn.me/src/infra/secretservice"
 )
 
-// checkClose closes specified closer and sets err to the result.
-func checkClose(c io.Closer, err *error) {
-	cerr := c.Close()
-	if *err == nil {
-		*err = cerr
-	}
-}
-
-func main() {
+// getHash returns the secret service hash.
+func getHash() string {
 	sshash, err := secretservice.GetHash()
 	if err != nil {
 		log.Fatalf("Unable to fetch secret service hash: %v\n", err)
 	}
+	return sshash
+}
 
-	conf, err := ignite.ReadConfig()
-	if err != nil {
-		log.Fatalf("Failed to read node config: %v\n", err)
-	}
-
+// fetchSecrets merges the checksums of the secrets of all project
+// versions the nodes run into their checksum files.
+func fetchSecrets(conf *ignite.Config, f *ignite.Fetcher) {
 	log.Printf("Read %d node configs..\n", len(conf.NodeConfigs))
-	checksums, err := conf.GetChecksums(sshash)
+	checksums, err := conf.GetChecksums(f, getHash())
 	if err != nil {
 		log.Fatalf("Failed to download checksums: %v\n", err)
 	}
-	basedir := "checksums"
 	for pv, checksumlines := range checksums {
-		var err error
-		filename := filepath.Join(basedir, fmt.Sprintf("%s_%s.sha512", pv.Name, pv.Version))
-		log.Printf("Creating %s with %d checksums for %v\n", filename, len(checksumlines), pv)
-		f, err := os.Create(filename)
+		filename := pv.ChecksumFile()
+		existing, err := os.ReadFile(filename)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatalf("Failed to read checksums file: %v\n", err)
+		}
+		data, err := ignite.MergeChecksums(existing, checksumlines)
 		if err != nil {
-			log.Fatalf("Failed to open checksums file: %v\n", err)
+			log.Fatalf("Failed to merge checksums into %s: %v\n", filename, err)
 		}
-		defer checkClose(f, &err)
-		for _, line := range checksumlines {
-			fmt.Printf("Appending checksum %x[..] to %q..\n", line[:5], filename)
-			f.Write([]byte(line))
+		log.Printf("Writing %s with %d secret checksums for %v\n", filename, len(checksumlines), pv)
+		if err := ignite.WriteFile(filename, data, 0644); err != nil {
+			log.Fatalf("Failed to write checksums file: %v\n", err)
+		}
+	}
+}
+
+// writeRelease writes the complete checksums of the project version,
+// with lines for its files and those fetched for its secrets.
+func writeRelease(conf *ignite.Config, f *ignite.Fetcher, pv ignite.ProjectVersion, lines []string) {
+	secrets, err := conf.ProjectConfigs.GetSecrets(pv.Name)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if len(secrets) > 0 {
+		secretLines, err := conf.SecretChecksums(f, getHash(), pv)
+		if err != nil {
+			log.Fatalf("Failed to download checksums: %v\n", err)
+		}
+		lines = append(lines, secretLines...)
+	}
+	data, err := ignite.MergeChecksums(nil, lines)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	filename := pv.ChecksumFile()
+	log.Printf("Writing %s with %d checksums for %v\n", filename, len(lines), pv)
+	if err := ignite.WriteFile(filename, data, 0644); err != nil {
+		log.Fatalf("Failed to write checksums file: %v\n", err)
+	}
+}
+
+func main() {
+	release := flag.String("release", "", "directory of release artifacts to compute the checksums of -project at -version from")
+	project := flag.String("project", "", "project of the release to write the checksums of")
+	version := flag.String("version", "", "version of the release to write the checksums of")
+	keys := flag.String("keys", ignite.DefaultKeysDir, "directory of public keys trusted to sign the SHA512SUMS of releases")
+	cache := flag.String("cache", ignite.DefaultCacheDir(), "directory to cache fetched files in, or \"\" for none")
+	offline := flag.Bool("offline", false, "only use fetched files from -cache")
+	concurrency := flag.Int("concurrency", 4, "most files to fetch at once")
+	timeout := flag.Duration("timeout", 30*time.Second, "timeout of connecting and waiting for the response of each request; reading the body isn't limited")
+	retries := flag.Int("retries", 3, "times to retry failing requests")
+	flag.Parse()
+
+	f := ignite.NewFetcher(*cache)
+	f.Offline = *offline
+	f.Concurrency = *concurrency
+	f.Client.Transport = ignite.NewTransport(*timeout)
+	f.Retries = *retries
+
+	g := ignite.NewGenerator(os.DirFS("."), ignite.DirSink("bootstrap"))
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		log.Fatalf("Failed to read node config: %v\n", err)
+	}
+	if *release == "" && *project == "" && *version == "" {
+		fetchSecrets(conf, f)
+		return
+	}
+	if *project == "" || *version == "" {
+		log.Fatalf("Both -project and -version are needed to write the checksums of a release\n")
+	}
+	pv := ignite.ProjectVersion{
+		Name:    ignite.ProjectName(*project),
+		Version: ignite.Version(*version),
+	}
+	if *release != "" {
+		lines, err := conf.ReleaseChecksums(os.DirFS(*release), pv)
+		if err != nil {
+			log.Fatalf("Failed to checksum release of %s %s in %q: %v\n", pv.Name, pv.Version, *release, err)
 		}
+		writeRelease(conf, f, pv, lines)
+		return
+	}
+	keyring, err := ignite.ReadKeyring(os.DirFS(*keys), ".")
+	if err != nil {
+		log.Fatalf("Failed to read keyring: %v\n", err)
+	}
+	lines, err := conf.SignedChecksums(f, pv, keyring)
+	if err != nil {
+		log.Fatalf("Failed to fetch checksums: %v\n", err)
 	}
+	writeRelease(conf, f, pv, lines)
 }
@@ -144,7 +144,7 @@ resource "google_compute_instance" "decenter-world" {
   metadata {
     sshKeys = "core:${var.admin2_decenter_world_pubkey}"
     version = "${var.infra_version}"
-    user-data = "${file("bootstrap/decenter_world.json")}"
+    user-data = "${var.nodes["decenter_world"].user_data}"
   }
 }
 
@@ -168,7 +168,7 @@ resource "google_compute_instance" "builder" {
   metadata {
     sshKeys = "core:${var.admin2_builder_pubkey}"
     version = "${var.infra_version}"
-    user-data = "${file("bootstrap/builder.json")}"
+    user-data = "${var.nodes["builder"].user_data}"
   }
 }
 
@@ -4,33 +4,43 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 	"os/user"
+	"path/filepath"
 
 	"hkjn.me/src/infra/ignite"
 	"hkjn.me/src/infra/secretservice"
 )
 
 func main() {
+	cache := flag.String("cache", ignite.DefaultCacheDir(), "directory to cache the results of probing mirrors in, or \"\" for none")
+	offline := flag.Bool("offline", false, "choose mirrors from the results cached in -cache by the last online run")
+	flag.Parse()
+
 	sshash, err := secretservice.GetHash()
 	if err != nil {
 		log.Fatalf("Unable to fetch secret service hash: %v\n", err)
 	}
 	log.Printf("Read %d character secret service hash.\n", len(sshash))
 
-	ns, err := ignite.CreateNodes()
-	if err != nil {
-		log.Fatalf("Failed to create nodes: %v\n", err)
+	g := ignite.NewGenerator(os.DirFS("."), ignite.DirSink("bootstrap"))
+	g.SecretServiceHash = sshash
+	g.Fetcher = ignite.NewFetcher(*cache)
+	g.Fetcher.Offline = *offline
+	g.TerraformOut = ignite.DirSink(".")
+	g.ServedOut = ignite.DirSink(filepath.Join("bootstrap", ignite.ServedDir))
+	if key, err := os.ReadFile(ignite.DefaultTokenKeyPath); err == nil {
+		g.TokenKey = key
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Unable to read token key: %v\n", err)
 	}
-	for _, n := range ns {
-		log.Printf("Writing Ignition config for %v..\n", n)
-		err := n.Write()
-		if err != nil {
-			u, uerr := user.Current()
-			if uerr != nil {
-				log.Fatalf("Failed to write node config, also failed to find current user (%v): %v\n", uerr, err)
-			}
-			log.Fatalf("Failed to write node config as user %v:%v: %v\n", u.Uid, u.Gid, err)
+	if _, err := g.Generate(); err != nil {
+		u, uerr := user.Current()
+		if uerr != nil {
+			log.Fatalf("Failed to generate node configs, also failed to find current user (%v): %v\n", uerr, err)
 		}
+		log.Fatalf("Failed to generate node configs as user %v:%v: %v\n", u.Uid, u.Gid, err)
 	}
 }
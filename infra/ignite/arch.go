@@ -0,0 +1,85 @@
+package ignite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// resolve returns the name of the release artifact to use for the file
+// on a node with the given arch, and the key of its checksum.
+//
+// Files name a logical binary, e.g. "tclient", which is resolved by:
+//
+//  1. the explicit arch mapping of the file, if it has one, or
+//  2. the name itself, if the file is arch independent, like the
+//     "gather_facts" script, or
+//  3. the "<name>_<arch>" naming convention used by our releases,
+//     e.g. "tclient_x86_64", or else the name itself.
+//
+// The checksum key is the name of the artifact, or the ChecksumKey of
+// the file, which follows the same "<key>_<arch>" convention.
+func (f NodeFile) resolve(pv ProjectVersion, arch string, sums checksums) (string, string, error) {
+	if err := f.validateArch(); err != nil {
+		return "", "", err
+	}
+	name, key := f.Name, f.checksumKey()
+	if len(f.Arch) > 0 {
+		archName, exists := f.Arch[arch]
+		if !exists {
+			return "", "", fmt.Errorf(
+				"file %q of %s %s has no artifact for arch %q, only for %s",
+				f.Name,
+				pv.Name,
+				pv.Version,
+				arch,
+				strings.Join(f.archs(), ", "),
+			)
+		}
+		name, key = archName, archName
+	} else if arch != "" && !f.ArchIndependent {
+		if _, exists := sums[fmt.Sprintf("%s_%s", key, arch)]; exists {
+			name = fmt.Sprintf("%s_%s", f.Name, arch)
+			key = fmt.Sprintf("%s_%s", key, arch)
+		}
+	}
+	if _, exists := sums[key]; !exists {
+		if arch == "" {
+			return "", "", fmt.Errorf(
+				"release %s %s has no artifact %q (missing checksum for %q in checksums/%s_%s.sha512)",
+				pv.Name, pv.Version, f.Name, key, pv.Name, pv.Version,
+			)
+		}
+		return "", "", fmt.Errorf(
+			"release %s %s has no artifact %q for arch %q (missing checksum for %q in checksums/%s_%s.sha512)",
+			pv.Name, pv.Version, f.Name, arch, key, pv.Name, pv.Version,
+		)
+	}
+	return name, key, nil
+}
+
+// validateArch checks that the file doesn't combine an explicit arch
+// mapping with a checksum key or being arch independent, which both
+// only apply to files resolved by name.
+func (f NodeFile) validateArch() error {
+	if len(f.Arch) == 0 {
+		return nil
+	}
+	if f.ChecksumKey != "" {
+		return fmt.Errorf("file %q can't have both an arch mapping and a checksum_key, since its artifacts are checksummed by their mapped names", f.Name)
+	}
+	if f.ArchIndependent {
+		return fmt.Errorf("file %q can't have both an arch mapping and be arch_independent", f.Name)
+	}
+	return nil
+}
+
+// archs returns the archs the file has explicit artifacts for, in sorted order.
+func (f NodeFile) archs() []string {
+	result := []string{}
+	for arch := range f.Arch {
+		result = append(result, arch)
+	}
+	sort.Strings(result)
+	return result
+}
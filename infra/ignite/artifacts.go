@@ -0,0 +1,99 @@
+package ignite
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+type (
+	// ArtifactSources describes where release artifacts are fetched from.
+	//
+	// The templates are text/template strings that can refer to .Project,
+	// .Version and .File, e.g.
+	// "https://github.com/hkjn/{{.Project}}/releases/download/{{.Version}}/{{.File}}".
+	ArtifactSources struct {
+		// URLTemplate is the template for artifact URLs.
+		URLTemplate string `json:"url_template,omitempty"`
+		// Mirrors are templates for artifact URLs that are tried in order
+		// before URLTemplate; the first one serving the artifact is used.
+		Mirrors []string `json:"mirrors,omitempty"`
+	}
+	// artifact is a single file in a release of a project.
+	artifact struct {
+		Project ProjectName
+		Version Version
+		File    string
+	}
+)
+
+// defaultURLTemplate is the template used if no url_template is configured.
+const defaultURLTemplate = "https://github.com/hkjn/{{.Project}}/releases/download/{{.Version}}/{{.File}}"
+
+// merge returns the sources with any fields set in override replacing ours.
+func (as ArtifactSources) merge(override *ArtifactSources) ArtifactSources {
+	if override == nil {
+		return as
+	}
+	if override.URLTemplate != "" {
+		as.URLTemplate = override.URLTemplate
+	}
+	if override.Mirrors != nil {
+		as.Mirrors = override.Mirrors
+	}
+	return as
+}
+
+// getArtifactSources returns the artifact sources for the project.
+func (conf Config) getArtifactSources(name ProjectName) ArtifactSources {
+	return conf.Artifacts.merge(conf.ProjectConfigs[name].Artifacts)
+}
+
+// render returns the URL from the template for the artifact.
+func (a artifact) render(tmpl string) (string, error) {
+	t, err := template.New("url").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("bad URL template %q: %v", tmpl, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, a); err != nil {
+		return "", fmt.Errorf("bad URL template %q: %v", tmpl, err)
+	}
+	return buf.String(), nil
+}
+
+// validate checks that all templates in the sources parse.
+func (as ArtifactSources) validate(path string, problems *Problems) {
+	a := artifact{Project: "p", Version: "v", File: "f"}
+	if as.URLTemplate != "" {
+		if _, err := a.render(as.URLTemplate); err != nil {
+			problems.add(path+".url_template", "%v", err)
+		}
+	}
+	for i, m := range as.Mirrors {
+		if _, err := a.render(m); err != nil {
+			problems.add(fmt.Sprintf("%s.mirrors[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// getURL returns the URL to fetch the artifact from.
+//
+// The first mirror that serves the artifact, as probed by f, is used,
+// falling back to the URL template.
+func (as ArtifactSources) getURL(a artifact, f *Fetcher) (string, error) {
+	for _, m := range as.Mirrors {
+		url, err := a.render(m)
+		if err != nil {
+			return "", err
+		}
+		if f.Available(url) {
+			return url, nil
+		}
+	}
+	tmpl := as.URLTemplate
+	if tmpl == "" {
+		tmpl = defaultURLTemplate
+	}
+	return a.render(tmpl)
+}
@@ -0,0 +1,76 @@
+package ignite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestArtifactSourcesGetURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/good/hkjninfra/1.5.13/tclient_x86_64" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	a := artifact{Project: "hkjninfra", Version: "1.5.13", File: "tclient_x86_64"}
+	cases := []struct {
+		desc    string
+		in      ArtifactSources
+		want    string
+		wantErr bool
+	}{
+		{
+			desc: "default template",
+			in:   ArtifactSources{},
+			want: "https://github.com/hkjn/hkjninfra/releases/download/1.5.13/tclient_x86_64",
+		},
+		{
+			desc: "custom template",
+			in: ArtifactSources{
+				URLTemplate: "https://fileserver.hkjn.me/{{.Project}}/{{.Version}}/{{.File}}",
+			},
+			want: "https://fileserver.hkjn.me/hkjninfra/1.5.13/tclient_x86_64",
+		},
+		{
+			desc: "first serving mirror is used",
+			in: ArtifactSources{
+				Mirrors: []string{
+					srv.URL + "/bad/{{.Project}}/{{.Version}}/{{.File}}",
+					srv.URL + "/good/{{.Project}}/{{.Version}}/{{.File}}",
+				},
+			},
+			want: srv.URL + "/good/hkjninfra/1.5.13/tclient_x86_64",
+		},
+		{
+			desc: "falls back to template when no mirror serves",
+			in: ArtifactSources{
+				URLTemplate: "https://fileserver.hkjn.me/{{.File}}",
+				Mirrors:     []string{srv.URL + "/bad/{{.File}}"},
+			},
+			want: "https://fileserver.hkjn.me/tclient_x86_64",
+		},
+		{
+			desc:    "unknown field",
+			in:      ArtifactSources{URLTemplate: "https://example.com/{{.Nope}}"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range cases {
+		got, err := tt.in.getURL(a, NewFetcher(""))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: getURL() = %q, want error", tt.desc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: getURL() returned error: %v", tt.desc, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: getURL() = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
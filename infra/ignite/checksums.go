@@ -0,0 +1,174 @@
+package ignite
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+)
+
+// ChecksumFile returns the path of the checksums of the project version,
+// e.g. "checksums/hkjninfra_1.5.13.sha512".
+func (pv ProjectVersion) ChecksumFile() string {
+	return fmt.Sprintf("checksums/%s_%s.sha512", pv.Name, pv.Version)
+}
+
+// checksumLine returns the line of a checksum file for data under key.
+func checksumLine(key string, data []byte) string {
+	return fmt.Sprintf("%x  %s\n", sha512.Sum512(data), key)
+}
+
+// archs returns the archs of the nodes, in sorted order.
+func (conf NodeConfigs) archs() []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, nc := range conf {
+		if nc.Arch != "" && !seen[nc.Arch] {
+			seen[nc.Arch] = true
+			result = append(result, nc.Arch)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// releaseArtifact is an artifact in a release, and the key of its checksum.
+type releaseArtifact struct {
+	name, key string
+}
+
+// artifacts returns the artifacts of the file that exist in a release,
+// for any of the archs.
+//
+// The artifacts are found as resolve finds them on nodes: by the
+// explicit arch mapping of the file, all of which must exist, by the
+// name itself for arch independent files, or else by the
+// "<name>_<arch>" convention and the name itself.
+func (f NodeFile) artifacts(exists func(name string) bool, archs []string) ([]releaseArtifact, error) {
+	if err := f.validateArch(); err != nil {
+		return nil, err
+	}
+	result := []releaseArtifact{}
+	if len(f.Arch) > 0 {
+		for _, arch := range f.archs() {
+			if !exists(f.Arch[arch]) {
+				return nil, fmt.Errorf("release has no artifact %q for file %q on arch %q", f.Arch[arch], f.Name, arch)
+			}
+			result = append(result, releaseArtifact{name: f.Arch[arch], key: f.Arch[arch]})
+		}
+		return result, nil
+	}
+	if !f.ArchIndependent {
+		for _, arch := range archs {
+			if name := fmt.Sprintf("%s_%s", f.Name, arch); exists(name) {
+				result = append(result, releaseArtifact{name: name, key: fmt.Sprintf("%s_%s", f.checksumKey(), arch)})
+			}
+		}
+	}
+	if exists(f.Name) {
+		result = append(result, releaseArtifact{name: f.Name, key: f.checksumKey()})
+	}
+	if len(result) == 0 {
+		if f.ArchIndependent {
+			return nil, fmt.Errorf("release has no artifact %q", f.Name)
+		}
+		return nil, fmt.Errorf("release has no artifact %q, or %q_<arch> for any of %s", f.Name, f.Name, strings.Join(archs, ", "))
+	}
+	return result, nil
+}
+
+// ReleaseChecksums returns the checksum lines of the files of the
+// project version, computed from the artifacts in release, e.g. the
+// output directory of a build.
+//
+// Artifacts are checksummed for the archs of all nodes in the config.
+func (conf Config) ReleaseChecksums(release fs.FS, pv ProjectVersion) (checksumlines, error) {
+	pc, exists := conf.ProjectConfigs[pv.Name]
+	if !exists {
+		return nil, fmt.Errorf("no project %q", pv.Name)
+	}
+	inRelease := func(name string) bool {
+		info, err := fs.Stat(release, name)
+		return err == nil && !info.IsDir()
+	}
+	archs := conf.NodeConfigs.archs()
+	result := checksumlines{}
+	for _, f := range pc.Files {
+		artifacts, err := f.artifacts(inRelease, archs)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range artifacts {
+			b, err := fs.ReadFile(release, a.name)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Checksummed artifact %q of %s %s..\n", a.name, pv.Name, pv.Version)
+			result = append(result, checksumLine(a.key, b))
+		}
+	}
+	return result, nil
+}
+
+// SecretChecksums returns the checksum lines of the secrets of the
+// project version, fetched by f from the secret service with given hash.
+func (conf Config) SecretChecksums(f *Fetcher, sshash string, pv ProjectVersion) (checksumlines, error) {
+	secrets, err := conf.ProjectConfigs.GetSecrets(pv.Name)
+	if err != nil {
+		return nil, err
+	}
+	reqs := []FetchRequest{}
+	for _, s := range secrets {
+		reqs = append(reqs, FetchRequest{URL: s.GetURL(conf.SecretServiceDomain, sshash, pv)})
+	}
+	log.Printf("Fetching and checksumming %d secrets of %s %s..\n", len(reqs), pv.Name, pv.Version)
+	result := checksumlines{}
+	for i, r := range f.FetchAll(reqs) {
+		if r.Err != nil {
+			return nil, fmt.Errorf("failed to fetch secret %q: %v", secrets[i].Name, r.Err)
+		}
+		result = append(result, checksumLine(secrets[i].Name, r.Data))
+	}
+	return result, nil
+}
+
+// MergeChecksums returns the checksum file data with its lines for the
+// keys of lines replaced by them, and the rest of lines added last.
+func MergeChecksums(data []byte, lines []string) ([]byte, error) {
+	replaced := map[string]string{}
+	keys := []string{}
+	for _, line := range lines {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid checksum line %q", line)
+		}
+		if _, exists := replaced[parts[1]]; !exists {
+			keys = append(keys, parts[1])
+		}
+		replaced[parts[1]] = strings.TrimSuffix(line, "\n") + "\n"
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in checksum file: %q", line)
+		}
+		if l, exists := replaced[parts[1]]; exists {
+			b.WriteString(l)
+			delete(replaced, parts[1])
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	for _, key := range keys {
+		if l, exists := replaced[key]; exists {
+			b.WriteString(l)
+		}
+	}
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,56 @@
+package ignite
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReleaseChecksums(t *testing.T) {
+	g := NewGenerator(newTestFS(testConfig), mapSink{})
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		t.Fatalf("ReadConfigWithoutChecksums() returned error: %v", err)
+	}
+	release := fstest.MapFS{
+		"gather_facts":   {Data: []byte("facts")},
+		"tclient_armv7l": {Data: []byte("arm")},
+		"tclient_x86_64": {Data: []byte("x86")},
+		"unrelated":      {Data: []byte("?")},
+	}
+	pv := ProjectVersion{Name: "hkjninfra", Version: "1.5.14"}
+	got, err := conf.ReleaseChecksums(release, pv)
+	if err != nil {
+		t.Fatalf("ReleaseChecksums() returned error: %v", err)
+	}
+	want := fmt.Sprintf("%x  gather_facts\n%x  tclient_armv7l\n%x  tclient_x86_64\n",
+		sha512.Sum512([]byte("facts")),
+		sha512.Sum512([]byte("arm")),
+		sha512.Sum512([]byte("x86")),
+	)
+	if strings.Join(got, "") != want {
+		t.Errorf("ReleaseChecksums() got\n%s\nwant\n%s", strings.Join(got, ""), want)
+	}
+
+	delete(release, "gather_facts")
+	if _, err := conf.ReleaseChecksums(release, pv); err == nil || !strings.Contains(err.Error(), `no artifact "gather_facts"`) {
+		t.Errorf("ReleaseChecksums() without gather_facts returned error %v", err)
+	}
+}
+
+func TestMergeChecksums(t *testing.T) {
+	existing := "aaa  tclient_x86_64\nbbb  client.pem\nccc  gather_facts\n"
+	got, err := MergeChecksums([]byte(existing), []string{"ddd  client.pem\n", "eee  mon_ca.pem\n"})
+	if err != nil {
+		t.Fatalf("MergeChecksums() returned error: %v", err)
+	}
+	want := "aaa  tclient_x86_64\nddd  client.pem\nccc  gather_facts\neee  mon_ca.pem\n"
+	if string(got) != want {
+		t.Errorf("MergeChecksums() got\n%s\nwant\n%s", got, want)
+	}
+	if _, err := MergeChecksums([]byte("aaa\n"), nil); err == nil {
+		t.Errorf("MergeChecksums() of invalid file succeeded")
+	}
+}
@@ -0,0 +1,269 @@
+package ignite
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The types below model the parts of a cloud-init #cloud-config document
+// we use, for nodes running images without Ignition, like Debian or
+// Ubuntu. Files with contents go in write_files, while binaries and
+// secrets are fetched by fetchScript from runcmd, which also enables the
+// units.
+type (
+	cloudUser struct {
+		Name              string   `yaml:"name"`
+		Passwd            string   `yaml:"passwd,omitempty"`
+		LockPasswd        *bool    `yaml:"lock_passwd,omitempty"`
+		SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+		Groups            string   `yaml:"groups,omitempty"`
+		UID               *int     `yaml:"uid,omitempty"`
+		Shell             string   `yaml:"shell,omitempty"`
+	}
+	cloudFilesystem struct {
+		Label      string `yaml:"label,omitempty"`
+		Filesystem string `yaml:"filesystem"`
+		Device     string `yaml:"device"`
+		Overwrite  bool   `yaml:"overwrite,omitempty"`
+	}
+	cloudFile struct {
+		Path        string `yaml:"path"`
+		Content     string `yaml:"content"`
+		Permissions string `yaml:"permissions"`
+		Owner       string `yaml:"owner,omitempty"`
+	}
+	// CloudConfig is a cloud-init #cloud-config document.
+	CloudConfig struct {
+		Bootcmd    []string          `yaml:"bootcmd,omitempty"`
+		Users      []cloudUser       `yaml:"users,omitempty"`
+		FSSetup    []cloudFilesystem `yaml:"fs_setup,omitempty"`
+		WriteFiles []cloudFile       `yaml:"write_files,omitempty"`
+		Runcmd     []string          `yaml:"runcmd,omitempty"`
+	}
+)
+
+const (
+	// outputIgnition is the output of nodes booting with Ignition, the default.
+	outputIgnition = "ignition"
+	// outputCloudInit is the output of nodes booting with cloud-init.
+	outputCloudInit = "cloud-init"
+	// cloudConfigHeader is the first line cloud-init expects of the document.
+	cloudConfigHeader = "#cloud-config\n"
+	// systemdDir is where units are written on cloud-init nodes.
+	systemdDir = "/etc/systemd/system"
+	// fetchScriptPath is where fetchScript is written on cloud-init nodes.
+	fetchScriptPath = "/usr/local/lib/ignite/fetch"
+)
+
+// fetchScript downloads a file, checks its sha512 checksum and only then
+// moves it into place, with given mode and owners. Its args are the URL,
+// checksum, path, mode, user and group.
+//
+// It downloads with curl, or wget on images without curl, and fails
+// saying so if there's neither.
+const fetchScript = `#!/bin/sh
+set -eu
+url=$1 checksum=$2 dest=$3 mode=$4 user=$5 group=$6
+mkdir -p "$(dirname "$dest")"
+tmp="$dest.part"
+if command -v curl >/dev/null; then
+	curl -fsSL --retry 5 -o "$tmp" "$url"
+elif command -v wget >/dev/null; then
+	wget -q --tries=5 -O "$tmp" "$url"
+else
+	echo "can't fetch $url: neither curl nor wget is installed" >&2
+	exit 1
+fi
+if ! echo "$checksum  $tmp" | sha512sum -c --quiet -; then
+	rm -f "$tmp"
+	echo "checksum mismatch for $url" >&2
+	exit 1
+fi
+chmod "$mode" "$tmp"
+chown "$user:$group" "$tmp"
+mv "$tmp" "$dest"
+`
+
+// safeArgRE matches arguments that don't need quoting in shell commands.
+var safeArgRE = regexp.MustCompile(`^[A-Za-z0-9@%+=:,./_-]+$`)
+
+// shellQuote returns the args as a shell command line, quoting them as needed.
+func shellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		if safeArgRE.MatchString(a) {
+			quoted[i] = a
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// getOutput returns the output the node's config is generated for.
+func (nc NodeConfig) getOutput() (string, error) {
+	switch nc.Output {
+	case "", outputIgnition:
+		return outputIgnition, nil
+	case outputCloudInit:
+		return outputCloudInit, nil
+	}
+	return "", fmt.Errorf("unsupported output %q, want %q or %q", nc.Output, outputIgnition, outputCloudInit)
+}
+
+// validateCloudInit checks that the node doesn't use features cloud-init
+// configs can't express.
+func (nc NodeConfig) validateCloudInit() error {
+	if len(nc.Storage.Disks) > 0 {
+		return fmt.Errorf("disks can't be partitioned with output %q", outputCloudInit)
+	}
+	return nil
+}
+
+// ownerString returns the owner as chown understands it, defaulting to root.
+func ownerString(o *Owner) string {
+	if o == nil || (o.ID == nil && o.Name == "") {
+		return "root"
+	}
+	if o.Name != "" {
+		return o.Name
+	}
+	return fmt.Sprintf("%d", *o.ID)
+}
+
+// toCloudUser returns the cloud-init form of the user.
+func (u User) toCloudUser() cloudUser {
+	result := cloudUser{
+		Name:              u.Name,
+		SSHAuthorizedKeys: u.SSHAuthorizedKeys,
+		Groups:            strings.Join(u.Groups, ", "),
+		UID:               u.UID,
+		Shell:             u.Shell,
+	}
+	if u.PasswordHash != "" {
+		unlocked := false
+		result.Passwd = u.PasswordHash
+		result.LockPasswd = &unlocked
+	}
+	return result
+}
+
+// getCloudConfig returns the cloud-init config for the node.
+//
+// Update policies only apply to Ignition nodes, so they aren't included.
+func (n node) getCloudConfig() CloudConfig {
+	result := CloudConfig{}
+	for _, g := range n.passwd.Groups {
+		args := []string{"groupadd", "-f"}
+		if g.GID != nil {
+			args = append(args, "-g", fmt.Sprintf("%d", *g.GID))
+		}
+		result.Bootcmd = append(result.Bootcmd, shellQuote(append(args, g.Name)...))
+	}
+	for _, u := range n.passwd.Users {
+		result.Users = append(result.Users, u.toCloudUser())
+	}
+	for _, f := range n.storage.Filesystems {
+		result.FSSetup = append(result.FSSetup, cloudFilesystem{
+			Label:      f.Label,
+			Filesystem: f.Format,
+			Device:     f.Device,
+			Overwrite:  f.WipeFilesystem,
+		})
+	}
+	write := func(p, contents string, mode int) {
+		result.WriteFiles = append(result.WriteFiles, cloudFile{
+			Path:        p,
+			Content:     contents,
+			Permissions: fmt.Sprintf("%04o", mode),
+			Owner:       "root:root",
+		})
+	}
+	if len(n.binaries)+len(n.secrets) > 0 {
+		write(fetchScriptPath, fetchScript, 0755)
+	}
+	for _, u := range n.networkdUnits {
+		write(path.Join(networkdDir, u.Name), u.Contents, 0644)
+	}
+	mounts, enable := []string{}, []string{}
+	for _, u := range n.systemdUnits {
+		if u.Contents != "" {
+			write(path.Join(systemdDir, u.Name), u.Contents, 0644)
+			switch {
+			case !u.Enable:
+			case strings.HasSuffix(u.Name, ".mount"):
+				mounts = append(mounts, u.Name)
+			default:
+				enable = append(enable, u.Name)
+			}
+		}
+		for _, d := range u.Dropins {
+			write(path.Join(systemdDir, u.Name+".d", d.Name), d.Contents, 0644)
+		}
+	}
+
+	result.Runcmd = append(result.Runcmd, "systemctl daemon-reload")
+	if len(n.networkdUnits) > 0 {
+		// Images like Debian don't run systemd-networkd by default, and
+		// it only reads the units written above when it (re)starts.
+		result.Runcmd = append(result.Runcmd,
+			"systemctl enable systemd-networkd.service",
+			"systemctl restart systemd-networkd.service",
+		)
+	}
+	if len(mounts) > 0 {
+		result.Runcmd = append(result.Runcmd, shellQuote(append([]string{"systemctl", "enable", "--now"}, mounts...)...))
+	}
+	for _, d := range n.storage.Directories {
+		mode := d.Mode
+		if mode == 0 {
+			mode = defaultDirectoryMode
+		}
+		result.Runcmd = append(result.Runcmd, shellQuote(
+			"install", "-d",
+			"-m", fmt.Sprintf("%04o", mode),
+			"-o", ownerString(d.User),
+			"-g", ownerString(d.Group),
+			d.Path,
+		))
+	}
+	for _, l := range n.storage.Links {
+		flags := "-sfn"
+		if l.Hard {
+			flags = "-fn"
+		}
+		result.Runcmd = append(result.Runcmd, shellQuote("ln", flags, l.Target, l.Path))
+	}
+	for _, b := range append(append([]binary{}, n.binaries...), n.secrets...) {
+		mode := b.mode
+		if mode == 0 {
+			mode = 0755
+		}
+		result.Runcmd = append(result.Runcmd, shellQuote(
+			"sh", fetchScriptPath,
+			b.url,
+			b.checksum,
+			b.path,
+			fmt.Sprintf("%04o", mode),
+			ownerString(b.user),
+			ownerString(b.group),
+		))
+	}
+	if len(enable) > 0 {
+		result.Runcmd = append(result.Runcmd, shellQuote(append([]string{"systemctl", "enable", "--now"}, enable...)...))
+	}
+	return result
+}
+
+// marshalCloudConfig returns the config as a #cloud-config document.
+func marshalCloudConfig(conf CloudConfig) ([]byte, error) {
+	b, err := yaml.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader), b...), nil
+}
@@ -0,0 +1,111 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestGenerateCloudInit(t *testing.T) {
+	conf := strings.Replace(testConfig, `"arch": "armv7l",
+			"ignition_version": "3.0.0",`, `"arch": "armv7l",
+			"output": "cloud-init",
+			"update": {"channel": "beta"},
+			"networkd": [{"name": "10-eth0.network", "contents": "[Match]\nName=eth0\n"}],
+			"passwd": {
+				"users": [{"name": "hkjn", "ssh_authorized_keys": ["ssh-ed25519 AAAA hkjn@laptop"], "groups": ["sudo", "docker"]}],
+				"groups": [{"name": "docker", "gid": 999}]
+			},
+			"storage": {
+				"filesystems": [{"device": "/dev/sda1", "format": "ext4", "label": "data", "path": "/data"}],
+				"links": [{"path": "/opt/data", "target": "/data"}]
+			},`, 1)
+	out := mapSink{}
+	g := NewGenerator(newTestFS(conf), out)
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	arm := outputs[0]
+	if arm.CloudInit == nil || arm.V2 != nil || arm.V3 != nil {
+		t.Fatalf("Generate() for arm = %+v, want cloud-init config", arm)
+	}
+	if arm.FileName() != "arm.yaml" || outputs[1].FileName() != "core.json" {
+		t.Errorf("Generate() wrote %q and %q, want arm.yaml and core.json", arm.FileName(), outputs[1].FileName())
+	}
+	data := string(out["arm.yaml"])
+	if !strings.HasPrefix(data, "#cloud-config\n") {
+		t.Errorf("Generate() wrote %q, want #cloud-config header", data)
+	}
+	got := CloudConfig{}
+	if err := yaml.Unmarshal(out["arm.yaml"], &got); err != nil {
+		t.Fatalf("Generate() wrote bad YAML: %v", err)
+	}
+	if !reflect.DeepEqual(got, *arm.CloudInit) {
+		t.Errorf("Generate() wrote %+v, want %+v", got, *arm.CloudInit)
+	}
+
+	if want := []string{"groupadd -f -g 999 docker"}; !reflect.DeepEqual(got.Bootcmd, want) {
+		t.Errorf("Generate() got bootcmd %q, want %q", got.Bootcmd, want)
+	}
+	wantUsers := []cloudUser{{Name: "hkjn", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA hkjn@laptop"}, Groups: "sudo, docker"}}
+	if !reflect.DeepEqual(got.Users, wantUsers) {
+		t.Errorf("Generate() got users %+v, want %+v", got.Users, wantUsers)
+	}
+	gotFiles := []string{}
+	for _, f := range got.WriteFiles {
+		gotFiles = append(gotFiles, f.Path+" "+f.Permissions)
+	}
+	wantFiles := []string{
+		"/usr/local/lib/ignite/fetch 0755",
+		"/etc/systemd/network/10-eth0.network 0644",
+		"/etc/systemd/system/tclient.service 0644",
+		"/etc/systemd/system/data.mount 0644",
+	}
+	if !reflect.DeepEqual(gotFiles, wantFiles) {
+		t.Errorf("Generate() got write_files %q, want %q", gotFiles, wantFiles)
+	}
+	wantCmds := []string{
+		"systemctl daemon-reload",
+		"systemctl enable systemd-networkd.service",
+		"systemctl restart systemd-networkd.service",
+		"systemctl enable --now data.mount",
+		"ln -sfn /data /opt/data",
+		"sh /usr/local/lib/ignite/fetch https://github.com/hkjn/hkjninfra/releases/download/1.5.13/gather_facts ccc /opt/bin/gather_facts 0755 root root",
+		"sh /usr/local/lib/ignite/fetch https://github.com/hkjn/hkjninfra/releases/download/1.5.13/tclient_armv7l aaa /opt/bin/tclient 0755 root root",
+		"sh /usr/local/lib/ignite/fetch https://secrets.example.com/123abc/files/hkjninfra/1.5.13/certs/client.pem ddd /etc/ssl/client.pem 0600 root root",
+		"systemctl enable --now tclient.service",
+	}
+	if !reflect.DeepEqual(got.Runcmd, wantCmds) {
+		t.Errorf("Generate() got runcmd\n%s\nwant\n%s", strings.Join(got.Runcmd, "\n"), strings.Join(wantCmds, "\n"))
+	}
+
+	fsys := newTestFS(conf)
+	fsys["bootstrap/arm.yaml"] = &fstest.MapFile{Data: out["arm.yaml"]}
+	fsys["bootstrap/core.json"] = &fstest.MapFile{Data: out["core.json"]}
+	fsys["units/tclient.service"] = &fstest.MapFile{Data: []byte("[Service]\nExecStart=/opt/bin/tclient\n")}
+	g = NewGenerator(fsys, mapSink{})
+	g.SecretServiceHash = "123abc"
+	c, err := g.ReadConfig()
+	if err != nil {
+		t.Fatalf("ReadConfig() returned error: %v", err)
+	}
+	diffs, err := g.Diff(*c, "bootstrap")
+	if err != nil {
+		t.Fatalf("Diff() returned error: %v", err)
+	}
+	if len(diffs) != 2 || diffs[0].Node != "arm" || len(diffs[0].Changes) != 1 || diffs[0].Changes[0].Kind != "cloud-init" {
+		t.Errorf("Diff() = %+v, want cloud-init change for arm", diffs)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	got := shellQuote("install", "-d", "/var/lib/my data", "it's")
+	if want := `install -d '/var/lib/my data' 'it'\''s'`; got != want {
+		t.Errorf("shellQuote() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,646 @@
+// ignite is a tool for working with config.json and the Ignition configs
+// generated from it.
+//
+// It should be run from the infra/ directory, e.g.:
+//
+//	go run ./ignite/cmd validate
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"hkjn.me/src/infra/ignite"
+	"hkjn.me/src/infra/secretservice"
+)
+
+// command is a subcommand of the tool.
+type command struct {
+	// desc is a one-line description of the command.
+	desc string
+	// run runs the command with given args, returning the exit code.
+	run func(args []string) int
+}
+
+var commands = map[string]command{
+	"diff": {
+		desc: "show what would change in bootstrap/ when regenerating configs",
+		run:  diff,
+	},
+	"inventory": {
+		desc: "print which nodes run which project versions",
+		run:  inventory,
+	},
+	"rollout": {
+		desc: "roll out a project version to nodes in stages",
+		run:  rollout,
+	},
+	"serve": {
+		desc: "serve the configs of served nodes over HTTPS",
+		run:  serve,
+	},
+	"show": {
+		desc: "print the effective config of nodes, with their groups applied",
+		run:  show,
+	},
+	"validate": {
+		desc: "check config.json against units/ and checksums/",
+		run:  validate,
+	},
+	"verify": {
+		desc: "fetch every source in bootstrap/ and check it against its hash",
+		run:  verify,
+	},
+	"wireguard": {
+		desc: "generate keys for the nodes of WireGuard meshes that have none",
+		run:  wireguard,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].desc)
+	}
+}
+
+// newGenerator returns a generator reading inputs from the current
+// directory and writing configs to bootstrap/.
+func newGenerator() *ignite.Generator {
+	g := ignite.NewGenerator(os.DirFS("."), ignite.DirSink("bootstrap"))
+	g.Fetcher = ignite.NewFetcher(ignite.DefaultCacheDir())
+	return g
+}
+
+// newFullGenerator returns a generator like newGenerator, also writing
+// served configs and Terraform variables, as generate_ignite_configs.go does.
+func newFullGenerator(sshash string) *ignite.Generator {
+	g := newGenerator()
+	g.SecretServiceHash = getHash(sshash)
+	g.TerraformOut = ignite.DirSink(".")
+	g.ServedOut = ignite.DirSink(filepath.Join("bootstrap", ignite.ServedDir))
+	if key, err := os.ReadFile(ignite.DefaultTokenKeyPath); err == nil {
+		g.TokenKey = key
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("Unable to read token key: %v\n", err)
+	}
+	return g
+}
+
+// getHash returns the secret service hash, unless one was given.
+func getHash(sshash string) string {
+	if sshash != "" {
+		return sshash
+	}
+	sshash, err := secretservice.GetHash()
+	if err != nil {
+		log.Fatalf("Unable to fetch secret service hash: %v\n", err)
+	}
+	return sshash
+}
+
+// diff prints the changes to bootstrap/ that generating configs would
+// make, exiting with 1 if there are any and 2 on errors.
+func diff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print changes as JSON")
+	sshash := flags.String("sshash", "", "secret service hash to use, instead of reading it from /etc/secrets")
+	offline := flags.Bool("offline", false, "choose mirrors from the results cached by the last online run")
+	flags.Parse(args)
+
+	g := newGenerator()
+	g.SecretServiceHash = getHash(*sshash)
+	g.Fetcher.Offline = *offline
+	conf, err := g.ReadConfig()
+	if err != nil {
+		log.Printf("Failed to read config: %v\n", err)
+		return 2
+	}
+	diffs, err := g.Diff(*conf, "bootstrap")
+	if err != nil {
+		log.Printf("Failed to diff configs: %v\n", err)
+		return 2
+	}
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(diffs); err != nil {
+			log.Printf("Failed to encode changes: %v\n", err)
+			return 2
+		}
+	} else {
+		for _, d := range diffs {
+			fmt.Println(d)
+		}
+	}
+	if len(diffs) > 0 {
+		log.Printf("Configs of %d nodes would change.\n", len(diffs))
+		return 1
+	}
+	log.Printf("No configs would change.\n")
+	return 0
+}
+
+// verify checks the sources of the generated configs of the nodes named
+// in args, or all nodes, exiting with 1 if any fail and 2 on errors.
+func verify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print results as JSON")
+	dir := flags.String("dir", "bootstrap", "directory of generated configs to verify")
+	concurrency := flags.Int("concurrency", 8, "most sources to fetch at once")
+	flags.Parse(args)
+
+	// Sources are always fetched, since a cached copy proves nothing
+	// about what nodes will get.
+	f := ignite.NewFetcher("")
+	f.Concurrency = *concurrency
+	checks, err := newGenerator().Verify(f, *dir, flags.Args()...)
+	if err != nil {
+		log.Printf("Failed to verify configs: %v\n", err)
+		return 2
+	}
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(checks); err != nil {
+			log.Printf("Failed to encode results: %v\n", err)
+			return 2
+		}
+	} else {
+		for _, c := range checks {
+			fmt.Println(c)
+		}
+	}
+	if !checks.OK() {
+		log.Printf("Some configs failed verification.\n")
+		return 1
+	}
+	log.Printf("All %d configs verified.\n", len(checks))
+	return 0
+}
+
+// inventory prints which nodes run which project versions, as a table,
+// JSON or Markdown.
+func inventory(args []string) int {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	format := flags.String("format", "table", `format to print the inventory in, "table", "json" or "markdown"`)
+	flags.Parse(args)
+
+	g := newGenerator()
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		log.Printf("Failed to read config: %v\n", err)
+		return 2
+	}
+	inv, err := g.Inventory(*conf)
+	if err != nil {
+		log.Printf("Failed to take inventory: %v\n", err)
+		return 2
+	}
+	switch *format {
+	case "table":
+		fmt.Print(inv.Table())
+	case "markdown":
+		fmt.Print(inv.Markdown())
+	case "json":
+		b, err := json.MarshalIndent(inv, "", "\t")
+		if err != nil {
+			log.Printf("Failed to encode inventory: %v\n", err)
+			return 2
+		}
+		fmt.Println(string(b))
+	default:
+		log.Printf("Unknown -format %q, want \"table\", \"json\" or \"markdown\".\n", *format)
+		return 2
+	}
+	return 0
+}
+
+// wireguard generates keypairs for the members of WireGuard meshes
+// without public keys, writing the private keys under the files
+// directory of the secret service and their checksums to checksums/.
+func wireguard(args []string) int {
+	flags := flag.NewFlagSet("wireguard", flag.ExitOnError)
+	filesDir := flags.String("files_dir", "/var/www/secretservice", "directory the secret service serves files from")
+	flags.Parse(args)
+
+	g := newGenerator()
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		log.Printf("Failed to read config: %v\n", err)
+		return 2
+	}
+	keys, err := g.NewWireguardKeys(*conf)
+	if err != nil {
+		log.Printf("Failed to generate keys: %v\n", err)
+		return 2
+	}
+	for _, k := range keys {
+		pv := ignite.MeshVersion(k.Mesh)
+		// The private key and its checksum are written before the public
+		// key, so that keys are generated again if writing them fails.
+		keyPath := filepath.Join(*filesDir, string(pv.Name), string(pv.Version), "certs", ignite.PrivateKeyName(k.Node))
+		if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+			log.Printf("Failed to write private key: %v\n", err)
+			return 2
+		}
+		if err := ignite.WriteFile(keyPath, k.PrivateKeyData(), 0600); err != nil {
+			log.Printf("Failed to write private key: %v\n", err)
+			return 2
+		}
+		existing, err := os.ReadFile(pv.ChecksumFile())
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to read checksums: %v\n", err)
+			return 2
+		}
+		data, err := ignite.MergeChecksums(existing, []string{k.ChecksumLine()})
+		if err != nil {
+			log.Printf("Failed to merge checksums into %s: %v\n", pv.ChecksumFile(), err)
+			return 2
+		}
+		if err := ignite.WriteFile(pv.ChecksumFile(), data, 0644); err != nil {
+			log.Printf("Failed to write checksums: %v\n", err)
+			return 2
+		}
+		pubPath := ignite.PublicKeyFile(k.Mesh, k.Node)
+		if err := os.MkdirAll(filepath.Dir(pubPath), 0755); err != nil {
+			log.Printf("Failed to write public key: %v\n", err)
+			return 2
+		}
+		if err := ignite.WriteFile(pubPath, []byte(k.Public+"\n"), 0644); err != nil {
+			log.Printf("Failed to write public key: %v\n", err)
+			return 2
+		}
+		log.Printf("Generated keys of node %q in mesh %q: %s, %s\n", k.Node, k.Mesh, pubPath, keyPath)
+	}
+	log.Printf("Generated %d keys; regenerate configs to add the new peers to all nodes.\n", len(keys))
+	return 0
+}
+
+// show prints the effective config of the nodes named in args, or all nodes.
+func show(args []string) int {
+	flags := flag.NewFlagSet("show", flag.ExitOnError)
+	flags.Parse(args)
+
+	conf, err := newGenerator().ReadConfig()
+	if err != nil {
+		log.Printf("Failed to read config: %v\n", err)
+		return 2
+	}
+	names := flags.Args()
+	if len(names) == 0 {
+		for name := range conf.NodeConfigs {
+			names = append(names, string(name))
+		}
+		sort.Strings(names)
+	}
+	result := map[string]ignite.NodeConfig{}
+	for _, name := range names {
+		nc, exists := conf.NodeConfigs.Get(name)
+		if !exists {
+			log.Printf("No node %q in config.json.\n", name)
+			return 2
+		}
+		result[name] = nc
+	}
+	b, err := json.MarshalIndent(result, "", "\t")
+	if err != nil {
+		log.Printf("Failed to encode configs: %v\n", err)
+		return 2
+	}
+	fmt.Println(string(b))
+	return 0
+}
+
+type (
+	// configFS is a directory of inputs, with config.json replaced.
+	configFS struct {
+		fs.FS
+		config []byte
+	}
+	// configFile is config.json, as opened from a configFS.
+	configFile struct {
+		*bytes.Reader
+		size int64
+	}
+	// pendingSink is a Sink keeping what's written, until it's flushed
+	// to its own sink.
+	pendingSink struct {
+		sink  ignite.Sink
+		names []string
+		files map[string][]byte
+	}
+)
+
+// Open opens the named file, serving config.json from memory.
+func (c configFS) Open(name string) (fs.File, error) {
+	if name == "config.json" {
+		return configFile{bytes.NewReader(c.config), int64(len(c.config))}, nil
+	}
+	return c.FS.Open(name)
+}
+
+// Stat returns the FileInfo of config.json.
+func (f configFile) Stat() (fs.FileInfo, error) { return f, nil }
+
+// Close does nothing, since the config is in memory.
+func (f configFile) Close() error { return nil }
+
+// Name returns the base name of the file.
+func (f configFile) Name() string { return "config.json" }
+
+// Size returns the length of the config in bytes.
+func (f configFile) Size() int64 { return f.size }
+
+// Mode returns the mode bits of the file.
+func (f configFile) Mode() fs.FileMode { return 0644 }
+
+// ModTime returns the zero time, since the config was never written.
+func (f configFile) ModTime() time.Time { return time.Time{} }
+
+// IsDir returns false, since the file isn't a directory.
+func (f configFile) IsDir() bool { return false }
+
+// Sys returns nil.
+func (f configFile) Sys() interface{} { return nil }
+
+// Write keeps the data to write to the named file when flushed.
+func (s *pendingSink) Write(name string, data []byte) error {
+	if s.files == nil {
+		s.files = map[string][]byte{}
+	}
+	if _, exists := s.files[name]; !exists {
+		s.names = append(s.names, name)
+	}
+	s.files[name] = data
+	return nil
+}
+
+// flush writes what was written to the sink, if there is one.
+func (s *pendingSink) flush() error {
+	if s.sink == nil {
+		return nil
+	}
+	for _, name := range s.names {
+		if err := s.sink.Write(name, s.files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stagedGenerator returns a generator like newFullGenerator, reading
+// config from memory instead of config.json, and keeping what it
+// generates in the sinks returned until they're flushed.
+func stagedGenerator(config []byte, sshash string) (*ignite.Generator, []*pendingSink) {
+	full := newFullGenerator(sshash)
+	out := &pendingSink{sink: ignite.DirSink("bootstrap")}
+	tfOut := &pendingSink{sink: full.TerraformOut}
+	servedOut := &pendingSink{sink: full.ServedOut}
+	g := ignite.NewGenerator(configFS{FS: os.DirFS("."), config: config}, out)
+	g.SecretServiceHash = full.SecretServiceHash
+	g.TokenKey = full.TokenKey
+	g.Fetcher = full.Fetcher
+	g.TerraformOut = tfOut
+	g.ServedOut = servedOut
+	return g, []*pendingSink{out, tfOut, servedOut}
+}
+
+// readRollout returns the current rollout.
+func readRollout() (*ignite.Rollout, error) {
+	b, err := os.ReadFile(ignite.RolloutFile)
+	if err != nil {
+		return nil, err
+	}
+	r := ignite.Rollout{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", ignite.RolloutFile, err)
+	}
+	return &r, nil
+}
+
+// writeRollout writes the rollout to RolloutFile.
+func writeRollout(r *ignite.Rollout) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ignite.WriteFile(ignite.RolloutFile, append(b, '\n'), 0644)
+}
+
+// rollout plans, advances, pauses or rolls back a staged rollout of a
+// project version, kept in rollout.json.
+func rollout(args []string) int {
+	flags := flag.NewFlagSet("rollout", flag.ExitOnError)
+	project := flags.String("project", "", "project to roll out, for start")
+	version := flags.String("version", "", "version to roll out, for start")
+	canary := flags.String("canary", "", "nodes to roll out to first, for start: a label as key=value, or a node group")
+	waves := flags.String("waves", "100", "comma-separated percentages of the other nodes to reach with each wave, for start")
+	sshash := flags.String("sshash", "", "secret service hash to use, instead of reading it from /etc/secrets")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: rollout [flags] start|advance|pause|resume|rollback|status\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	action := flags.Arg(0)
+	if action == "start" {
+		if r, err := readRollout(); err == nil && !r.Complete() && !r.RolledBack {
+			log.Printf("Rollout of %s %s is in progress, finish or roll it back first.\n", r.Project, r.Version)
+			return 2
+		}
+		pcts := []int{}
+		for _, w := range strings.Split(*waves, ",") {
+			pct, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(w), "%"))
+			if err != nil {
+				log.Printf("Bad wave %q: %v\n", w, err)
+				return 2
+			}
+			pcts = append(pcts, pct)
+		}
+		conf, problems, err := newGenerator().ValidateConfig()
+		if err != nil {
+			log.Printf("Failed to read config: %v\n", err)
+			return 2
+		}
+		if problems.Errors() > 0 {
+			log.Printf("Config has %d errors, see the validate command.\n", problems.Errors())
+			return 2
+		}
+		r, err := conf.PlanRollout(ignite.ProjectName(*project), ignite.Version(*version), *canary, pcts)
+		if err != nil {
+			log.Printf("Failed to plan rollout: %v\n", err)
+			return 2
+		}
+		if err := writeRollout(r); err != nil {
+			log.Printf("Failed to write %s: %v\n", ignite.RolloutFile, err)
+			return 2
+		}
+		fmt.Println(r)
+		return 0
+	}
+
+	r, err := readRollout()
+	if err != nil {
+		log.Printf("Failed to read rollout: %v\n", err)
+		return 2
+	}
+	var apply func([]byte) ([]byte, []string, error)
+	switch action {
+	case "status":
+		fmt.Println(r)
+		return 0
+	case "pause", "resume":
+		r.Paused = action == "pause"
+		if err := writeRollout(r); err != nil {
+			log.Printf("Failed to write %s: %v\n", ignite.RolloutFile, err)
+			return 2
+		}
+		fmt.Println(r)
+		return 0
+	case "advance":
+		apply = r.Advance
+	case "rollback":
+		apply = r.Rollback
+	default:
+		flags.Usage()
+		return 2
+	}
+	raw, err := os.ReadFile("config.json")
+	if err != nil {
+		log.Printf("Failed to read config: %v\n", err)
+		return 2
+	}
+	updated, nodes, err := apply(raw)
+	if err != nil {
+		log.Printf("Failed to %s rollout: %v\n", action, err)
+		return 2
+	}
+	// The configs are generated before anything is written, so that
+	// config.json and rollout.json are left as they were if that fails.
+	g, sinks := stagedGenerator(updated, *sshash)
+	if len(nodes) > 0 {
+		if _, err := g.Generate(nodes...); err != nil {
+			log.Printf("Failed to regenerate configs of %s, leaving config.json as it was: %v\n", strings.Join(nodes, ", "), err)
+			return 2
+		}
+	}
+	if err := ignite.WriteFile("config.json", updated, 0644); err != nil {
+		log.Printf("Failed to write config: %v\n", err)
+		return 2
+	}
+	if err := writeRollout(r); err != nil {
+		log.Printf("Failed to write %s: %v\n", ignite.RolloutFile, err)
+		return 2
+	}
+	for _, s := range sinks {
+		if err := s.flush(); err != nil {
+			log.Printf("Updated config.json, but failed to write configs of %s: %v\n", strings.Join(nodes, ", "), err)
+			return 2
+		}
+	}
+	fmt.Println(r)
+	return 0
+}
+
+// serve serves the configs in bootstrap/served to the nodes they're for.
+func serve(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8443", "address to listen on")
+	dir := flags.String("dir", filepath.Join("bootstrap", ignite.ServedDir), "directory of served configs")
+	keyPath := flags.String("token_key", ignite.DefaultTokenKeyPath, "file with the key node tokens are derived from")
+	certFile := flags.String("tls_cert", "", "TLS certificate of the server")
+	keyFile := flags.String("tls_key", "", "TLS key of the server")
+	clientCA := flags.String("client_ca", "", "if set, CA whose client certs can fetch the config of the node named by their common name")
+	flags.Parse(args)
+
+	key, err := os.ReadFile(*keyPath)
+	if err != nil {
+		log.Printf("Failed to read token key: %v\n", err)
+		return 2
+	}
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: ignite.NewServer(os.DirFS(*dir), key),
+	}
+	if *clientCA != "" {
+		b, err := os.ReadFile(*clientCA)
+		if err != nil {
+			log.Printf("Failed to read client CA: %v\n", err)
+			return 2
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			log.Printf("No certs found in %s.\n", *clientCA)
+			return 2
+		}
+		server.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  pool,
+		}
+	}
+	log.Printf("Serving configs in %s on %s..\n", *dir, *addr)
+	if err := server.ListenAndServeTLS(*certFile, *keyFile); err != nil {
+		log.Printf("Failed to serve: %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// validate reports all problems in config.json.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print problems as JSON")
+	flags.Parse(args)
+
+	_, problems, err := newGenerator().ValidateConfig()
+	if err != nil {
+		log.Fatalf("Failed to read config: %v\n", err)
+	}
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(problems); err != nil {
+			log.Fatalf("Failed to encode problems: %v\n", err)
+		}
+	} else {
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+	}
+	if problems.Errors() > 0 {
+		log.Printf("Found %d errors and %d warnings.\n", problems.Errors(), len(problems)-problems.Errors())
+		return 1
+	}
+	log.Printf("Config is valid (%d warnings).\n", len(problems))
+	return 0
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, exists := commands[os.Args[1]]
+	if !exists {
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(os.Args[2:]))
+}
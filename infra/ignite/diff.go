@@ -0,0 +1,541 @@
+package ignite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+type (
+	// Change is a single difference between the existing and new config of a node.
+	Change struct {
+		// Kind is what changed: "ignition", "file", "unit", "dropin", "networkd",
+		// "filesystem", "directory", "link", "user" or "cloud-init".
+		Kind string `json:"kind"`
+		// Name is the path of the file, directory or link, the device of
+		// the filesystem, the name of the unit, dropin, networkd unit or
+		// user, or the file name of a cloud-init config.
+		Name string `json:"name"`
+		// Op is "+" if it was added, "-" if it was removed and "~" if it changed.
+		Op string `json:"op"`
+		// Field is the changed field, e.g. "source", if Op is "~".
+		Field string `json:"field,omitempty"`
+		// Old is the existing value of the field.
+		Old string `json:"old,omitempty"`
+		// New is the new value of the field.
+		New string `json:"new,omitempty"`
+	}
+	// NodeDiff is the difference between the existing and new config of a node.
+	NodeDiff struct {
+		// Node is the name of the node.
+		Node string `json:"node"`
+		// Op is "+" if the node has no existing config, "-" if it's no
+		// longer in config.json, and "~" otherwise.
+		Op string `json:"op"`
+		// Changes are the differences, if Op is "~".
+		Changes []Change `json:"changes,omitempty"`
+	}
+	// Diffs are the differences of all nodes.
+	Diffs []NodeDiff
+
+	// fileState is the part of a file we compare between configs.
+	fileState struct {
+		source, hash, user, group string
+		mode                      int
+	}
+	// unitState is the part of a systemd unit we compare between configs.
+	unitState struct {
+		enabled  bool
+		contents string
+		dropins  map[string]string
+	}
+	// configState is the part of an Ignition config we compare, independent of spec version.
+	configState struct {
+		version string
+		files   map[string]fileState
+		units   map[string]unitState
+		// networkd maps the names of spec 2.x networkd units to their contents.
+		networkd map[string]string
+		// filesystems maps devices to a description of their filesystem.
+		filesystems map[string]string
+		// directories maps directory paths to their mode and owners.
+		directories map[string]string
+		// links maps link paths to their targets.
+		links map[string]string
+		// users maps user names to a description of their groups and keys.
+		users map[string]string
+	}
+)
+
+// String returns a description of the owner, e.g. "core" or "500".
+func (o owner) String() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	if o.ID != nil {
+		return fmt.Sprintf("%d", *o.ID)
+	}
+	return ""
+}
+
+// addUnit records the unit in the state, merging dropins for units listed more than once.
+func (s *configState) addUnit(name string, enabled bool, contents string, dropins map[string]string) {
+	u, exists := s.units[name]
+	if !exists {
+		u = unitState{dropins: map[string]string{}}
+	}
+	u.enabled = u.enabled || enabled
+	if contents != "" {
+		u.contents = contents
+	}
+	for k, v := range dropins {
+		u.dropins[k] = v
+	}
+	s.units[name] = u
+}
+
+// stateV2 returns the comparable state of the spec 2.x config.
+func stateV2(conf IgnitionConfig) configState {
+	s := configState{
+		version:     conf.Ignition.Version,
+		files:       map[string]fileState{},
+		units:       map[string]unitState{},
+		networkd:    map[string]string{},
+		filesystems: map[string]string{},
+		directories: map[string]string{},
+		links:       map[string]string{},
+		users:       map[string]string{},
+	}
+	for _, u := range conf.Networkd.Units {
+		s.networkd[u.Name] = u.Contents
+	}
+	for _, f := range conf.Storage.Filesystems {
+		s.filesystems[f.Mount.Device] = describeFilesystem(f.Mount.Format, f.Mount.Label, f.Mount.WipeFilesystem || (f.Mount.Create != nil && f.Mount.Create.Force))
+	}
+	for _, d := range conf.Storage.Directories {
+		s.directories[d.Path] = describeDirectory(d.Mode, d.User.String(), d.Group.String())
+	}
+	for _, l := range conf.Storage.Links {
+		s.links[l.Path] = l.Target
+	}
+	for _, u := range conf.Passwd.Users {
+		s.users[u.Name] = u.describe()
+	}
+	for _, f := range conf.Storage.Files {
+		s.files[f.Path] = fileState{
+			source: f.Contents.Source,
+			hash:   f.Contents.Verification.Hash,
+			user:   f.User.String(),
+			group:  f.Group.String(),
+			mode:   f.Mode,
+		}
+	}
+	for _, u := range conf.Systemd.Units {
+		dropins := map[string]string{}
+		for _, d := range u.Dropins {
+			dropins[d.Name] = d.Contents
+		}
+		s.addUnit(u.Name, u.Enable, u.Contents, dropins)
+	}
+	return s
+}
+
+// stateV3 returns the comparable state of the spec 3.x config.
+func stateV3(conf IgnitionConfigV3) configState {
+	s := configState{
+		version:     conf.Ignition.Version,
+		files:       map[string]fileState{},
+		units:       map[string]unitState{},
+		networkd:    map[string]string{},
+		filesystems: map[string]string{},
+		directories: map[string]string{},
+		links:       map[string]string{},
+		users:       map[string]string{},
+	}
+	for _, u := range conf.Passwd.Users {
+		s.users[u.Name] = u.describe()
+	}
+	ownerString := func(o *ownerV3) string {
+		if o == nil {
+			return ""
+		}
+		return owner{ID: o.ID, Name: o.Name}.String()
+	}
+	for _, f := range conf.Storage.Files {
+		s.files[f.Path] = fileState{
+			source: f.Contents.Source,
+			hash:   f.Contents.Verification.Hash,
+			user:   ownerString(f.User),
+			group:  ownerString(f.Group),
+			mode:   f.Mode,
+		}
+	}
+	for _, u := range conf.Systemd.Units {
+		dropins := map[string]string{}
+		for _, d := range u.Dropins {
+			dropins[d.Name] = d.Contents
+		}
+		s.addUnit(u.Name, u.Enabled != nil && *u.Enabled, u.Contents, dropins)
+	}
+	for _, f := range conf.Storage.Filesystems {
+		s.filesystems[f.Device] = describeFilesystem(f.Format, f.Label, f.WipeFilesystem)
+	}
+	for _, d := range conf.Storage.Directories {
+		s.directories[d.Path] = describeDirectory(d.Mode, ownerString(d.User), ownerString(d.Group))
+	}
+	for _, l := range conf.Storage.Links {
+		s.links[l.Path] = l.Target
+	}
+	return s
+}
+
+// describeFilesystem returns a description of a filesystem, for diffs.
+func describeFilesystem(format, label string, wipe bool) string {
+	return fmt.Sprintf("format=%s label=%s wipe=%v", format, label, wipe)
+}
+
+// describeDirectory returns a description of a directory, for diffs.
+func describeDirectory(mode int, user, group string) string {
+	return fmt.Sprintf("mode=%04o user=%s group=%s", mode, user, group)
+}
+
+// state returns the comparable state of the generated config.
+func (o Output) state() configState {
+	if o.V3 != nil {
+		return stateV3(*o.V3)
+	}
+	return stateV2(*o.V2)
+}
+
+// ParseOutput parses an existing Ignition config for the named node.
+func ParseOutput(name string, data []byte) (*Output, error) {
+	peek := struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}{}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return nil, fmt.Errorf("failed to parse config for %q: %v", name, err)
+	}
+	result := Output{Name: name}
+	if isV3(peek.Ignition.Version) {
+		result.V3 = &IgnitionConfigV3{}
+		if err := json.Unmarshal(data, result.V3); err != nil {
+			return nil, fmt.Errorf("failed to parse spec %s config for %q: %v", peek.Ignition.Version, name, err)
+		}
+	} else {
+		result.V2 = &IgnitionConfig{}
+		if err := json.Unmarshal(data, result.V2); err != nil {
+			return nil, fmt.Errorf("failed to parse spec %s config for %q: %v", peek.Ignition.Version, name, err)
+		}
+	}
+	return &result, nil
+}
+
+// sortedKeys returns the keys of the maps in sorted order, without duplicates.
+func sortedKeys(maps ...map[string]bool) []string {
+	seen := map[string]bool{}
+	for _, m := range maps {
+		for k := range m {
+			seen[k] = true
+		}
+	}
+	result := []string{}
+	for k := range seen {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// diffStates returns the changes from old to new.
+func diffStates(old, new configState) []Change {
+	result := []Change{}
+	if old.version != new.version {
+		result = append(result, Change{Kind: "ignition", Name: "version", Op: "~", Field: "version", Old: old.version, New: new.version})
+	}
+	oldFiles, newFiles := map[string]bool{}, map[string]bool{}
+	for p := range old.files {
+		oldFiles[p] = true
+	}
+	for p := range new.files {
+		newFiles[p] = true
+	}
+	for _, p := range sortedKeys(oldFiles, newFiles) {
+		of, inOld := old.files[p]
+		nf, inNew := new.files[p]
+		if !inOld {
+			result = append(result, Change{Kind: "file", Name: p, Op: "+", New: nf.source})
+			continue
+		}
+		if !inNew {
+			result = append(result, Change{Kind: "file", Name: p, Op: "-", Old: of.source})
+			continue
+		}
+		fields := []struct{ name, old, new string }{
+			{"source", of.source, nf.source},
+			{"hash", of.hash, nf.hash},
+			{"mode", fmt.Sprintf("%04o", of.mode), fmt.Sprintf("%04o", nf.mode)},
+			{"user", of.user, nf.user},
+			{"group", of.group, nf.group},
+		}
+		for _, f := range fields {
+			if f.old != f.new {
+				result = append(result, Change{Kind: "file", Name: p, Op: "~", Field: f.name, Old: f.old, New: f.new})
+			}
+		}
+	}
+	oldUnits, newUnits := map[string]bool{}, map[string]bool{}
+	for name := range old.units {
+		oldUnits[name] = true
+	}
+	for name := range new.units {
+		newUnits[name] = true
+	}
+	for _, name := range sortedKeys(oldUnits, newUnits) {
+		ou, inOld := old.units[name]
+		nu, inNew := new.units[name]
+		if !inOld {
+			result = append(result, Change{Kind: "unit", Name: name, Op: "+", New: nu.contents})
+			continue
+		}
+		if !inNew {
+			result = append(result, Change{Kind: "unit", Name: name, Op: "-", Old: ou.contents})
+			continue
+		}
+		if ou.enabled != nu.enabled {
+			result = append(result, Change{Kind: "unit", Name: name, Op: "~", Field: "enabled", Old: fmt.Sprint(ou.enabled), New: fmt.Sprint(nu.enabled)})
+		}
+		if ou.contents != nu.contents {
+			result = append(result, Change{Kind: "unit", Name: name, Op: "~", Field: "contents", Old: ou.contents, New: nu.contents})
+		}
+		oldDropins, newDropins := map[string]bool{}, map[string]bool{}
+		for d := range ou.dropins {
+			oldDropins[d] = true
+		}
+		for d := range nu.dropins {
+			newDropins[d] = true
+		}
+		for _, d := range sortedKeys(oldDropins, newDropins) {
+			dname := fmt.Sprintf("%s/%s", name, d)
+			od, inOld := ou.dropins[d]
+			nd, inNew := nu.dropins[d]
+			switch {
+			case !inOld:
+				result = append(result, Change{Kind: "dropin", Name: dname, Op: "+", New: nd})
+			case !inNew:
+				result = append(result, Change{Kind: "dropin", Name: dname, Op: "-", Old: od})
+			case od != nd:
+				result = append(result, Change{Kind: "dropin", Name: dname, Op: "~", Field: "contents", Old: od, New: nd})
+			}
+		}
+	}
+	result = append(result, diffValues("networkd", "contents", old.networkd, new.networkd)...)
+	result = append(result, diffValues("filesystem", "filesystem", old.filesystems, new.filesystems)...)
+	result = append(result, diffValues("directory", "directory", old.directories, new.directories)...)
+	result = append(result, diffValues("link", "target", old.links, new.links)...)
+	result = append(result, diffValues("user", "passwd", old.users, new.users)...)
+	return result
+}
+
+// diffValues returns the changes of given kind from old to new, where
+// the maps hold the value of field by name.
+func diffValues(kind, field string, old, new map[string]string) []Change {
+	result := []Change{}
+	oldNames, newNames := map[string]bool{}, map[string]bool{}
+	for name := range old {
+		oldNames[name] = true
+	}
+	for name := range new {
+		newNames[name] = true
+	}
+	for _, name := range sortedKeys(oldNames, newNames) {
+		ov, inOld := old[name]
+		nv, inNew := new[name]
+		switch {
+		case !inOld:
+			result = append(result, Change{Kind: kind, Name: name, Op: "+", New: nv})
+		case !inNew:
+			result = append(result, Change{Kind: kind, Name: name, Op: "-", Old: ov})
+		case ov != nv:
+			result = append(result, Change{Kind: kind, Name: name, Op: "~", Field: field, Old: ov, New: nv})
+		}
+	}
+	return result
+}
+
+// Diff returns the differences between the configs that would be
+// generated from conf and the existing configs in dir of the
+// generator's fs.FS, e.g. "bootstrap", or under ServedDir in it for
+// served nodes.
+func (g *Generator) Diff(conf Config, dir string) (Diffs, error) {
+	outputs, err := g.Build(conf)
+	if err != nil {
+		return nil, err
+	}
+	result := Diffs{}
+	seen := map[string]bool{}
+	for _, o := range outputs {
+		seen[o.Name] = true
+		p := path.Join(dir, o.FileName())
+		if o.Served {
+			// Stubs of served nodes only change with the served config.
+			p = path.Join(dir, ServedDir, o.FileName())
+		}
+		data, err := fs.ReadFile(g.fsys, p)
+		if err != nil {
+			result = append(result, NodeDiff{Node: o.Name, Op: "+"})
+			continue
+		}
+		if o.CloudInit != nil {
+			// cloud-init configs are compared as a whole, since
+			// fetched files and units are only part of runcmd.
+			b, err := o.Marshal()
+			if err != nil {
+				return nil, err
+			}
+			if string(b) != string(data) {
+				result = append(result, NodeDiff{Node: o.Name, Op: "~", Changes: []Change{
+					{Kind: "cloud-init", Name: o.FileName(), Op: "~", Field: "contents", Old: string(data), New: string(b)},
+				}})
+			}
+			continue
+		}
+		existing, err := ParseOutput(o.Name, data)
+		if err != nil {
+			return nil, err
+		}
+		changes := diffStates(existing.state(), o.state())
+		if len(changes) > 0 {
+			result = append(result, NodeDiff{Node: o.Name, Op: "~", Changes: changes})
+		}
+	}
+	for _, ext := range []string{".json", ".yaml"} {
+		existing, err := fs.Glob(g.fsys, path.Join(dir, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range existing {
+			name := strings.TrimSuffix(path.Base(p), ext)
+			if !seen[name] {
+				result = append(result, NodeDiff{Node: name, Op: "-"})
+				seen[name] = true
+			}
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Node < result[j].Node
+	})
+	return result, nil
+}
+
+// shortHash returns the start of a "sha512-..." hash, for display.
+func shortHash(hash string) string {
+	if len(hash) > len("sha512-")+12 {
+		return hash[:len("sha512-")+12] + ".."
+	}
+	return hash
+}
+
+// String returns a human-readable description of the change.
+func (c Change) String() string {
+	switch {
+	case c.Op == "+" && c.Kind == "file":
+		return fmt.Sprintf("+ file %s from %s", c.Name, c.New)
+	case c.Op == "-" && c.Kind == "file":
+		return fmt.Sprintf("- file %s from %s", c.Name, c.Old)
+	case c.Op == "+" || c.Op == "-":
+		return fmt.Sprintf("%s %s %s", c.Op, c.Kind, c.Name)
+	}
+	if c.Field == "contents" {
+		return fmt.Sprintf("~ %s %s contents:\n%s", c.Kind, c.Name, diffLines(c.Old, c.New, "    "))
+	}
+	old, new := c.Old, c.New
+	if c.Field == "hash" {
+		old, new = shortHash(old), shortHash(new)
+	}
+	return fmt.Sprintf("~ %s %s %s: %q -> %q", c.Kind, c.Name, c.Field, old, new)
+}
+
+// String returns a human-readable description of the node's changes.
+func (d NodeDiff) String() string {
+	switch d.Op {
+	case "+":
+		return fmt.Sprintf("+ %s: new node", d.Node)
+	case "-":
+		return fmt.Sprintf("- %s: no longer in config.json", d.Node)
+	}
+	lines := []string{fmt.Sprintf("~ %s: %d changes", d.Node, len(d.Changes))}
+	for _, c := range d.Changes {
+		lines = append(lines, "  "+c.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffContext is the number of unchanged lines shown around changed lines.
+const diffContext = 2
+
+// diffLines returns a line-based diff of old and new, with each line
+// prefixed by indent and "-", "+" or " ".
+func diffLines(old, new, indent string) string {
+	a := strings.Split(strings.TrimSuffix(old, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(new, "\n"), "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	lines := []string{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, "  "+a[i])
+			i += 1
+			j += 1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "- "+a[i])
+			i += 1
+		default:
+			lines = append(lines, "+ "+b[j])
+			j += 1
+		}
+	}
+	// show is true for the lines within diffContext of a changed line.
+	show := make([]bool, len(lines))
+	for k, line := range lines {
+		if line[0] == ' ' {
+			continue
+		}
+		for c := k - diffContext; c <= k+diffContext; c++ {
+			if c >= 0 && c < len(lines) {
+				show[c] = true
+			}
+		}
+	}
+	result := []string{}
+	for k, line := range lines {
+		if !show[k] {
+			if k == 0 || show[k-1] {
+				result = append(result, indent+"  ...")
+			}
+			continue
+		}
+		result = append(result, indent+line)
+	}
+	return strings.Join(result, "\n")
+}
@@ -0,0 +1,65 @@
+package ignite
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDiff(t *testing.T) {
+	fsys := newTestFS(testConfig)
+	out := mapSink{}
+	g := NewGenerator(fsys, out)
+	g.SecretServiceHash = "123abc"
+	if _, err := g.Generate(); err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	fsys["bootstrap/core.json"] = &fstest.MapFile{Data: out["core.json"]}
+	fsys["bootstrap/old.json"] = &fstest.MapFile{Data: out["core.json"]}
+	fsys["units/tclient.service"] = &fstest.MapFile{Data: []byte("[Service]\nExecStart=/opt/bin/tclient -v\n")}
+	fsys["checksums/hkjninfra_1.5.13.sha512"] = &fstest.MapFile{Data: []byte("aaa  tclient_armv7l\neee  tclient_x86_64\nccc  gather_facts\nddd  client.pem\n")}
+
+	conf, err := g.ReadConfig()
+	if err != nil {
+		t.Fatalf("ReadConfig() returned error: %v", err)
+	}
+	got, err := g.Diff(*conf, "bootstrap")
+	if err != nil {
+		t.Fatalf("Diff() returned error: %v", err)
+	}
+	want := Diffs{
+		{Node: "arm", Op: "+"},
+		{
+			Node: "core",
+			Op:   "~",
+			Changes: []Change{
+				{Kind: "file", Name: "/opt/bin/tclient", Op: "~", Field: "hash", Old: "sha512-bbb", New: "sha512-eee"},
+				{
+					Kind:  "unit",
+					Name:  "tclient.service",
+					Op:    "~",
+					Field: "contents",
+					Old:   "[Service]\nExecStart=/opt/bin/tclient -addr mon2.example.com:50051\n",
+					New:   "[Service]\nExecStart=/opt/bin/tclient -v\n",
+				},
+			},
+		},
+		{Node: "old", Op: "-"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\n"
+	new := "a\nb\nc\nD\ne\nf\ng\n"
+	want := "  ...\n  b\n  c\n- d\n+ D\n  e\n  f\n  ..."
+	if got := diffLines(old, new, ""); got != want {
+		t.Errorf("diffLines() = %q, want %q", got, want)
+	}
+	if got := fmt.Sprint(Change{Kind: "file", Name: "/x", Op: "~", Field: "mode", Old: "0644", New: "0755"}); got != `~ file /x mode: "0644" -> "0755"` {
+		t.Errorf("Change.String() = %q", got)
+	}
+}
@@ -0,0 +1,366 @@
+package ignite
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// Fetcher fetches artifacts, secrets and release checksums, with
+	// bounded concurrency, timeouts, retries with backoff and a local
+	// cache.
+	//
+	// Fetched contents are cached under CacheDir by URL and expected
+	// hash, so that contents with a known hash are only fetched once, and
+	// downloads of them that fail part way are resumed. The rest are
+	// fetched each time, and only come from the cache when Offline. The
+	// results of probing mirrors are cached too, so that configs can be
+	// regenerated Offline, making the same choices as the last run that
+	// went online.
+	Fetcher struct {
+		// Client is the client making requests. Its transport times out
+		// connecting and waiting for responses, but not reading bodies,
+		// so large artifacts can take as long as they need.
+		Client *http.Client
+		// Concurrency is the most requests made at once by FetchAll.
+		Concurrency int
+		// Retries is how many times a failing request is retried.
+		Retries int
+		// Backoff is the delay before the first retry, doubling for each
+		// one after.
+		Backoff time.Duration
+		// CacheDir is where fetched contents are cached, if set.
+		CacheDir string
+		// Offline makes all requests be served from the cache, failing if
+		// they aren't in it.
+		Offline bool
+
+		mu     sync.Mutex
+		probes map[string]*probe
+	}
+	// probe is the result of probing a URL, made once.
+	probe struct {
+		once sync.Once
+		ok   bool
+	}
+	// FetchRequest is a URL to fetch, and the hash its contents must have.
+	FetchRequest struct {
+		// URL is the URL to fetch.
+		URL string
+		// Hash is the hash the contents must have, e.g. "sha512-abc..",
+		// or "" if it isn't known.
+		Hash string
+	}
+	// FetchResult is the result of a FetchRequest.
+	FetchResult struct {
+		FetchRequest
+		// Data is the contents fetched.
+		Data []byte
+		// Err is the error fetching the contents, if any.
+		Err error
+	}
+	// statusError is an unexpected HTTP status.
+	statusError struct {
+		url  string
+		code int
+		desc string
+	}
+)
+
+// errNotCached is returned for requests missing from the cache when offline.
+var errNotCached = errors.New("not in cache, and fetching is offline")
+
+// NewFetcher returns a fetcher caching contents in cacheDir, if set,
+// with the default timeout, retries and concurrency.
+func NewFetcher(cacheDir string) *Fetcher {
+	return &Fetcher{
+		Client:      &http.Client{Transport: NewTransport(30 * time.Second)},
+		Concurrency: 4,
+		Retries:     3,
+		Backoff:     time.Second,
+		CacheDir:    cacheDir,
+	}
+}
+
+// NewTransport returns a transport giving up on connecting, the TLS
+// handshake or waiting for the response headers after timeout. Reading
+// the body isn't limited, unlike with http.Client's Timeout, which would
+// fail downloads of large artifacts over slow links.
+func NewTransport(timeout time.Duration) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = timeout
+	t.ResponseHeaderTimeout = timeout
+	return t
+}
+
+// DefaultCacheDir returns where fetched contents are usually cached, in
+// the user's cache directory, or "" if it isn't known.
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "ignite")
+}
+
+// Error returns a description of the status error.
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status code from GET %q, want 200 OK, got %s", e.url, e.desc)
+}
+
+// temporary returns true if the request may succeed when retried.
+func (e statusError) temporary() bool {
+	return e.code >= 500 || e.code == http.StatusTooManyRequests
+}
+
+// checkHash checks that data has the hash, e.g. "sha512-abc..", if set.
+func checkHash(data []byte, hash string) error {
+	if hash == "" {
+		return nil
+	}
+	if !strings.HasPrefix(hash, "sha512-") {
+		return fmt.Errorf("unsupported hash %q, want sha512-<hex>", hash)
+	}
+	if got := fmt.Sprintf("sha512-%x", sha512.Sum512(data)); got != hash {
+		return fmt.Errorf("got hash %s, want %s", got, hash)
+	}
+	return nil
+}
+
+// cachePath returns the path in the cache of the entry of kind for url,
+// e.g. "sha512-abc.." for contents with that hash.
+func (f *Fetcher) cachePath(url, kind string) string {
+	return filepath.Join(f.CacheDir, fmt.Sprintf("%x", sha256.Sum256([]byte(url))), kind)
+}
+
+// readCache returns the cached entry of kind for url.
+func (f *Fetcher) readCache(url, kind string) ([]byte, error) {
+	if f.CacheDir == "" {
+		return nil, errNotCached
+	}
+	b, err := os.ReadFile(f.cachePath(url, kind))
+	if os.IsNotExist(err) {
+		return nil, errNotCached
+	}
+	return b, err
+}
+
+// writeCache caches the entry of kind for url, if there's a cache. The
+// cache may hold secrets, so it's only readable by the user.
+func (f *Fetcher) writeCache(url, kind string, data []byte) {
+	if f.CacheDir == "" {
+		return
+	}
+	path := f.cachePath(url, kind)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		log.Printf("Failed to cache %q: %v\n", url, err)
+		return
+	}
+	if err := WriteFile(path, data, 0600); err != nil {
+		log.Printf("Failed to cache %q: %v\n", url, err)
+	}
+}
+
+// removeCache removes the cached entry of kind for url, if any.
+func (f *Fetcher) removeCache(url, kind string) {
+	if f.CacheDir == "" {
+		return
+	}
+	if err := os.Remove(f.cachePath(url, kind)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cached %q: %v\n", url, err)
+	}
+}
+
+// retry calls do until it succeeds, it fails with an error that isn't
+// temporary, or the retries run out.
+func (f *Fetcher) retry(url string, do func() error) error {
+	backoff := f.Backoff
+	for i := 0; ; i++ {
+		err := do()
+		var se statusError
+		if err == nil || i >= f.Retries || (errors.As(err, &se) && !se.temporary()) {
+			return err
+		}
+		log.Printf("Retrying %q in %v: %v\n", url, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// get returns the contents at url.
+//
+// If the contents have a hash, what was read of them before a request
+// failed is kept, in the cache as "<hash>.partial" if there is one, and
+// later requests only ask for the rest with a Range header.
+func (f *Fetcher) get(url, hash string) ([]byte, error) {
+	var partial []byte
+	if hash != "" {
+		partial, _ = f.readCache(url, hash+".partial")
+	}
+	err := f.retry(url, func() error {
+		if hash == "" {
+			partial = nil
+		}
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		if len(partial) > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(partial)))
+		}
+		resp, err := f.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			partial = nil
+		case resp.StatusCode == http.StatusPartialContent && len(partial) > 0:
+			if want := fmt.Sprintf("bytes %d-", len(partial)); !strings.HasPrefix(resp.Header.Get("Content-Range"), want) {
+				partial = nil
+				return fmt.Errorf("got Content-Range %q from GET %q, want %s..", resp.Header.Get("Content-Range"), url, want)
+			}
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && len(partial) > 0:
+			partial = nil
+			return fmt.Errorf("partial contents of %q are no longer satisfiable, starting over", url)
+		default:
+			return statusError{url: url, code: resp.StatusCode, desc: resp.Status}
+		}
+		b, err := io.ReadAll(resp.Body)
+		partial = append(partial, b...)
+		if err != nil && hash != "" && len(partial) > 0 {
+			f.writeCache(url, hash+".partial", partial)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if hash != "" {
+		f.removeCache(url, hash+".partial")
+	}
+	return partial, nil
+}
+
+// Fetch returns the contents at url, which must have the hash if set.
+//
+// Contents with a hash are served from the cache if they're in it. The
+// rest are fetched each time, and only served from the cache when
+// Offline, so that a failed fetch never gives stale contents.
+func (f *Fetcher) Fetch(url, hash string) ([]byte, error) {
+	kind := hash
+	if kind == "" {
+		kind = "latest"
+	}
+	if hash != "" || f.Offline {
+		b, err := f.readCache(url, kind)
+		if err == nil {
+			if err := checkHash(b, hash); err != nil {
+				return nil, fmt.Errorf("cached %q is corrupt: %v", url, err)
+			}
+			return b, nil
+		}
+		if f.Offline {
+			return nil, fmt.Errorf("failed to fetch %q: %v", url, err)
+		}
+	}
+	b, err := f.get(url, hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHash(b, hash); err != nil {
+		return nil, fmt.Errorf("fetched %q: %v", url, err)
+	}
+	f.writeCache(url, kind, b)
+	return b, nil
+}
+
+// FetchAll fetches the requests, at most Concurrency at a time,
+// returning their results in the same order.
+func (f *Fetcher) FetchAll(reqs []FetchRequest) []FetchResult {
+	results := make([]FetchResult, len(reqs))
+	n := f.Concurrency
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, req FetchRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			data, err := f.Fetch(req.URL, req.Hash)
+			results[i] = FetchResult{FetchRequest: req, Data: data, Err: err}
+		}(i, req)
+	}
+	wg.Wait()
+	return results
+}
+
+// Available returns true if url can be fetched.
+//
+// Each URL is only probed once, and the result is cached, so that
+// offline runs find the same URLs available as the last online one.
+func (f *Fetcher) Available(url string) bool {
+	f.mu.Lock()
+	if f.probes == nil {
+		f.probes = map[string]*probe{}
+	}
+	p, exists := f.probes[url]
+	if !exists {
+		p = &probe{}
+		f.probes[url] = p
+	}
+	f.mu.Unlock()
+	p.once.Do(func() { p.ok = f.probe(url) })
+	return p.ok
+}
+
+// probe returns true if url can be fetched, from the cached result of
+// the last probe if offline.
+func (f *Fetcher) probe(url string) bool {
+	var ok bool
+	if f.Offline {
+		b, err := f.readCache(url, "probe")
+		ok = err == nil && string(b) == "ok"
+	} else {
+		err := f.retry(url, func() error {
+			resp, err := f.Client.Head(url)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return statusError{url: url, code: resp.StatusCode, desc: resp.Status}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Mirror %q is unavailable: %v\n", url, err)
+		}
+		ok = err == nil
+		result := "unavailable"
+		if ok {
+			result = "ok"
+		}
+		f.writeCache(url, "probe", []byte(result))
+	}
+	return ok
+}
@@ -0,0 +1,251 @@
+package ignite
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestFetcher returns a fetcher caching in a temporary directory,
+// retrying without delay.
+func newTestFetcher(t *testing.T) *Fetcher {
+	f := NewFetcher(t.TempDir())
+	f.Backoff = time.Millisecond
+	return f
+}
+
+func TestFetchRetries(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path] += 1
+		n := calls[r.URL.Path]
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case n <= 2:
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, "contents")
+		}
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	b, err := f.Fetch(srv.URL+"/flaky", "")
+	if err != nil || string(b) != "contents" {
+		t.Errorf("Fetch(flaky) = %q, %v, want contents after retries", b, err)
+	}
+	if _, err := f.Fetch(srv.URL+"/missing", ""); err == nil {
+		t.Errorf("Fetch(missing) succeeded")
+	}
+	if calls["/missing"] != 1 {
+		t.Errorf("Fetch(missing) made %d requests, want 1 without retries", calls["/missing"])
+	}
+	f.Retries = 1
+	if _, err := f.Fetch(srv.URL+"/flaky2", ""); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Fetch(flaky2) with one retry returned error %v, want 503", err)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stalled" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, "slow ")
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "body")
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	f.Client.Transport = NewTransport(50 * time.Millisecond)
+	f.Retries = 0
+	if _, err := f.Fetch(srv.URL+"/stalled", ""); err == nil {
+		t.Errorf("Fetch(stalled) succeeded, want timeout waiting for the response")
+	}
+	if b, err := f.Fetch(srv.URL+"/slow", ""); err != nil || string(b) != "slow body" {
+		t.Errorf("Fetch(slow) = %q, %v, want the whole body, however long it takes", b, err)
+	}
+}
+
+func TestFetchCache(t *testing.T) {
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "contents of %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	f.Retries = 0
+	hash := fmt.Sprintf("sha512-%x", sha512.Sum512([]byte("contents of /a")))
+	if _, err := f.Fetch(srv.URL+"/a", hash); err != nil {
+		t.Fatalf("Fetch(a) returned error: %v", err)
+	}
+	if _, err := f.Fetch(srv.URL+"/b", hash); err == nil || !strings.Contains(err.Error(), "want "+hash) {
+		t.Errorf("Fetch(b) with hash of a returned error %v, want hash mismatch", err)
+	}
+	if _, err := f.Fetch(srv.URL+"/secret", ""); err != nil {
+		t.Fatalf("Fetch(secret) returned error: %v", err)
+	}
+
+	up = false
+	if b, err := f.Fetch(srv.URL+"/secret", ""); err == nil {
+		t.Errorf("Fetch(secret) with server down = %q, want error instead of the cached contents", b)
+	}
+	if _, err := f.Fetch(srv.URL+"/a", hash); err != nil {
+		t.Errorf("Fetch(a) with server down returned error %v, want cached contents", err)
+	}
+	offline := newTestFetcher(t)
+	offline.CacheDir = f.CacheDir
+	offline.Offline = true
+	results := offline.FetchAll([]FetchRequest{{URL: srv.URL + "/a", Hash: hash}, {URL: srv.URL + "/secret"}, {URL: srv.URL + "/c"}})
+	if results[0].Err != nil || results[1].Err != nil || string(results[1].Data) != "contents of /secret" {
+		t.Errorf("FetchAll() offline = %+v, want cached a and secret", results)
+	}
+	if results[2].Err == nil || !strings.Contains(results[2].Err.Error(), "offline") {
+		t.Errorf("FetchAll() offline of uncached c returned error %v", results[2].Err)
+	}
+}
+
+func TestFetchResume(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 1000))
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if len(ranges) == 1 {
+			w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+			w.Write(data[:4000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	f.Retries = 0
+	hash := fmt.Sprintf("sha512-%x", sha512.Sum512(data))
+	if _, err := f.Fetch(srv.URL+"/data", hash); err == nil {
+		t.Fatalf("Fetch() of aborted response returned no error")
+	}
+	b, err := f.Fetch(srv.URL+"/data", hash)
+	if err != nil {
+		t.Fatalf("Fetch() returned error: %v", err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Fetch() got %d bytes, want the %d bytes of data", len(b), len(data))
+	}
+	if want := []string{"", "bytes=4000-"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("Fetch() made requests with ranges %q, want %q", ranges, want)
+	}
+	if _, err := f.readCache(srv.URL+"/data", hash+".partial"); err != errNotCached {
+		t.Errorf("Fetch() left partial contents in the cache: %v", err)
+	}
+}
+
+func TestFetchAllConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight += 1
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight -= 1
+		mu.Unlock()
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	f.Concurrency = 2
+	reqs := []FetchRequest{}
+	for i := 0; i < 6; i++ {
+		reqs = append(reqs, FetchRequest{URL: fmt.Sprintf("%s/%d", srv.URL, i)})
+	}
+	for i, r := range f.FetchAll(reqs) {
+		if r.Err != nil || string(r.Data) != fmt.Sprintf("/%d", i) {
+			t.Errorf("FetchAll() result %d = %q, %v", i, r.Data, r.Err)
+		}
+	}
+	if most > 2 {
+		t.Errorf("FetchAll() made %d requests at once, want at most 2", most)
+	}
+}
+
+func TestAvailableOffline(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/good" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	if !f.Available(srv.URL+"/good") || f.Available(srv.URL+"/bad") {
+		t.Fatalf("Available() online got wrong results")
+	}
+	srv.Close()
+	offline := newTestFetcher(t)
+	offline.CacheDir = f.CacheDir
+	offline.Offline = true
+	if !offline.Available(srv.URL+"/good") || offline.Available(srv.URL+"/bad") || offline.Available(srv.URL+"/unknown") {
+		t.Errorf("Available() offline didn't match the online probes")
+	}
+}
+
+func TestAvailableConcurrent(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	heads := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		heads[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	f := newTestFetcher(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !f.Available(srv.URL + "/slow") {
+				t.Errorf("Available(slow) = false, want true")
+			}
+		}()
+	}
+	// A probe of another URL isn't held up by the slow one.
+	if !f.Available(srv.URL + "/fast") {
+		t.Errorf("Available(fast) = false, want true")
+	}
+	close(release)
+	wg.Wait()
+	if heads["/slow"] != 1 || heads["/fast"] != 1 {
+		t.Errorf("Available() made requests %v, want one per URL", heads)
+	}
+}
@@ -0,0 +1,289 @@
+package ignite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type (
+	// Generator generates Ignition configs for the nodes in config.json.
+	//
+	// All inputs, i.e. config.json and the units/ and checksums/
+	// directories, are read from the generator's fs.FS, and generated
+	// configs are written to its Sink.
+	Generator struct {
+		// SecretServiceHash is the secret service hash used in the URLs of secrets.
+		SecretServiceHash string
+		// TerraformOut is where nodes.auto.tfvars.json is written, if set.
+		TerraformOut Sink
+		// ServedOut is where the configs of served nodes are written, for
+		// the config server.
+		ServedOut Sink
+		// TokenKey is the key the tokens of served nodes are derived from.
+		TokenKey []byte
+		// Fetcher probes the mirrors of artifacts.
+		Fetcher *Fetcher
+		fsys    fs.FS
+		out     Sink
+	}
+	// Sink is where generated configs are written.
+	Sink interface {
+		// Write writes the generated config data to the named file, e.g.
+		// "core.json" for Ignition or "scw1.yaml" for cloud-init.
+		Write(name string, data []byte) error
+	}
+	// DirSink is a Sink writing configs as files in a directory.
+	DirSink string
+	// Output is the generated config for a single node.
+	Output struct {
+		// Name is the name of the node.
+		Name string
+		// V2 is the config if the node uses Ignition spec 2.x.
+		V2 *IgnitionConfig
+		// V3 is the config if the node uses Ignition spec 3.x.
+		V3 *IgnitionConfigV3
+		// CloudInit is the config if the node uses cloud-init.
+		CloudInit *CloudConfig
+		// Served is true if the config is served by the config server, and
+		// the node only gets a stub pointing at it.
+		Served bool
+	}
+)
+
+// NewGenerator returns a generator reading inputs from fsys and writing to out.
+func NewGenerator(fsys fs.FS, out Sink) *Generator {
+	return &Generator{
+		Fetcher: NewFetcher(""),
+		fsys:    fsys,
+		out:     out,
+	}
+}
+
+// Write writes the data to the named file in the directory, creating it if needed.
+func (d DirSink) Write(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return fmt.Errorf("failed to create dir %q: %v", d, err)
+	}
+	return WriteFile(filepath.Join(string(d), name), data, 0644)
+}
+
+// WriteFile writes data to the file at path atomically, by writing it to
+// a temporary file in the same directory and renaming it into place, so
+// that a failed write never leaves a partial file behind.
+func WriteFile(path string, data []byte, perm os.FileMode) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Config returns the generated config, in the layout of its spec version.
+func (o Output) Config() interface{} {
+	switch {
+	case o.CloudInit != nil:
+		return o.CloudInit
+	case o.V3 != nil:
+		return o.V3
+	}
+	return o.V2
+}
+
+// FileName returns the name of the file the config is written to, e.g.
+// "core.json", or "scw1.yaml" for cloud-init.
+func (o Output) FileName() string {
+	if o.CloudInit != nil {
+		return fmt.Sprintf("%s.yaml", o.Name)
+	}
+	return fmt.Sprintf("%s.json", o.Name)
+}
+
+// Marshal returns the generated config as JSON, or as a #cloud-config
+// document for cloud-init.
+func (o Output) Marshal() ([]byte, error) {
+	if o.CloudInit != nil {
+		return marshalCloudConfig(*o.CloudInit)
+	}
+	b, err := json.Marshal(o.Config())
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// ReadConfig returns the node/project configs, with the checksums of
+// each project version the nodes run, including those of the projects'
+// includes.
+//
+// The config of each node is its effective config, with the settings of
+// its groups applied.
+func (g *Generator) ReadConfig() (*Config, error) {
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		return nil, err
+	}
+	for nn, nc := range conf.NodeConfigs {
+		nc := nc
+		nc.checksums = map[ProjectVersion]checksums{}
+		for _, pv := range nc.ProjectVersions {
+			checksums, err := pv.getChecksums(g.fsys)
+			if err != nil {
+				return nil, err
+			}
+			nc.checksums[pv] = checksums
+		}
+		conf.NodeConfigs[nn] = nc
+	}
+	return conf, nil
+}
+
+// ReadConfigWithoutChecksums returns the node/project configs like
+// ReadConfig, but without reading checksums/, e.g. to write them.
+func (g *Generator) ReadConfigWithoutChecksums() (*Config, error) {
+	conf, err := g.readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.applyGroups(); err != nil {
+		return nil, err
+	}
+	if err := conf.expandProjects(); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// readConfigFile returns the node/project configs from config.json,
+// without loading any checksums.
+func (g *Generator) readConfigFile() (*Config, error) {
+	conf := Config{}
+	b, err := fs.ReadFile(g.fsys, "config.json")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return nil, fmt.Errorf("failed to decode config.json: %v", err)
+	}
+	return &conf, nil
+}
+
+// ValidateConfig reads config.json and returns all problems found in it.
+//
+// An error is only returned if config.json itself can't be read.
+func (g *Generator) ValidateConfig() (*Config, Problems, error) {
+	conf, err := g.readConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conf, g.Validate(*conf), nil
+}
+
+// Build returns the generated configs for all nodes in conf, sorted by name.
+func (g *Generator) Build(conf Config) ([]Output, error) {
+	ns, err := g.getNodes(conf)
+	if err != nil {
+		return nil, err
+	}
+	result := []Output{}
+	for _, n := range ns {
+		result = append(result, n.getOutput())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// Generate reads the config, builds configs for the named nodes, or all
+// nodes if none are named, and writes them to the sink, along with their
+// Terraform variables if TerraformOut is set.
+//
+// The configs of served nodes are written to ServedOut, with stubs
+// fetching them written to the sink.
+func (g *Generator) Generate(names ...string) ([]Output, error) {
+	conf, err := g.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Read config with %d nodes.\n", len(conf.NodeConfigs))
+	// vars are the Terraform variables of the nodes that aren't regenerated.
+	vars := map[string]terraformNode{}
+	if len(names) > 0 {
+		if g.TerraformOut != nil {
+			if vars, err = g.readTerraformVars(*conf); err != nil {
+				return nil, err
+			}
+		}
+		only := NodeConfigs{}
+		for _, name := range names {
+			nc, exists := conf.NodeConfigs.Get(name)
+			if !exists {
+				return nil, fmt.Errorf("no node %q in config.json", name)
+			}
+			only[nodeName(name)] = nc
+		}
+		conf.NodeConfigs = only
+	}
+	outputs, err := g.Build(*conf)
+	if err != nil {
+		return nil, err
+	}
+	// userData are the configs written for each node.
+	userData := map[string][]byte{}
+	for _, o := range outputs {
+		b, err := o.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal config for %q: %v", o.Name, err)
+		}
+		if o.Served {
+			if b, err = g.writeServed(*conf, o, b); err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("Writing %s..\n", o.FileName())
+		if err := g.out.Write(o.FileName(), b); err != nil {
+			return nil, fmt.Errorf("failed to write config for %q: %v", o.Name, err)
+		}
+		userData[o.Name] = b
+	}
+	if g.TerraformOut != nil {
+		b, err := marshalTerraformVars(*conf, userData, vars)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Writing %s..\n", terraformVarsFile)
+		if err := g.TerraformOut.Write(terraformVarsFile, b); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %v", terraformVarsFile, err)
+		}
+	}
+	return outputs, nil
+}
+
+// ReadConfig returns the node/project configs, read from the current directory.
+func ReadConfig() (*Config, error) {
+	return NewGenerator(os.DirFS("."), DirSink("bootstrap")).ReadConfig()
+}
@@ -0,0 +1,237 @@
+package ignite
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// mapSink is a Sink keeping written configs in memory.
+type mapSink map[string][]byte
+
+func (s mapSink) Write(name string, data []byte) error {
+	s[name] = data
+	return nil
+}
+
+// testConfig is the config.json used in tests.
+const testConfig = `{
+	"secretservice_domain": "secrets.example.com",
+	"project_configs": {
+		"hkjninfra": {
+			"vars": {"report_addr": "mon.example.com:50051"},
+			"units": ["tclient.service"],
+			"files": [
+				{"name": "gather_facts", "path": "/opt/bin/gather_facts", "arch_independent": true},
+				{"name": "tclient", "path": "/opt/bin/tclient"}
+			],
+			"secrets": [
+				{"name": "client.pem", "path": "/etc/ssl/client.pem"}
+			]
+		},
+		"bitcoin": {
+			"dropins": [
+				{"unit": "docker.service", "dropin": "10_override_storage.conf"}
+			]
+		}
+	},
+	"nodes": {
+		"arm": {
+			"arch": "armv7l",
+			"ignition_version": "3.0.0",
+			"projects": [{"name": "hkjninfra", "version": "1.5.13"}]
+		},
+		"core": {
+			"arch": "x86_64",
+			"vars": {"report_addr": "mon2.example.com:50051"},
+			"update": {"channel": "beta", "reboot_strategy": "etcd-lock"},
+			"projects": [
+				{"name": "hkjninfra", "version": "1.5.13"},
+				{"name": "bitcoin", "version": "0.0.15"}
+			]
+		}
+	}
+}`
+
+// newTestFS returns the inputs used in tests, with config.json replaced by conf.
+func newTestFS(conf string) fstest.MapFS {
+	return fstest.MapFS{
+		"config.json":                    {Data: []byte(conf)},
+		"units/tclient.service":          {Data: []byte("[Service]\nExecStart=/opt/bin/tclient -addr {{.Vars.report_addr}}\n")},
+		"units/10_override_storage.conf": {Data: []byte("[Service]\n")},
+		"checksums/hkjninfra_1.5.13.sha512": {Data: []byte(strings.Join([]string{
+			"aaa  tclient_armv7l",
+			"bbb  tclient_x86_64",
+			"ccc  gather_facts",
+			"ddd  client.pem",
+			"",
+		}, "\n"))},
+		"checksums/bitcoin_0.0.15.sha512": {Data: []byte("")},
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	out := mapSink{}
+	g := NewGenerator(newTestFS(testConfig), out)
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	if len(outputs) != 2 || outputs[0].Name != "arm" || outputs[1].Name != "core" {
+		t.Fatalf("Generate() = %v, want configs for arm and core", outputs)
+	}
+
+	core := outputs[1].V2
+	if core == nil || outputs[1].V3 != nil {
+		t.Fatalf("Generate() for core = %+v, want spec 2.x config", outputs[1])
+	}
+	gotFiles := map[string]string{}
+	for _, f := range core.Storage.Files {
+		gotFiles[f.Path] = describeFile(f.Contents.Source, f.Contents.Verification.Hash, f.Mode)
+	}
+	wantFiles := map[string]string{
+		"/etc/coreos/update.conf": describeFile("data:,GROUP%3Dbeta%0AREBOOT_STRATEGY%3D%22etcd-lock%22", "", 0644),
+		"/opt/bin/gather_facts":   describeFile("https://github.com/hkjn/hkjninfra/releases/download/1.5.13/gather_facts", "sha512-ccc", 0755),
+		"/opt/bin/tclient":        describeFile("https://github.com/hkjn/hkjninfra/releases/download/1.5.13/tclient_x86_64", "sha512-bbb", 0755),
+		"/etc/ssl/client.pem":     describeFile("https://secrets.example.com/123abc/files/hkjninfra/1.5.13/certs/client.pem", "sha512-ddd", 0600),
+	}
+	if !reflect.DeepEqual(gotFiles, wantFiles) {
+		t.Errorf("Generate() for core got files %v, want %v", gotFiles, wantFiles)
+	}
+	if len(core.Systemd.Units) != 3 || core.Systemd.Units[1].Dropins[0].Name != "10_override_storage.conf" {
+		t.Fatalf("Generate() for core got units %+v, want tclient.service, docker.service dropin and locksmithd.service", core.Systemd.Units)
+	}
+	if u := core.Systemd.Units[2]; u.Name != "locksmithd.service" || !u.Enable || len(u.Dropins) != 0 {
+		t.Errorf("Generate() for core got unit %+v, want enabled locksmithd.service using its default endpoint", u)
+	}
+	if want := "[Service]\nExecStart=/opt/bin/tclient -addr mon2.example.com:50051\n"; core.Systemd.Units[0].Contents != want {
+		t.Errorf("Generate() for core got tclient.service %q, want %q", core.Systemd.Units[0].Contents, want)
+	}
+
+	arm := outputs[0].V3
+	if arm == nil {
+		t.Fatalf("Generate() for arm = %+v, want spec 3.x config", outputs[0])
+	}
+	if arm.Storage.Files[1].Contents.Source != "https://github.com/hkjn/hkjninfra/releases/download/1.5.13/tclient_armv7l" {
+		t.Errorf("Generate() for arm got tclient %+v, want armv7l artifact", arm.Storage.Files[1])
+	}
+	if want := "[Service]\nExecStart=/opt/bin/tclient -addr mon.example.com:50051\n"; arm.Systemd.Units[0].Contents != want {
+		t.Errorf("Generate() for arm got tclient.service %q, want %q", arm.Systemd.Units[0].Contents, want)
+	}
+
+	for _, o := range outputs {
+		var got map[string]interface{}
+		if err := json.Unmarshal(out[o.FileName()], &got); err != nil {
+			t.Errorf("Generate() wrote bad JSON for %q: %v", o.Name, err)
+		}
+	}
+}
+
+// describeFile returns a short description of a file's source, hash and mode.
+func describeFile(source, hash string, mode int) string {
+	return fmt.Sprintf("%s %s %o", source, hash, mode)
+}
+
+func TestGenerateFileOwners(t *testing.T) {
+	conf := strings.Replace(testConfig, `{"name": "tclient", "path": "/opt/bin/tclient"}`,
+		`{"name": "tclient", "path": "/opt/bin/tclient", "mode": 488, "user": {"id": 500}, "group": {"id": 501}}`, 1)
+	g := NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	for _, o := range outputs {
+		got := o.state().files["/opt/bin/tclient"]
+		if got.mode != 0750 || got.user != "500" || got.group != "501" {
+			t.Errorf("Generate() for %s got tclient %+v, want mode 0750 owned by 500:501", o.Name, got)
+		}
+		if gf := o.state().files["/opt/bin/gather_facts"]; gf.mode != 0755 || gf.user != "" || gf.group != "" {
+			t.Errorf("Generate() for %s got gather_facts %+v, want mode 0755 owned by root", o.Name, gf)
+		}
+	}
+
+	conf = strings.Replace(testConfig, `{"name": "tclient", "path": "/opt/bin/tclient"}`,
+		`{"name": "tclient", "path": "/opt/bin/tclient", "user": {"name": "tclient"}}`, 1)
+	g = NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	want := `node "core": file "/opt/bin/tclient" is owned by name, which needs Ignition 2.1.0 or later`
+	if _, err := g.Generate(); err == nil || err.Error() != want {
+		t.Errorf("Generate() with tclient owned by name returned error %v, want %q", err, want)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	cases := []struct {
+		desc    string
+		conf    string
+		sshash  string
+		wantErr string
+	}{
+		{
+			desc:    "no secret service hash",
+			conf:    testConfig,
+			wantErr: "no secret service hash",
+		},
+		{
+			desc:    "missing arch artifact",
+			conf:    strings.Replace(testConfig, `"armv7l"`, `"aarch64"`, 1),
+			sshash:  "123abc",
+			wantErr: `no artifact "tclient" for arch "aarch64"`,
+		},
+		{
+			desc:    "missing template variable",
+			conf:    strings.Replace(testConfig, `"vars": {"report_addr": "mon.example.com:50051"},`, "", 1),
+			sshash:  "123abc",
+			wantErr: `map has no entry for key "report_addr"`,
+		},
+		{
+			desc:    "unsupported spec version",
+			conf:    strings.Replace(testConfig, `"3.0.0"`, `"4.0.0"`, 1),
+			sshash:  "123abc",
+			wantErr: `unsupported ignition_version "4.0.0"`,
+		},
+	}
+	for _, tt := range cases {
+		g := NewGenerator(newTestFS(tt.conf), mapSink{})
+		g.SecretServiceHash = tt.sshash
+		_, err := g.Generate()
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Generate() returned error %v, want %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg0.key")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(path, []byte("new"), 0600); err != nil {
+		t.Fatalf("WriteFile() returned error: %v", err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new" || fi.Mode().Perm() != 0600 {
+		t.Errorf("WriteFile() wrote %q with mode %v, want \"new\" with mode 0600", b, fi.Mode().Perm())
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("WriteFile() left files %v in the directory, want only wg0.key", entries)
+	}
+	if err := WriteFile(filepath.Join(dir, "missing", "x"), nil, 0644); err == nil {
+		t.Errorf("WriteFile() to a missing directory returned no error")
+	}
+}
@@ -0,0 +1,174 @@
+package ignite
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NodeGroups are named groups of nodes, with the settings shared by their
+// members, e.g. "btc-nodes".
+type NodeGroups map[string]NodeConfig
+
+// copyMap returns a copy of the map, or nil if it's empty.
+func copyMap(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	result := map[string]string{}
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+// mergeMaps returns the entries of a, with those of b added or replacing them.
+func mergeMaps(a, b map[string]string) map[string]string {
+	result := copyMap(a)
+	if len(b) > 0 && result == nil {
+		result = map[string]string{}
+	}
+	for k, v := range b {
+		result[k] = v
+	}
+	return result
+}
+
+// merge returns nc with override applied on top.
+//
+// Scalar fields of override replace those of nc if they're set. Projects
+// and networkd units replace those with the same name, and are otherwise
+// added, as are storage entries. Vars, labels, users and update policy are
+// merged.
+func (nc NodeConfig) merge(override NodeConfig) NodeConfig {
+	result := nc
+	result.ProjectVersions = append([]ProjectVersion{}, nc.ProjectVersions...)
+	for _, pv := range override.ProjectVersions {
+		replaced := false
+		for i, existing := range result.ProjectVersions {
+			if existing.Name == pv.Name {
+				result.ProjectVersions[i] = pv
+				replaced = true
+			}
+		}
+		if !replaced {
+			result.ProjectVersions = append(result.ProjectVersions, pv)
+		}
+	}
+	if override.Arch != "" {
+		result.Arch = override.Arch
+	}
+	if override.IgnitionVersion != "" {
+		result.IgnitionVersion = override.IgnitionVersion
+	}
+	if override.Output != "" {
+		result.Output = override.Output
+	}
+	if override.Provider != "" {
+		result.Provider = override.Provider
+	}
+	if override.Serve != nil {
+		result.Serve = override.Serve
+	}
+	result.Vars = mergeMaps(nc.Vars, override.Vars)
+	result.Labels = mergeMaps(nc.Labels, override.Labels)
+	result.Passwd = nc.Passwd.merge(override.Passwd)
+	result.Networkd = append([]NetworkdUnit{}, nc.Networkd...)
+	for _, u := range override.Networkd {
+		replaced := false
+		for i, existing := range result.Networkd {
+			if existing.Name == u.Name {
+				result.Networkd[i] = u
+				replaced = true
+			}
+		}
+		if !replaced {
+			result.Networkd = append(result.Networkd, u)
+		}
+	}
+	result.Storage = NodeStorage{
+		Disks:       append(append([]Disk{}, nc.Storage.Disks...), override.Storage.Disks...),
+		Filesystems: append(append([]Filesystem{}, nc.Storage.Filesystems...), override.Storage.Filesystems...),
+		Directories: append(append([]Directory{}, nc.Storage.Directories...), override.Storage.Directories...),
+		Links:       append(append([]Link{}, nc.Storage.Links...), override.Storage.Links...),
+	}
+	result.Update = nc.Update.merge(override.Update)
+	result.Wireguard = nc.Wireguard
+	if override.Wireguard != nil {
+		result.Wireguard = override.Wireguard
+	}
+	return result
+}
+
+// effective returns the config of the named node with the settings of its
+// groups applied in order, and then its own on top, as well as the names
+// of any groups that don't exist.
+func (conf Config) effective(name nodeName) (NodeConfig, []string) {
+	nc := conf.NodeConfigs[name]
+	result := NodeConfig{}
+	unknown := []string{}
+	for _, gn := range nc.Groups {
+		group, exists := conf.NodeGroups[gn]
+		if !exists {
+			unknown = append(unknown, gn)
+			continue
+		}
+		result = result.merge(group)
+	}
+	result = result.merge(nc)
+	result.Groups = nc.Groups
+	return result, unknown
+}
+
+// projectRefs returns the projects the named node runs, before
+// includes, with the path in its groups or own config that sets each.
+func (conf Config) projectRefs(name nodeName) []projectRef {
+	nc := conf.NodeConfigs[name]
+	result := []projectRef{}
+	add := func(refs []projectRef) {
+		for _, ref := range refs {
+			replaced := false
+			for i, existing := range result {
+				if existing.pv.Name == ref.pv.Name {
+					result[i] = ref
+					replaced = true
+				}
+			}
+			if !replaced {
+				result = append(result, ref)
+			}
+		}
+	}
+	for _, gn := range nc.Groups {
+		if group, exists := conf.NodeGroups[gn]; exists {
+			add(newProjectRefs(jsonPath("node_groups", gn), group.ProjectVersions))
+		}
+	}
+	add(newProjectRefs(jsonPath("nodes", string(name)), nc.ProjectVersions))
+	return result
+}
+
+// applyGroups replaces the config of each node with its effective config.
+func (conf *Config) applyGroups() error {
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		nc, unknown := conf.effective(nn)
+		if len(unknown) > 0 {
+			return fmt.Errorf("node %q: unknown group %q", nn, unknown[0])
+		}
+		conf.NodeConfigs[nn] = nc
+	}
+	return nil
+}
+
+// validate checks that groups don't themselves join groups.
+func (groups NodeGroups) validate(problems *Problems) {
+	names := []string{}
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(groups[name].Groups) > 0 {
+			problems.add(jsonPath("node_groups", name)+".groups", "groups can't join other groups")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEffective(t *testing.T) {
+	served, notServed := true, false
+	conf := Config{
+		NodeGroups: NodeGroups{
+			"btc-nodes": {
+				Arch:            "x86_64",
+				ProjectVersions: []ProjectVersion{{"hkjninfra", "1.5.13"}, {"bitcoin", "0.0.15"}},
+				Vars:            map[string]string{"report_addr": "mon.example.com:50051", "datadir": "/containers"},
+				Labels:          map[string]string{"role": "btc"},
+			},
+			"x86": {
+				Arch:  "x86_64",
+				Serve: &served,
+			},
+		},
+		NodeConfigs: NodeConfigs{
+			"btc1": {
+				Groups:          []string{"btc-nodes", "nope"},
+				ProjectVersions: []ProjectVersion{{"hkjninfra", "1.5.12"}},
+				Vars:            map[string]string{"datadir": "/data"},
+				Labels:          map[string]string{"stage": "canary"},
+			},
+		},
+	}
+	got, unknown := conf.effective("btc1")
+	if want := []string{"nope"}; !reflect.DeepEqual(unknown, want) {
+		t.Errorf("effective() got unknown groups %v, want %v", unknown, want)
+	}
+	if want := []ProjectVersion{{"hkjninfra", "1.5.12"}, {"bitcoin", "0.0.15"}}; !reflect.DeepEqual(got.ProjectVersions, want) {
+		t.Errorf("effective() got projects %v, want %v", got.ProjectVersions, want)
+	}
+	if got.Arch != "x86_64" {
+		t.Errorf("effective() got arch %q, want x86_64", got.Arch)
+	}
+	if want := map[string]string{"report_addr": "mon.example.com:50051", "datadir": "/data"}; !reflect.DeepEqual(got.Vars, want) {
+		t.Errorf("effective() got vars %v, want %v", got.Vars, want)
+	}
+	if want := map[string]string{"role": "btc", "stage": "canary"}; !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("effective() got labels %v, want %v", got.Labels, want)
+	}
+	if conf.NodeGroups["btc-nodes"].Vars["datadir"] != "/containers" {
+		t.Errorf("effective() changed the vars of the group")
+	}
+
+	conf.NodeConfigs["btc2"] = NodeConfig{Groups: []string{"x86"}}
+	if got, _ := conf.effective("btc2"); !got.served() {
+		t.Errorf("effective() for btc2 got serve %v, want served by its group", got.Serve)
+	}
+	conf.NodeConfigs["btc2"] = NodeConfig{Groups: []string{"x86"}, Serve: &notServed}
+	if got, _ := conf.effective("btc2"); got.served() {
+		t.Errorf("effective() for btc2 got serve %v, want turned off by the node", *got.Serve)
+	}
+
+	refs := conf.projectRefs("btc1")
+	want := []projectRef{
+		{ProjectVersion{"hkjninfra", "1.5.12"}, "nodes.btc1.projects[0]"},
+		{ProjectVersion{"bitcoin", "0.0.15"}, `node_groups["btc-nodes"].projects[1]`},
+	}
+	if !reflect.DeepEqual(refs, want) {
+		t.Errorf("projectRefs() = %v, want %v", refs, want)
+	}
+}
+
+func TestGenerateGroups(t *testing.T) {
+	conf := strings.Replace(testConfig, `"nodes": {`, `"node_groups": {
+		"infra": {
+			"vars": {"report_addr": "mon-eu.example.com:50051"},
+			"projects": [{"name": "hkjninfra", "version": "1.5.13"}]
+		}
+	},
+	"nodes": {`, 1)
+	conf = strings.Replace(conf, `"vars": {"report_addr": "mon2.example.com:50051"},`, `"groups": ["infra", "nope"],`, 1)
+	g := NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	if _, err := g.Generate(); err == nil || !strings.Contains(err.Error(), `node "core": unknown group "nope"`) {
+		t.Errorf("Generate() returned error %v, want unknown group", err)
+	}
+
+	conf = strings.Replace(conf, `"groups": ["infra", "nope"],`, `"groups": ["infra"],`, 1)
+	g = NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	if want := "[Service]\nExecStart=/opt/bin/tclient -addr mon-eu.example.com:50051\n"; outputs[1].V2.Systemd.Units[0].Contents != want {
+		t.Errorf("Generate() for core got tclient.service %q, want %q", outputs[1].V2.Systemd.Units[0].Contents, want)
+	}
+}
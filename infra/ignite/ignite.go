@@ -1,18 +1,11 @@
 // Package ignite deals with Ignite JSON configs.
-//
-// TODO: Fix issue with missing /etc/ssl .pem files in hkjninfra project, seems like call to ProjectConfigs.GetSecrets() got lost..
 package ignite
 
 import (
-	"crypto/sha512"
-	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
+	"io/fs"
 	"log"
-	"net/http"
-	"os"
-	"os/user"
+	"path"
 	"sort"
 	"strings"
 )
@@ -25,17 +18,25 @@ type (
 		Source       string           `json:"source"`
 		Verification fileVerification `json:"verification"`
 	}
+	// owner is the user or group owning a file.
+	owner struct {
+		ID   *int   `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
+	}
 	file struct {
-		Filesystem string            `json:"filesystem"`
-		Path       string            `json:"path"`
-		Contents   fileContents      `json:"contents"`
-		Mode       int               `json:"mode"`
-		User       map[string]string `json:"user"`
-		Group      map[string]string `json:"group"`
+		Filesystem string       `json:"filesystem"`
+		Path       string       `json:"path"`
+		Contents   fileContents `json:"contents"`
+		Mode       int          `json:"mode"`
+		User       owner        `json:"user"`
+		Group      owner        `json:"group"`
 	}
 	storage struct {
-		Filesystem []string `json:"filesystem"`
-		Files      []file   `json:"files"`
+		Disks       []disk       `json:"disks,omitempty"`
+		Filesystems []filesystem `json:"filesystems,omitempty"`
+		Files       []file       `json:"files"`
+		Directories []directory  `json:"directories,omitempty"`
+		Links       []link       `json:"links,omitempty"`
 	}
 	systemdDropin struct {
 		Name     string `json:"name"`
@@ -48,18 +49,23 @@ type (
 		Dropins  []systemdDropin `json:"dropins,omitempty"`
 	}
 	systemd struct {
-		Units    []systemdUnit     `json:"units"`
-		Passwd   map[string]string `json:"passwd"`
-		Networkd map[string]string `json:"networkd"`
+		Units []systemdUnit `json:"units"`
+	}
+	// ignitionConfig points at a config to use instead of this one.
+	ignitionConfig struct {
+		Replace *fileContents `json:"replace,omitempty"`
 	}
 	ignition struct {
-		Version string            `json:"version"`
-		Config  map[string]string `json:"config"`
+		Version string         `json:"version"`
+		Config  ignitionConfig `json:"config"`
 	}
-	ignitionConfig struct {
+	// IgnitionConfig is an Ignition config in the spec 2.x layout.
+	IgnitionConfig struct {
 		Ignition ignition `json:"ignition"`
 		Storage  storage  `json:"storage"`
 		Systemd  systemd  `json:"systemd"`
+		Networkd networkd `json:"networkd"`
+		Passwd   passwd   `json:"passwd"`
 	}
 	// binary to fetch on a node
 	binary struct {
@@ -69,6 +75,10 @@ type (
 		checksum string
 		// path on the remote node for the binary, e.g. "/opt/bin/tserver"
 		path string
+		// mode of the file on the remote node, e.g. 0755
+		mode int
+		// user and group owning the file on the remote node, or nil for root
+		user, group *Owner
 	}
 	Version string
 	// nodeName is the name of a node, e.g. "core".
@@ -79,8 +89,24 @@ type (
 		name nodeName
 		// binaries are the files to install on the node.
 		binaries []binary
+		// secrets are the secret files to install on the node.
+		secrets []binary
 		// systemdUnits are the systemd units to use for the node.
 		systemdUnits []systemdUnit
+		// ignitionVersion is the Ignition spec version to emit, e.g. "2.0.0".
+		ignitionVersion string
+		// passwd are the users and groups of the node.
+		passwd Passwd
+		// networkdUnits are the systemd-networkd units of the node.
+		networkdUnits []networkdUnit
+		// storage are the disks, filesystems, directories and links of the node.
+		storage NodeStorage
+		// updateFiles are the files configuring OS updates on the node.
+		updateFiles []file
+		// output is what the node's config is generated for, e.g. "cloud-init".
+		output string
+		// served is true if the node fetches its config from the config server.
+		served bool
 	}
 	nodes map[nodeName]node
 	// ProjectName is the name of a project.
@@ -103,12 +129,58 @@ type (
 		checksums map[ProjectVersion]checksums
 		// arch is the CPU architecture the node runs, e.g. "x86_64"
 		Arch string `json:"arch"`
+		// IgnitionVersion is the Ignition spec version to emit, e.g. "3.0.0"; defaults to "2.0.0"
+		IgnitionVersion string `json:"ignition_version,omitempty"`
+		// Output is "ignition" for nodes booting with Ignition, the default,
+		// or "cloud-init" for nodes booting with cloud-init, like Debian.
+		Output string `json:"output,omitempty"`
+		// Provider is where Terraform provisions the node, e.g. "gcp", "digitalocean" or "scaleway".
+		Provider string `json:"provider,omitempty"`
+		// Serve makes the node fetch its config from the config server,
+		// with a stub pointing at it as its bootstrap config. It's a
+		// pointer, so that a node can turn off serving set by its groups.
+		Serve *bool `json:"serve,omitempty"`
+		// Vars are variables available to unit templates as .Vars, overriding those of the projects.
+		Vars map[string]string `json:"vars,omitempty"`
+		// Passwd are the users and groups of the node, merged with those of the config.
+		Passwd Passwd `json:"passwd"`
+		// Networkd are the systemd-networkd units of the node, e.g. for static addresses.
+		Networkd []NetworkdUnit `json:"networkd,omitempty"`
+		// Storage are the disks, filesystems, directories and links of the node.
+		Storage NodeStorage `json:"storage"`
+		// Update overrides fields of the update policy of the config for the node.
+		Update *Update `json:"update,omitempty"`
+		// Groups are the node groups the node joins, whose settings apply
+		// in order before the node's own.
+		Groups []string `json:"groups,omitempty"`
+		// Labels are arbitrary attributes of the node, e.g. {"stage": "canary"},
+		// available to templates as .Node.Labels.
+		Labels map[string]string `json:"labels,omitempty"`
+		// Wireguard makes the node a member of a WireGuard mesh, peering
+		// with all other members.
+		Wireguard *NodeWireguard `json:"wireguard,omitempty"`
 	}
 
 	NodeFile struct {
 		Path        string `json:"path"`
 		Name        string `json:"name"`
 		ChecksumKey string `json:"checksum_key"`
+		// Arch maps node archs to artifact names, e.g. {"armv7l": "tclient_arm"}, for
+		// artifacts that don't follow the "<name>_<arch>" convention.
+		Arch map[string]string `json:"arch,omitempty"`
+		// ArchIndependent marks artifacts that run on any arch, like
+		// scripts, which are used as named on all nodes.
+		ArchIndependent bool `json:"arch_independent,omitempty"`
+		// Mode is the mode of the file on the node, defaulting to 0755 for files and 0600 for secrets.
+		Mode int `json:"mode,omitempty"`
+		// User and Group own the file on the node, defaulting to root.
+		User  *Owner `json:"user,omitempty"`
+		Group *Owner `json:"group,omitempty"`
+	}
+	// Owner is a user or group owning a file on a node, by id or name.
+	Owner struct {
+		ID   *int   `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
 	}
 	NodeFiles  []NodeFile
 	Secret     NodeFile
@@ -122,37 +194,83 @@ type (
 
 	// projectConfig is the full configuration for a project.
 	projectConfig struct {
-		Units   []string     `json:"units"`
-		Dropins []DropinName `json:"dropins"`
-		Files   NodeFiles    `json:"files"`
-		Secrets NodeFiles    `json:"secrets"`
+		// Includes are other projects to run along with the project, before it.
+		Includes []ProjectVersion `json:"includes,omitempty"`
+		Units    []string         `json:"units"`
+		Dropins  []DropinName     `json:"dropins"`
+		Files    NodeFiles        `json:"files"`
+		Secrets  NodeFiles        `json:"secrets"`
+		// Artifacts overrides where the project's release artifacts are fetched from.
+		Artifacts *ArtifactSources `json:"artifacts,omitempty"`
+		// Vars are variables available to the project's unit templates as .Vars.
+		Vars map[string]string `json:"vars,omitempty"`
 	}
 	// ProjectConfigs represents all the project configurations.
 	ProjectConfigs map[ProjectName]projectConfig
 	// NodeConfigs is the configuration of all nodes.
 	NodeConfigs map[nodeName]NodeConfig
 	Config      struct {
+		// SecretServiceDomain is the domain secrets are served from, e.g. "admin1.hkjn.me".
+		SecretServiceDomain string `json:"secretservice_domain"`
+		// Artifacts is where release artifacts are fetched from, unless overridden by the project.
+		Artifacts ArtifactSources `json:"artifacts"`
+		// Passwd are the users and groups of all nodes.
+		Passwd Passwd `json:"passwd"`
+		// Update is the update policy of all nodes, unless overridden by the node.
+		Update *Update `json:"update,omitempty"`
+		// Serve is where the configs of nodes with serve set are served.
+		Serve          *ServeConfig   `json:"serve,omitempty"`
 		ProjectConfigs ProjectConfigs `json:"project_configs"`
-		NodeConfigs    NodeConfigs    `json:"nodes"`
+		// UnitChecks configures checking the paths units refer to against the files of nodes.
+		UnitChecks UnitChecks `json:"unit_checks"`
+		// NodeGroups are settings shared by the nodes joining each group.
+		NodeGroups NodeGroups `json:"node_groups,omitempty"`
+		// WireguardMeshes are the WireGuard meshes nodes can join.
+		WireguardMeshes WireguardMeshes `json:"wireguard_meshes,omitempty"`
+		NodeConfigs     NodeConfigs     `json:"nodes"`
 	}
 )
 
-// sharedFiles are the shared files for each node.
-var sharedFiles = []file{
-	{
+// dataURL returns a data URL with given contents, escaping all but
+// unreserved characters.
+func dataURL(contents string) string {
+	var b strings.Builder
+	b.WriteString("data:,")
+	for i := 0; i < len(contents); i++ {
+		c := contents[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// newDataFile returns a file at path with given contents, readable by all.
+func newDataFile(path, contents string) file {
+	return file{
 		Filesystem: "root",
-		Path:       "/etc/coreos/update.conf",
-		Contents: fileContents{
-			Source:       "data:,GROUP%3Dbeta%0AREBOOT_STRATEGY%3D%22etcd-lock%22",
-			Verification: fileVerification{},
-		},
-		Mode:  420,
-		User:  map[string]string{},
-		Group: map[string]string{},
-	},
+		Path:       path,
+		Contents:   fileContents{Source: dataURL(contents)},
+		Mode:       0644,
+	}
+}
+
+// toOwner returns the Ignition form of the owner.
+func (o *Owner) toOwner() owner {
+	if o == nil {
+		return owner{}
+	}
+	return owner{ID: o.ID, Name: o.Name}
 }
 
 func (b binary) toFile() file {
+	mode := b.mode
+	if mode == 0 {
+		mode = 0755
+	}
 	return file{
 		Filesystem: "root",
 		Path:       b.path,
@@ -162,18 +280,15 @@ func (b binary) toFile() file {
 				Hash: fmt.Sprintf("sha512-%s", b.checksum),
 			},
 		},
-		Mode:  493,
-		User:  map[string]string{},
-		Group: map[string]string{},
+		Mode:  mode,
+		User:  b.user.toOwner(),
+		Group: b.group.toOwner(),
 	}
 }
 
-// newSystemdUnit reads systemd unit from file name.
-func newSystemdUnit(unitFile string) (*systemdUnit, error) {
-	b, err := ioutil.ReadFile(fmt.Sprintf(
-		"units/%s",
-		unitFile,
-	))
+// newSystemdUnit reads systemd unit from file name under units/ in fsys.
+func newSystemdUnit(fsys fs.FS, unitFile string) (*systemdUnit, error) {
+	b, err := fs.ReadFile(fsys, path.Join("units", unitFile))
 	if err != nil {
 		return nil, err
 	}
@@ -184,9 +299,9 @@ func newSystemdUnit(unitFile string) (*systemdUnit, error) {
 	}, nil
 }
 
-// Load returns the systemd units.
-func (dn DropinName) Load() (*systemdUnit, error) {
-	b, err := ioutil.ReadFile(fmt.Sprintf("units/%s", dn.Dropin))
+// Load returns the systemd units, reading the dropin from units/ in fsys.
+func (dn DropinName) Load(fsys fs.FS) (*systemdUnit, error) {
+	b, err := fs.ReadFile(fsys, path.Join("units", dn.Dropin))
 	if err != nil {
 		return nil, err
 	}
@@ -205,14 +320,15 @@ func (dn DropinName) Load() (*systemdUnit, error) {
 func (n node) getFiles() []file {
 	result := make(
 		[]file,
-		len(n.binaries)+len(sharedFiles),
-		len(n.binaries)+len(sharedFiles),
+		0,
+		len(n.binaries)+len(n.secrets)+len(n.updateFiles),
 	)
-	for i, sharedFile := range sharedFiles {
-		result[i] = sharedFile
+	result = append(result, n.updateFiles...)
+	for _, bin := range n.binaries {
+		result = append(result, bin.toFile())
 	}
-	for j, bin := range n.binaries {
-		result[j+len(sharedFiles)] = bin.toFile()
+	for _, secret := range n.secrets {
+		result = append(result, secret.toFile())
 	}
 	return result
 }
@@ -220,82 +336,83 @@ func (n node) getFiles() []file {
 // String returns a human-readable description of the node.
 func (n node) String() string {
 	return fmt.Sprintf(
-		"%q (%d binaries, %d systemd units)",
+		"%q (Ignition %s, %d binaries, %d secrets, %d systemd units, %d users)",
 		n.name,
+		n.ignitionVersion,
 		len(n.binaries),
+		len(n.secrets),
 		len(n.systemdUnits),
+		len(n.passwd.Users),
 	)
 }
 
-// Write writes the Ignition config to disk.
-func (n node) Write() error {
-	bp := "bootstrap"
-	_, err := os.Stat(bp)
-	if os.IsNotExist(err) {
-		if mkerr := os.Mkdir(bp, 755); mkerr != nil {
-			u, _ := user.Current()
-			return fmt.Errorf("failed to create dir %q as %s:%s: %v", bp, u.Uid, u.Gid, mkerr)
-		}
-	} else if err != nil {
-		return fmt.Errorf("failed to stat %q: %v", bp, err)
-	}
-	f, err := os.Create(fmt.Sprintf("%s/%s.json", bp, n.name))
-	if err != nil {
-		return err
+// getOutput returns the generated config for the node, in the layout of
+// its Ignition spec version, or as a cloud-init config.
+func (n node) getOutput() Output {
+	result := Output{Name: string(n.name), Served: n.served}
+	if n.output == outputCloudInit {
+		conf := n.getCloudConfig()
+		result.CloudInit = &conf
+	} else if isV3(n.ignitionVersion) {
+		conf := n.getIgnitionConfigV3()
+		result.V3 = &conf
+	} else {
+		conf := n.getIgnitionConfig()
+		result.V2 = &conf
 	}
-	defer f.Close()
-
-	conf := n.getIgnitionConfig()
-	return json.NewEncoder(f).Encode(&conf)
+	return result
 }
 
-// getIgnitionConfig returns the ignition config for the nod.
-func (n node) getIgnitionConfig() ignitionConfig {
-	return ignitionConfig{
+// getIgnitionConfig returns the spec 2.x ignition config for the node.
+func (n node) getIgnitionConfig() IgnitionConfig {
+	return IgnitionConfig{
 		Ignition: ignition{
-			Version: "2.0.0",
-			Config:  map[string]string{},
+			Version: n.ignitionVersion,
 		},
 		Storage: storage{
-			Filesystem: []string{},
-			Files:      n.getFiles(),
+			Disks:       n.storage.getDisks(),
+			Filesystems: n.storage.getFilesystems(n.ignitionVersion),
+			Files:       n.getFiles(),
+			Directories: n.storage.getDirectories(),
+			Links:       n.storage.getLinks(),
 		},
 		Systemd: systemd{
-			Units:    n.systemdUnits,
-			Passwd:   map[string]string{},
-			Networkd: map[string]string{},
+			Units: n.systemdUnits,
 		},
+		Networkd: networkd{
+			Units: n.networkdUnits,
+		},
+		Passwd: n.passwd.getPasswd(n.ignitionVersion),
 	}
 }
 
-// newProject returns the systemd units created from config.
-func (conf projectConfig) getSystemdUnits() ([]systemdUnit, error) {
+// getSystemdUnits returns the systemd units created from config, rendered with data.
+func (conf projectConfig) getSystemdUnits(fsys fs.FS, data TemplateData) ([]systemdUnit, error) {
 	units := []systemdUnit{}
 	for _, unitFile := range conf.Units {
-		unit, err := newSystemdUnit(unitFile)
+		unit, err := newSystemdUnit(fsys, unitFile)
 		if err != nil {
 			return nil, err
 		}
 		units = append(units, *unit)
 	}
 	for _, d := range conf.Dropins {
-		dropin, err := d.Load()
+		dropin, err := d.Load(fsys)
 		if err != nil {
 			return nil, err
 		}
 		units = append(units, *dropin)
 	}
+	if err := data.renderUnits(units); err != nil {
+		return nil, err
+	}
 	return units, nil
 }
 
-// getChecksums returns the checksums for the project version.
-func (pv ProjectVersion) getChecksums() (checksums, error) {
-	checksumFile := fmt.Sprintf(
-		"checksums/%s_%s.sha512",
-		pv.Name,
-		pv.Version,
-	)
-	checksumData, err := ioutil.ReadFile(checksumFile)
+// getChecksums returns the checksums for the project version, read from checksums/ in fsys.
+func (pv ProjectVersion) getChecksums(fsys fs.FS) (checksums, error) {
+	checksumFile := pv.ChecksumFile()
+	checksumData, err := fs.ReadFile(fsys, checksumFile)
 	if err != nil {
 		return nil, fmt.Errorf("unable to read checksums for %q version %q: %v", pv.Name, pv.Version, err)
 	}
@@ -314,12 +431,12 @@ func (pv ProjectVersion) getChecksums() (checksums, error) {
 }
 
 // GetChecksumURL returns the URL to fetch the checksums for the project.
-func (pv ProjectVersion) GetChecksumURL() string {
-	return fmt.Sprintf(
-		"https://github.com/hkjn/%s/releases/download/%s/SHA512SUMS",
-		pv.Name,
-		pv.Version,
-	)
+func (pv ProjectVersion) GetChecksumURL(sources ArtifactSources, f *Fetcher) (string, error) {
+	return sources.getURL(artifact{
+		Project: pv.Name,
+		Version: pv.Version,
+		File:    releaseChecksumsFile,
+	}, f)
 }
 
 // Names returns the names of the project configs in sorted order.
@@ -405,11 +522,19 @@ func (s Secret) GetURL(secretServiceDomain, sshash string, pv ProjectVersion) st
 	)
 }
 
+// Get returns the config of the named node, if it exists.
+func (conf NodeConfigs) Get(name string) (NodeConfig, bool) {
+	nc, exists := conf[nodeName(name)]
+	return nc, exists
+}
+
 // String returns a human-readable description of the NodeConfig.
 func (nc NodeConfig) String() string {
 	return fmt.Sprintf(
-		"NodeConfig{Arch: %s}",
+		"NodeConfig{Arch: %s, IgnitionVersion: %s, Groups: %s}",
 		nc.Arch,
+		nc.IgnitionVersion,
+		strings.Join(nc.Groups, ", "),
 	)
 }
 
@@ -429,46 +554,87 @@ func (conf projectConfig) String() string {
 	}
 }
 
-// getBinaries returns the binaries for this project and version, given configs.
-func (pv ProjectVersion) getBinaries(conf ProjectConfigs, checksums checksums) ([]binary, error) {
+// getBinaries returns the binaries for this project and version on arch, given configs.
+func (pv ProjectVersion) getBinaries(conf ProjectConfigs, sources ArtifactSources, f *Fetcher, arch string, checksums checksums) ([]binary, error) {
 	pc, exists := conf[pv.Name]
 	if !exists {
 		return nil, fmt.Errorf("bug: no such project %q", pv.Name)
 	}
 	result := []binary{}
 	for _, file := range pc.Files {
-		key := file.ChecksumKey
-		if key == "" {
-			key = file.Name
+		name, key, err := file.resolve(pv, arch, checksums)
+		if err != nil {
+			return nil, err
+		}
+		url, err := sources.getURL(artifact{
+			Project: pv.Name,
+			Version: pv.Version,
+			File:    name,
+		}, f)
+		if err != nil {
+			return nil, err
 		}
+		result = append(result, binary{
+			url:      url,
+			checksum: checksums[key],
+			path:     file.Path,
+			mode:     file.Mode,
+			user:     file.User,
+			group:    file.Group,
+		})
+	}
+
+	return result, nil
+}
+
+// secretMode is the default mode of secrets on the node.
+const secretMode = 0600
+
+// getSecrets returns the secrets for this project and version, fetched
+// from the secret service with given hash.
+func (pv ProjectVersion) getSecrets(conf Config, sshash string, checksums checksums) ([]binary, error) {
+	secrets, err := conf.ProjectConfigs.GetSecrets(pv.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, nil
+	}
+	if sshash == "" || conf.SecretServiceDomain == "" {
+		return nil, fmt.Errorf("project %q has secrets, but no secret service hash or secretservice_domain was given", pv.Name)
+	}
+	result := []binary{}
+	for _, s := range secrets {
+		key := NodeFile(s).checksumKey()
 		checksum, exists := checksums[key]
 		if !exists {
-			return nil, fmt.Errorf("missing checksum for key %q; all checksums \"%v\"", key, checksums)
+			return nil, fmt.Errorf("missing checksum for secret %q in checksums/%s_%s.sha512", key, pv.Name, pv.Version)
+		}
+		mode := s.Mode
+		if mode == 0 {
+			mode = secretMode
 		}
 		result = append(result, binary{
-			url: fmt.Sprintf(
-				"https://github.com/hkjn/%s/releases/download/%s/%s",
-				pv.Name,
-				pv.Version,
-				file.Name,
-			),
+			url:      s.GetURL(conf.SecretServiceDomain, sshash, pv),
 			checksum: checksum,
-			path:     file.Path,
+			path:     s.Path,
+			mode:     mode,
+			user:     s.User,
+			group:    s.Group,
 		})
 	}
-
 	return result, nil
 }
 
-// getUnits returns the systemd units for the specific projects.
-func (conf ProjectConfigs) getSystemdUnits(pversions []ProjectVersion) ([]systemdUnit, error) {
+// getSystemdUnits returns the systemd units for the projects of the node.
+func (conf ProjectConfigs) getSystemdUnits(fsys fs.FS, name nodeName, nc NodeConfig) ([]systemdUnit, error) {
 	result := []systemdUnit{}
-	for _, pv := range pversions {
+	for _, pv := range nc.ProjectVersions {
 		pc, exists := conf[pv.Name]
 		if !exists {
 			return nil, fmt.Errorf("bug: no such project %q", pv.Name)
 		}
-		units, err := pc.getSystemdUnits()
+		units, err := pc.getSystemdUnits(fsys, newTemplateData(name, nc, pv, pc))
 		if err != nil {
 			return nil, err
 		}
@@ -486,33 +652,102 @@ func (conf Config) String() string {
 	)
 }
 
-// createNodes returns the nodes created from configs.
-func (nconf NodeConfig) createNode(name nodeName, pconf ProjectConfigs) (*node, error) {
+// createNode returns the node created from configs.
+func (g *Generator) createNode(name nodeName, conf Config) (*node, error) {
+	nconf := conf.NodeConfigs[name]
+	version, err := nconf.getIgnitionVersion()
+	if err != nil {
+		return nil, fmt.Errorf("node %q: %v", name, err)
+	}
+	output, err := nconf.getOutput()
+	if err != nil {
+		return nil, fmt.Errorf("node %q: %v", name, err)
+	}
+	if output == outputCloudInit {
+		if err := nconf.validateCloudInit(); err != nil {
+			return nil, fmt.Errorf("node %q: %v", name, err)
+		}
+	}
+	if err := nconf.validateServe(conf.Serve, output); err != nil {
+		return nil, fmt.Errorf("node %q: %v", name, err)
+	}
 	bins := []binary{}
+	secrets := []binary{}
 	for _, pv := range nconf.ProjectVersions {
-		newbins, err := pv.getBinaries(pconf, nconf.checksums[pv])
+		newbins, err := pv.getBinaries(conf.ProjectConfigs, conf.getArtifactSources(pv.Name), g.Fetcher, nconf.Arch, nconf.checksums[pv])
 		if err != nil {
 			return nil, err
 		}
 		bins = append(bins, newbins...)
+		newsecrets, err := pv.getSecrets(conf, g.SecretServiceHash, nconf.checksums[pv])
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, newsecrets...)
 	}
-	units, err := pconf.getSystemdUnits(nconf.ProjectVersions)
+	wireguardUnits, wireguardKey, err := g.getWireguard(conf, name)
+	if err != nil {
+		return nil, fmt.Errorf("node %q: %v", name, err)
+	}
+	if wireguardKey != nil {
+		secrets = append(secrets, *wireguardKey)
+	}
+	if output == outputIgnition && version == ignitionVersionV2 {
+		for _, f := range append(bins, secrets...) {
+			if (f.user != nil && f.user.Name != "") || (f.group != nil && f.group.Name != "") {
+				return nil, fmt.Errorf("node %q: file %q is owned by name, which needs Ignition 2.1.0 or later", name, f.path)
+			}
+		}
+		if len(nconf.Storage.Directories) > 0 || len(nconf.Storage.Links) > 0 {
+			return nil, fmt.Errorf("node %q: directories and links need Ignition 2.1.0 or later", name)
+		}
+	}
+	units, err := conf.ProjectConfigs.getSystemdUnits(g.fsys, name, nconf)
 	if err != nil {
 		return nil, err
 	}
-	return &node{
-		name:         name,
-		binaries:     bins,
-		systemdUnits: units,
-	}, nil
+	var updateFiles []file
+	if update := conf.getUpdate(nconf, version); update != nil && output == outputIgnition {
+		updateFiles, err = update.getFiles(version)
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %v", name, err)
+		}
+		units = append(units, update.getUnits(version)...)
+	}
+	units = append(units, nconf.Storage.getMountUnits()...)
+	networkdUnits, err := nconf.getNetworkdUnits(g.fsys, newTemplateData(name, nconf, ProjectVersion{}, projectConfig{}))
+	if err != nil {
+		return nil, fmt.Errorf("node %q: %v", name, err)
+	}
+	networkdUnits = append(networkdUnits, wireguardUnits...)
+	n := &node{
+		name:            name,
+		binaries:        bins,
+		secrets:         secrets,
+		systemdUnits:    units,
+		ignitionVersion: version,
+		passwd:          conf.Passwd.merge(nconf.Passwd),
+		networkdUnits:   networkdUnits,
+		storage:         nconf.Storage,
+		updateFiles:     updateFiles,
+		output:          output,
+		served:          nconf.served(),
+	}
+	for _, msg := range n.checkUnits(conf.UnitChecks) {
+		if conf.UnitChecks.Strict {
+			return nil, fmt.Errorf("node %q: %s", name, msg)
+		}
+		log.Printf("Warning: node %q: %s\n", name, msg)
+	}
+	return n, nil
 }
 
 // getNodes returns the nodes created from the config.
-func (conf Config) getNodes() (nodes, error) {
+func (g *Generator) getNodes(conf Config) (nodes, error) {
 	result := nodes{}
-	for name, nc := range conf.NodeConfigs {
+	for name := range conf.NodeConfigs {
 		log.Printf("Generating config for node %q..\n", name)
-		n, err := nc.createNode(name, conf.ProjectConfigs)
+		n, err := g.createNode(name, conf)
 		if err != nil {
 			return nil, err
 		}
@@ -522,36 +757,13 @@ func (conf Config) getNodes() (nodes, error) {
 	return result, nil
 }
 
-// checkClose closes specified closer and sets err to the result.
-func checkClose(c io.Closer, err *error) {
-	cerr := c.Close()
-	if *err == nil {
-		*err = cerr
-	}
-}
-
-// checksum returns the sha512 checksum of file at specified url.
-func (s Secret) checksum(url string) (string, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", err
-	}
-	defer checkClose(resp.Body, &err)
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code from GET %q, want 200 OK, got %s", url, resp.Status)
-	}
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	digest := sha512.Sum512(b)
-	return fmt.Sprintf("%x  %s\n", digest, s.Name), nil
-}
-
-// getSecretChecksums returns the checksums of secrets in given combination of node and project version.
-func (nc NodeConfig) getSecretChecksums(sshash, ssbasedomain string, pconfs ProjectConfigs) (Checksums, error) {
-	result := Checksums{}
-	fetched := map[string]bool{}
+// secretRequests returns the requests fetching the secrets of the node's
+// project versions, skipping those of fetched, along with the project
+// version and name of each secret.
+func (nc NodeConfig) secretRequests(sshash, ssbasedomain string, pconfs ProjectConfigs, fetched map[string]bool) ([]FetchRequest, []ProjectVersion, []string, error) {
+	reqs := []FetchRequest{}
+	pvs := []ProjectVersion{}
+	names := []string{}
 	for _, pv := range nc.ProjectVersions {
 		// TODO: Also need to handle secrets, like decenter.world.pem for "decenter.world"..
 		// fetch from secret service directly?
@@ -565,93 +777,49 @@ func (nc NodeConfig) getSecretChecksums(sshash, ssbasedomain string, pconfs Proj
 		}
 		secrets, err := pconfs.GetSecrets(pv.Name)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
 		for _, secret := range secrets {
 			url := secret.GetURL(ssbasedomain, sshash, pv)
 			if fetched[url] {
 				continue
 			}
-			log.Printf("Fetching and checksumming secret %q..\n", secret.Name)
-			line, err := secret.checksum(url)
-			if err != nil {
-				return nil, err
-			}
-			lines, exist := result[pv]
-			if !exist {
-				result[pv] = checksumlines([]string{line})
-			} else {
-				result[pv] = append(lines, line)
-			}
+			reqs = append(reqs, FetchRequest{URL: url})
+			pvs = append(pvs, pv)
+			names = append(names, secret.Name)
 			fetched[url] = true
 		}
 	}
-	return result, nil
+	return reqs, pvs, names, nil
 }
 
-// GetChecksums returns the checksums specified by the config.
-func (conf *Config) GetChecksums(sshash, ssbasedomain string) (Checksums, error) {
-	result := Checksums{}
-	// TODO: Should include non-secret checksums here too, or otherwise make sure that fetch_checksums.go will include those.
-	for node, nc := range conf.NodeConfigs {
-		log.Printf("Fetching checksums for node %q..\n", node)
-		newchecksums, err := nc.getSecretChecksums(sshash, ssbasedomain, conf.ProjectConfigs)
+// GetChecksums returns the checksums of the secrets of the project
+// versions the nodes run, fetched by f.
+func (conf *Config) GetChecksums(f *Fetcher, sshash string) (Checksums, error) {
+	reqs := []FetchRequest{}
+	pvs := []ProjectVersion{}
+	names := []string{}
+	fetched := map[string]bool{}
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		r, p, n, err := conf.NodeConfigs[nn].secretRequests(sshash, conf.SecretServiceDomain, conf.ProjectConfigs, fetched)
 		if err != nil {
 			return nil, err
 		}
-		for k, v := range newchecksums {
-			_, exists := result[k]
-			if !exists {
-				result[k] = v
-			}
-		}
-	}
-	return result, nil
-}
-
-// ReadConfig returns the node/project configs, read from disk.
-func ReadConfig() (*Config, error) {
-	conf := Config{}
-	f, err := os.Open("config.json")
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	if err := json.NewDecoder(f).Decode(&conf); err != nil {
-		return nil, err
-	}
-
-	for nn, nc := range conf.NodeConfigs {
-		nc := nc
-		nc.checksums = map[ProjectVersion]checksums{}
-		for _, pv := range nc.ProjectVersions {
-			checksums, err := pv.getChecksums()
-			if err != nil {
-				return nil, err
-			}
-			nc.checksums[pv] = checksums
+		reqs, pvs, names = append(reqs, r...), append(pvs, p...), append(names, n...)
+		if w := conf.NodeConfigs[nn].Wireguard; w != nil {
+			pv := MeshVersion(w.Mesh)
+			name := PrivateKeyName(string(nn))
+			reqs = append(reqs, FetchRequest{URL: Secret{Name: name}.GetURL(conf.SecretServiceDomain, sshash, pv)})
+			pvs, names = append(pvs, pv), append(names, name)
 		}
-		conf.NodeConfigs[nn] = nc
 	}
-	// TODO: Should probably include systemd units / files and secrets in *Config returned here..
-	return &conf, nil
-}
-
-// CreateNodes returns nodes created from the configs.
-func CreateNodes() (nodes, error) {
-	conf, err := ReadConfig()
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("Read config: %+v\n", conf)
-	for _, nc := range conf.NodeConfigs {
-		if len(nc.checksums) == 0 {
-			return nil, fmt.Errorf("bug: missing checksums")
+	log.Printf("Fetching and checksumming %d secrets..\n", len(reqs))
+	result := Checksums{}
+	for i, r := range f.FetchAll(reqs) {
+		if r.Err != nil {
+			return nil, fmt.Errorf("failed to fetch secret %q of %s %s: %v", names[i], pvs[i].Name, pvs[i].Version, r.Err)
 		}
-	}
-	result, err := conf.getNodes()
-	if err != nil {
-		log.Fatalf("Failed to get node: %v\n", err)
+		result[pvs[i]] = append(result[pvs[i]], checksumLine(names[i], r.Data))
 	}
 	return result, nil
 }
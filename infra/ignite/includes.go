@@ -0,0 +1,136 @@
+package ignite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// projectRef is a project version a node runs, with the path in
+// config.json that made it run it, e.g. "nodes.core.projects[1]" or
+// "project_configs.hkjninfra.includes[0]".
+type projectRef struct {
+	pv   ProjectVersion
+	path string
+}
+
+// newProjectRefs returns the project versions listed at path, e.g. "nodes.core".
+func newProjectRefs(path string, pvs []ProjectVersion) []projectRef {
+	result := []projectRef{}
+	for i, pv := range pvs {
+		result = append(result, projectRef{pv: pv, path: fmt.Sprintf("%s.projects[%d]", path, i)})
+	}
+	return result
+}
+
+// expand returns the project versions of a node, with those included by
+// each project before the project itself, depth first and without
+// duplicates.
+//
+// A project the node lists itself runs at that version wherever it's
+// included, so that single nodes can be moved to another version, as
+// rollouts do. Unknown projects are returned as they are, without
+// includes. An error is returned if the includes have a cycle, or a
+// project would run at more than one version.
+func (conf ProjectConfigs) expand(refs []projectRef) ([]projectRef, error) {
+	result := []projectRef{}
+	versions := map[ProjectName]Version{}
+	own := map[ProjectName]projectRef{}
+	for _, ref := range refs {
+		own[ref.pv.Name] = ref
+	}
+	var visit func(ref projectRef, stack []ProjectName) error
+	visit = func(ref projectRef, stack []ProjectName) error {
+		if pinned, exists := own[ref.pv.Name]; exists && pinned.pv.Version != ref.pv.Version {
+			ref = pinned
+		}
+		for i, name := range stack {
+			if name == ref.pv.Name {
+				cycle := []string{}
+				for _, n := range append(stack[i:], name) {
+					cycle = append(cycle, string(n))
+				}
+				return fmt.Errorf("include cycle %s", strings.Join(cycle, " -> "))
+			}
+		}
+		if v, seen := versions[ref.pv.Name]; seen {
+			if v != ref.pv.Version {
+				return fmt.Errorf("project %q would run at both version %q and %q", ref.pv.Name, v, ref.pv.Version)
+			}
+			return nil
+		}
+		stack = append(stack, ref.pv.Name)
+		for i, inc := range conf[ref.pv.Name].Includes {
+			incPath := fmt.Sprintf("%s.includes[%d]", jsonPath("project_configs", string(ref.pv.Name)), i)
+			if err := visit(projectRef{pv: inc, path: incPath}, stack); err != nil {
+				return err
+			}
+		}
+		versions[ref.pv.Name] = ref.pv.Version
+		result = append(result, ref)
+		return nil
+	}
+	for _, ref := range refs {
+		if err := visit(ref, nil); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// conflicts returns problems for the paths, units and dropins that more
+// than one of the projects deliver.
+func (conf ProjectConfigs) conflicts(refs []projectRef) Problems {
+	problems := Problems{}
+	paths := map[string]ProjectName{}
+	units := map[string]ProjectName{}
+	dropins := map[DropinName]ProjectName{}
+	for _, ref := range refs {
+		pc, exists := conf[ref.pv.Name]
+		if !exists {
+			continue
+		}
+		for _, f := range append(append(NodeFiles{}, pc.Files...), pc.Secrets...) {
+			if other, seen := paths[f.Path]; seen {
+				problems.add(ref.path, "path %q is also delivered by project %q", f.Path, other)
+				continue
+			}
+			paths[f.Path] = ref.pv.Name
+		}
+		for _, u := range pc.Units {
+			if other, seen := units[u]; seen {
+				problems.add(ref.path, "unit %q is also delivered by project %q", u, other)
+				continue
+			}
+			units[u] = ref.pv.Name
+		}
+		for _, d := range pc.Dropins {
+			if other, seen := dropins[d]; seen {
+				problems.add(ref.path, "dropin %q of %q is also delivered by project %q", d.Dropin, d.Unit, other)
+				continue
+			}
+			dropins[d] = ref.pv.Name
+		}
+	}
+	return problems
+}
+
+// expandProjects replaces the project versions of each node with those
+// it runs when including the projects' includes.
+func (conf *Config) expandProjects() error {
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		nc := conf.NodeConfigs[nn]
+		refs, err := conf.ProjectConfigs.expand(newProjectRefs(jsonPath("nodes", string(nn)), nc.ProjectVersions))
+		if err != nil {
+			return fmt.Errorf("node %q: %v", nn, err)
+		}
+		if problems := conf.ProjectConfigs.conflicts(refs); len(problems) > 0 {
+			return fmt.Errorf("node %q: %v", nn, problems[0])
+		}
+		nc.ProjectVersions = nil
+		for _, ref := range refs {
+			nc.ProjectVersions = append(nc.ProjectVersions, ref.pv)
+		}
+		conf.NodeConfigs[nn] = nc
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	conf := ProjectConfigs{
+		"base":      {Includes: []ProjectVersion{{"telemetry", "1.0"}}},
+		"telemetry": {},
+		"web":       {Includes: []ProjectVersion{{"base", "2.0"}, {"telemetry", "1.0"}}},
+		"loop":      {Includes: []ProjectVersion{{"loop2", "1"}}},
+		"loop2":     {Includes: []ProjectVersion{{"loop", "1"}}},
+		"old":       {Includes: []ProjectVersion{{"telemetry", "0.9"}}},
+	}
+	cases := []struct {
+		desc    string
+		pvs     []ProjectVersion
+		want    []projectRef
+		wantErr string
+	}{
+		{
+			desc: "includes first, without duplicates",
+			pvs:  []ProjectVersion{{"web", "3.0"}, {"base", "2.0"}},
+			want: []projectRef{
+				{ProjectVersion{"telemetry", "1.0"}, "project_configs.base.includes[0]"},
+				{ProjectVersion{"base", "2.0"}, "project_configs.web.includes[0]"},
+				{ProjectVersion{"web", "3.0"}, "nodes.core.projects[0]"},
+			},
+		},
+		{
+			desc: "own version replaces included one",
+			pvs:  []ProjectVersion{{"web", "3.0"}, {"telemetry", "1.1"}},
+			want: []projectRef{
+				{ProjectVersion{"telemetry", "1.1"}, "nodes.core.projects[1]"},
+				{ProjectVersion{"base", "2.0"}, "project_configs.web.includes[0]"},
+				{ProjectVersion{"web", "3.0"}, "nodes.core.projects[0]"},
+			},
+		},
+		{
+			desc:    "cycle",
+			pvs:     []ProjectVersion{{"loop", "1"}},
+			wantErr: "include cycle loop -> loop2 -> loop",
+		},
+		{
+			desc:    "two versions",
+			pvs:     []ProjectVersion{{"web", "3.0"}, {"old", "1"}},
+			wantErr: `project "telemetry" would run at both version "1.0" and "0.9"`,
+		},
+	}
+	for _, tt := range cases {
+		got, err := conf.expand(newProjectRefs("nodes.core", tt.pvs))
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: expand() returned error %v, want %q", tt.desc, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expand() returned error: %v", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expand() = %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// withBase returns the test config, with hkjninfra's unit moved to a
+// "base" project it includes.
+func withBase(conf string) string {
+	conf = strings.Replace(conf, `"units": ["tclient.service"],`, `"includes": [{"name": "base", "version": "1.0"}],`, 1)
+	return strings.Replace(conf, `"project_configs": {`, `"project_configs": {
+		"base": {
+			"vars": {"report_addr": "mon.example.com:50051"},
+			"units": ["tclient.service"]
+		},`, 1)
+}
+
+func TestGenerateIncludes(t *testing.T) {
+	fsys := newTestFS(withBase(testConfig))
+	fsys["checksums/base_1.0.sha512"] = fsys["checksums/bitcoin_0.0.15.sha512"]
+	g := NewGenerator(fsys, mapSink{})
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	core := outputs[1].V2
+	if len(core.Systemd.Units) != 3 || core.Systemd.Units[0].Name != "tclient.service" {
+		t.Errorf("Generate() for core got units %+v, want tclient.service from base first", core.Systemd.Units)
+	}
+}
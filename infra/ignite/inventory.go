@@ -0,0 +1,226 @@
+package ignite
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+type (
+	// Inventory is which nodes run which versions of each project, and
+	// which versions have checksums.
+	Inventory struct {
+		// Projects are the projects run by any node, in sorted order.
+		Projects []ProjectName `json:"projects"`
+		// Latest maps projects to the newest version with checksums.
+		Latest map[ProjectName]Version `json:"latest"`
+		// Nodes are the nodes, in sorted order.
+		Nodes []InventoryNode `json:"nodes"`
+		// Unused are the checksum files of versions no node runs, e.g.
+		// "checksums/hkjninfra_1.5.0.sha512".
+		Unused []string `json:"unused_checksums"`
+	}
+	// InventoryNode is the project versions a node runs.
+	InventoryNode struct {
+		// Node is the name of the node.
+		Node string `json:"node"`
+		// Versions maps the projects the node runs, including those of
+		// its groups and includes, to their versions.
+		Versions map[ProjectName]Version `json:"versions"`
+		// Behind are the projects the node runs at a version older than
+		// the latest one.
+		Behind []ProjectName `json:"behind,omitempty"`
+	}
+)
+
+// parseChecksumFile returns the project version of the checksum file
+// name, e.g. "decenter.world_1.1.8.sha512".
+func parseChecksumFile(name string) (ProjectVersion, bool) {
+	base := strings.TrimSuffix(name, ".sha512")
+	i := strings.LastIndex(base, "_")
+	if base == name || i <= 0 || i == len(base)-1 {
+		return ProjectVersion{}, false
+	}
+	return ProjectVersion{Name: ProjectName(base[:i]), Version: Version(base[i+1:])}, true
+}
+
+// compareVersions returns -1, 0 or 1 if a is older than, the same as or
+// newer than b, comparing dot-separated parts numerically when they're
+// numbers, so that "1.5.13" is newer than "1.5.5".
+func compareVersions(a, b Version) int {
+	as, bs := strings.Split(string(a), "."), strings.Split(string(b), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aerr != nil || berr != nil) && as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// Inventory returns which nodes of conf run which project versions,
+// compared to the versions with checksums in the generator's fs.FS.
+func (g *Generator) Inventory(conf Config) (*Inventory, error) {
+	files, err := fs.Glob(g.fsys, "checksums/*.sha512")
+	if err != nil {
+		return nil, err
+	}
+	result := &Inventory{Projects: []ProjectName{}, Latest: map[ProjectName]Version{}, Nodes: []InventoryNode{}, Unused: []string{}}
+	used := map[ProjectVersion]bool{}
+	projects := map[ProjectName]bool{}
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		n := InventoryNode{Node: string(nn), Versions: map[ProjectName]Version{}}
+		for _, pv := range conf.NodeConfigs[nn].ProjectVersions {
+			n.Versions[pv.Name] = pv.Version
+			used[pv] = true
+			projects[pv.Name] = true
+		}
+		if w := conf.NodeConfigs[nn].Wireguard; w != nil {
+			used[MeshVersion(w.Mesh)] = true
+		}
+		result.Nodes = append(result.Nodes, n)
+	}
+	for name := range projects {
+		result.Projects = append(result.Projects, name)
+	}
+	sort.Slice(result.Projects, func(i, j int) bool { return result.Projects[i] < result.Projects[j] })
+
+	for _, f := range files {
+		pv, ok := parseChecksumFile(path.Base(f))
+		if !ok {
+			continue
+		}
+		if pv.Name == wireguardProject {
+			// The keys of WireGuard meshes have no versions to compare.
+			if !used[pv] {
+				result.Unused = append(result.Unused, f)
+			}
+			continue
+		}
+		if latest, exists := result.Latest[pv.Name]; !exists || compareVersions(pv.Version, latest) > 0 {
+			result.Latest[pv.Name] = pv.Version
+		}
+		if !used[pv] {
+			result.Unused = append(result.Unused, f)
+		}
+	}
+	for i, n := range result.Nodes {
+		for _, name := range result.Projects {
+			v, runs := n.Versions[name]
+			if latest, exists := result.Latest[name]; runs && exists && compareVersions(v, latest) < 0 {
+				result.Nodes[i].Behind = append(result.Nodes[i].Behind, name)
+			}
+		}
+	}
+	return result, nil
+}
+
+// cell returns the description of the version of the project the node
+// runs, marked with "*" if it's behind the latest one.
+func (inv Inventory) cell(n InventoryNode, name ProjectName) string {
+	v, runs := n.Versions[name]
+	if !runs {
+		return "-"
+	}
+	for _, b := range n.Behind {
+		if b == name {
+			return fmt.Sprintf("%s*", v)
+		}
+	}
+	return string(v)
+}
+
+// rows returns the header and rows of the node × project version matrix.
+func (inv Inventory) rows() [][]string {
+	header := []string{"node"}
+	for _, name := range inv.Projects {
+		header = append(header, fmt.Sprintf("%s (%s)", name, inv.latest(name)))
+	}
+	result := [][]string{header}
+	for _, n := range inv.Nodes {
+		row := []string{n.Node}
+		for _, name := range inv.Projects {
+			row = append(row, inv.cell(n, name))
+		}
+		result = append(result, row)
+	}
+	return result
+}
+
+// latest returns the latest version of the project, or "?" if it has no checksums.
+func (inv Inventory) latest(name ProjectName) string {
+	if v, exists := inv.Latest[name]; exists {
+		return string(v)
+	}
+	return "?"
+}
+
+// behindNote explains the marks of versions behind the latest one.
+const behindNote = "Versions marked with * are behind the latest version in checksums/, shown with each project."
+
+// Table returns the inventory as a plain text table.
+func (inv Inventory) Table() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, row := range inv.rows() {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+	fmt.Fprintf(&b, "\n%s\n", behindNote)
+	if len(inv.Unused) > 0 {
+		fmt.Fprintf(&b, "\nChecksum files no node uses:\n")
+		for _, f := range inv.Unused {
+			fmt.Fprintf(&b, "  %s\n", f)
+		}
+	}
+	return b.String()
+}
+
+// Markdown returns the inventory as a Markdown table.
+func (inv Inventory) Markdown() string {
+	escape := strings.NewReplacer("*", "\\*", "_", "\\_", "|", "\\|")
+	line := func(cells []string) string {
+		escaped := []string{}
+		for _, c := range cells {
+			escaped = append(escaped, escape.Replace(c))
+		}
+		return "| " + strings.Join(escaped, " | ") + " |"
+	}
+	rows := inv.rows()
+	sep := []string{}
+	for range rows[0] {
+		sep = append(sep, "---")
+	}
+	lines := []string{line(rows[0]), "| " + strings.Join(sep, " | ") + " |"}
+	for _, row := range rows[1:] {
+		lines = append(lines, line(row))
+	}
+	lines = append(lines, "", escape.Replace(behindNote))
+	if len(inv.Unused) > 0 {
+		lines = append(lines, "", "Checksum files no node uses:", "")
+		for _, f := range inv.Unused {
+			lines = append(lines, fmt.Sprintf("- `%s`", f))
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
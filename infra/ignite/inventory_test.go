@@ -0,0 +1,67 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b Version
+		want int
+	}{
+		{"1.5.13", "1.5.5", 1},
+		{"1.5.5", "1.5.13", -1},
+		{"1.5.13", "1.5.13", 0},
+		{"1.5", "1.5.1", -1},
+		{"1.0.0-rc1", "1.0.0-rc2", -1},
+	}
+	for _, tt := range cases {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestInventory(t *testing.T) {
+	fsys := newTestFS(testConfig)
+	fsys["checksums/hkjninfra_1.5.5.sha512"] = &fstest.MapFile{}
+	fsys["checksums/hkjninfra_1.5.14.sha512"] = &fstest.MapFile{}
+	fsys["checksums/decenter.world_1.1.8.sha512"] = &fstest.MapFile{}
+	g := NewGenerator(fsys, mapSink{})
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		t.Fatalf("ReadConfigWithoutChecksums() returned error: %v", err)
+	}
+	inv, err := g.Inventory(*conf)
+	if err != nil {
+		t.Fatalf("Inventory() returned error: %v", err)
+	}
+	if want := []ProjectName{"bitcoin", "hkjninfra"}; !reflect.DeepEqual(inv.Projects, want) {
+		t.Errorf("Inventory() got projects %v, want %v", inv.Projects, want)
+	}
+	if want := (map[ProjectName]Version{"bitcoin": "0.0.15", "decenter.world": "1.1.8", "hkjninfra": "1.5.14"}); !reflect.DeepEqual(inv.Latest, want) {
+		t.Errorf("Inventory() got latest versions %v, want %v", inv.Latest, want)
+	}
+	if want := []string{"checksums/decenter.world_1.1.8.sha512", "checksums/hkjninfra_1.5.14.sha512", "checksums/hkjninfra_1.5.5.sha512"}; !reflect.DeepEqual(inv.Unused, want) {
+		t.Errorf("Inventory() got unused checksums %v, want %v", inv.Unused, want)
+	}
+	if len(inv.Nodes) != 2 || !reflect.DeepEqual(inv.Nodes[1].Behind, []ProjectName{"hkjninfra"}) {
+		t.Errorf("Inventory() got nodes %+v, want core behind on hkjninfra", inv.Nodes)
+	}
+
+	table := inv.Table()
+	for _, want := range []string{"node  bitcoin (0.0.15)  hkjninfra (1.5.14)", "arm   -                 1.5.13*", "core  0.0.15            1.5.13*", "  checksums/hkjninfra_1.5.5.sha512"} {
+		if !strings.Contains(table, want) {
+			t.Errorf("Table() got\n%s\nwant it to contain %q", table, want)
+		}
+	}
+	md := inv.Markdown()
+	for _, want := range []string{"| node | bitcoin (0.0.15) | hkjninfra (1.5.14) |\n| --- | --- | --- |\n| arm | - | 1.5.13\\* |", "- `checksums/hkjninfra_1.5.5.sha512`"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("Markdown() got\n%s\nwant it to contain %q", md, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ignite
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+type (
+	// NetworkdUnit is a systemd-networkd unit of a node, e.g. "10-static.network".
+	NetworkdUnit struct {
+		// Name is the name of the unit, ending in .network, .netdev or .link.
+		Name string `json:"name"`
+		// Contents are the contents of the unit, read from networkd/<name> if empty.
+		Contents string `json:"contents,omitempty"`
+	}
+	// networkdUnit is a networkd unit in the spec 2.x layout.
+	networkdUnit struct {
+		Name     string `json:"name"`
+		Contents string `json:"contents"`
+	}
+	networkd struct {
+		Units []networkdUnit `json:"units,omitempty"`
+	}
+)
+
+// networkdDir is where networkd units are written on nodes using Ignition
+// spec 3.x, which has no networkd section.
+const networkdDir = "/etc/systemd/network"
+
+// networkdSuffixes are the kinds of units systemd-networkd reads.
+var networkdSuffixes = []string{".network", ".netdev", ".link"}
+
+// load returns the contents of the unit, reading them from networkd/ in fsys if not inline.
+func (u NetworkdUnit) load(fsys fs.FS) (string, error) {
+	if u.Contents != "" {
+		return u.Contents, nil
+	}
+	b, err := fs.ReadFile(fsys, path.Join("networkd", u.Name))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// getNetworkdUnits returns the networkd units of the node, rendered with data.
+func (nc NodeConfig) getNetworkdUnits(fsys fs.FS, data TemplateData) ([]networkdUnit, error) {
+	result := []networkdUnit{}
+	for _, u := range nc.Networkd {
+		contents, err := u.load(fsys)
+		if err != nil {
+			return nil, err
+		}
+		contents, err = data.render(u.Name, contents)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, networkdUnit{Name: u.Name, Contents: contents})
+	}
+	return result, nil
+}
+
+// toFile returns the networkd unit as a file for spec 3.x configs.
+func (u networkdUnit) toFile() file {
+	return newDataFile(path.Join(networkdDir, u.Name), u.Contents)
+}
+
+// validateNetworkd checks the names and contents of the networkd units of the node at path.
+func (nc NodeConfig) validateNetworkd(fsys fs.FS, path string, data TemplateData, problems *Problems) {
+	names := map[string]bool{}
+	for i, u := range nc.Networkd {
+		upath := fmt.Sprintf("%s.networkd[%d]", path, i)
+		valid := false
+		for _, suffix := range networkdSuffixes {
+			if strings.HasSuffix(u.Name, suffix) {
+				valid = true
+			}
+		}
+		if !valid {
+			problems.add(upath+".name", "networkd unit %q doesn't end in %s", u.Name, strings.Join(networkdSuffixes, ", "))
+		}
+		if names[u.Name] {
+			problems.add(upath+".name", "networkd unit %q is declared more than once", u.Name)
+		}
+		names[u.Name] = true
+		contents, err := u.load(fsys)
+		if err != nil {
+			problems.add(upath, "missing networkd file networkd/%s", u.Name)
+			continue
+		}
+		if _, err := data.render(u.Name, contents); err != nil {
+			problems.add(upath, "%v", err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestGenerateNetworkd(t *testing.T) {
+	conf := strings.Replace(testConfig, `"arch": "armv7l",`, `"arch": "armv7l",
+			"networkd": [{"name": "wg0.netdev", "contents": "[NetDev]\nName=wg0\nKind=wireguard\n"}],`, 1)
+	conf = strings.Replace(conf, `"arch": "x86_64",`, `"arch": "x86_64",
+			"networkd": [{"name": "10-static.network"}],`, 1)
+	conf = strings.Replace(conf, `"vars": {"report_addr": "mon2.example.com:50051"}`, `"vars": {"report_addr": "mon2.example.com:50051", "address": "10.0.0.2/24"}`, 1)
+	fsys := newTestFS(conf)
+	fsys["networkd/10-static.network"] = &fstest.MapFile{Data: []byte("[Network]\nAddress={{.Vars.address}}\n")}
+
+	g := NewGenerator(fsys, mapSink{})
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+
+	core := outputs[1].V2
+	want := []networkdUnit{{Name: "10-static.network", Contents: "[Network]\nAddress=10.0.0.2/24\n"}}
+	if !reflect.DeepEqual(core.Networkd.Units, want) {
+		t.Errorf("Generate() for core got networkd units %+v, want %+v", core.Networkd.Units, want)
+	}
+
+	arm := outputs[0].V3
+	last := arm.Storage.Files[len(arm.Storage.Files)-1]
+	if wantPath := "/etc/systemd/network/wg0.netdev"; last.Path != wantPath || last.Mode != 0644 {
+		t.Errorf("Generate() for arm got last file %+v, want %s with mode 0644", last, wantPath)
+	}
+	if wantSource := "data:,%5BNetDev%5D%0AName%3Dwg0%0AKind%3Dwireguard%0A"; last.Contents.Source != wantSource {
+		t.Errorf("Generate() for arm got source %q, want %q", last.Contents.Source, wantSource)
+	}
+}
@@ -0,0 +1,220 @@
+package ignite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	// Passwd declares users and groups to create or configure on nodes.
+	Passwd struct {
+		Users  []User  `json:"users,omitempty"`
+		Groups []Group `json:"groups,omitempty"`
+	}
+	// User is a user on a node, e.g. "core" with its SSH keys.
+	User struct {
+		// Name is the name of the user.
+		Name string `json:"name"`
+		// PasswordHash is the hashed password of the user, as in /etc/shadow.
+		PasswordHash string `json:"password_hash,omitempty"`
+		// SSHAuthorizedKeys are the public keys that can log in as the user.
+		SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"`
+		// Groups are supplementary groups of the user, e.g. "docker".
+		Groups []string `json:"groups,omitempty"`
+		// UID is the user id, if the user is created.
+		UID *int `json:"uid,omitempty"`
+		// Shell is the login shell, if the user is created.
+		Shell string `json:"shell,omitempty"`
+	}
+	// Group is a group on a node.
+	Group struct {
+		// Name is the name of the group.
+		Name string `json:"name"`
+		// GID is the group id.
+		GID *int `json:"gid,omitempty"`
+	}
+
+	// passwdUserCreate is how spec 2.0.0 creates users.
+	passwdUserCreate struct {
+		UID    *int     `json:"uid,omitempty"`
+		Groups []string `json:"groups,omitempty"`
+		Shell  string   `json:"shell,omitempty"`
+	}
+	passwdUser struct {
+		Name              string            `json:"name"`
+		PasswordHash      string            `json:"passwordHash,omitempty"`
+		SSHAuthorizedKeys []string          `json:"sshAuthorizedKeys,omitempty"`
+		Create            *passwdUserCreate `json:"create,omitempty"`
+		// UID, Groups and Shell replace Create from spec 2.1.0.
+		UID    *int     `json:"uid,omitempty"`
+		Groups []string `json:"groups,omitempty"`
+		Shell  string   `json:"shell,omitempty"`
+	}
+	passwdGroup struct {
+		Name string `json:"name"`
+		GID  *int   `json:"gid,omitempty"`
+	}
+	// passwd is the passwd section of both spec 2.x and 3.x configs.
+	passwd struct {
+		Users  []passwdUser  `json:"users,omitempty"`
+		Groups []passwdGroup `json:"groups,omitempty"`
+	}
+)
+
+// union returns the strings in a followed by those in b that aren't in a.
+func union(a, b []string) []string {
+	result := append([]string{}, a...)
+	seen := map[string]bool{}
+	for _, s := range a {
+		seen[s] = true
+	}
+	for _, s := range b {
+		if !seen[s] {
+			result = append(result, s)
+			seen[s] = true
+		}
+	}
+	return result
+}
+
+// merge returns the users and groups of p, with those of override added.
+//
+// Users with the same name are merged, keeping the SSH keys and groups of
+// both and taking other fields from override if they are set.
+func (p Passwd) merge(override Passwd) Passwd {
+	result := Passwd{}
+	users := map[string]int{}
+	for _, u := range append(append([]User{}, p.Users...), override.Users...) {
+		i, exists := users[u.Name]
+		if !exists {
+			users[u.Name] = len(result.Users)
+			u.SSHAuthorizedKeys = union(nil, u.SSHAuthorizedKeys)
+			u.Groups = union(nil, u.Groups)
+			result.Users = append(result.Users, u)
+			continue
+		}
+		merged := &result.Users[i]
+		merged.SSHAuthorizedKeys = union(merged.SSHAuthorizedKeys, u.SSHAuthorizedKeys)
+		merged.Groups = union(merged.Groups, u.Groups)
+		if u.PasswordHash != "" {
+			merged.PasswordHash = u.PasswordHash
+		}
+		if u.UID != nil {
+			merged.UID = u.UID
+		}
+		if u.Shell != "" {
+			merged.Shell = u.Shell
+		}
+	}
+	groups := map[string]int{}
+	for _, g := range append(append([]Group{}, p.Groups...), override.Groups...) {
+		i, exists := groups[g.Name]
+		if !exists {
+			groups[g.Name] = len(result.Groups)
+			result.Groups = append(result.Groups, g)
+			continue
+		}
+		if g.GID != nil {
+			result.Groups[i].GID = g.GID
+		}
+	}
+	return result
+}
+
+// getPasswd returns the passwd section for the Ignition spec version.
+func (p Passwd) getPasswd(version string) passwd {
+	result := passwd{}
+	for _, u := range p.Users {
+		pu := passwdUser{
+			Name:              u.Name,
+			PasswordHash:      u.PasswordHash,
+			SSHAuthorizedKeys: u.SSHAuthorizedKeys,
+		}
+		if version == ignitionVersionV2 {
+			if u.UID != nil || len(u.Groups) > 0 || u.Shell != "" {
+				pu.Create = &passwdUserCreate{
+					UID:    u.UID,
+					Groups: u.Groups,
+					Shell:  u.Shell,
+				}
+			}
+		} else {
+			pu.UID = u.UID
+			pu.Groups = u.Groups
+			pu.Shell = u.Shell
+		}
+		result.Users = append(result.Users, pu)
+	}
+	for _, g := range p.Groups {
+		result.Groups = append(result.Groups, passwdGroup{Name: g.Name, GID: g.GID})
+	}
+	return result
+}
+
+// validate checks the users and groups of the passwd section at path.
+func (p Passwd) validate(path string, problems *Problems) {
+	users := map[string]bool{}
+	for i, u := range p.Users {
+		upath := fmt.Sprintf("%s.users[%d]", path, i)
+		if u.Name == "" {
+			problems.add(upath+".name", "user has no name")
+		} else if users[u.Name] {
+			problems.add(upath+".name", "user %q is declared more than once", u.Name)
+		}
+		users[u.Name] = true
+		for j, key := range u.SSHAuthorizedKeys {
+			if len(strings.Fields(key)) < 2 || !(strings.HasPrefix(key, "ssh-") || strings.HasPrefix(key, "ecdsa-") || strings.HasPrefix(key, "sk-")) {
+				problems.add(fmt.Sprintf("%s.ssh_authorized_keys[%d]", upath, j), "doesn't look like an SSH public key")
+			}
+		}
+	}
+	groups := map[string]bool{}
+	for i, g := range p.Groups {
+		gpath := fmt.Sprintf("%s.groups[%d]", path, i)
+		if g.Name == "" {
+			problems.add(gpath+".name", "group has no name")
+		} else if groups[g.Name] {
+			problems.add(gpath+".name", "group %q is declared more than once", g.Name)
+		}
+		groups[g.Name] = true
+	}
+}
+
+// describe returns a short description of the user, for diffs.
+func (u passwdUser) describe() string {
+	groups := append([]string{}, u.Groups...)
+	keys := append([]string{}, u.SSHAuthorizedKeys...)
+	uid := u.UID
+	if u.Create != nil {
+		groups = append(groups, u.Create.Groups...)
+		if u.Create.UID != nil {
+			uid = u.Create.UID
+		}
+	}
+	sort.Strings(groups)
+	sort.Strings(keys)
+	desc := fmt.Sprintf("groups=%s keys=%d", strings.Join(groups, ","), len(keys))
+	for _, k := range keys {
+		desc += fmt.Sprintf(" %s", sshKeyComment(k))
+	}
+	if uid != nil {
+		desc += fmt.Sprintf(" uid=%d", *uid)
+	}
+	if u.PasswordHash != "" {
+		desc += " password"
+	}
+	return desc
+}
+
+// sshKeyComment returns the comment of the SSH public key, or its type if it has none.
+func sshKeyComment(key string) string {
+	fields := strings.Fields(key)
+	if len(fields) > 2 {
+		return fields[2]
+	}
+	if len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
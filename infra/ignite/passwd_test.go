@@ -0,0 +1,70 @@
+package ignite
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPasswdMerge(t *testing.T) {
+	uid := 1001
+	defaults := Passwd{
+		Users: []User{
+			{Name: "core", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA1 admin"}, Groups: []string{"docker"}},
+		},
+		Groups: []Group{{Name: "builders"}},
+	}
+	node := Passwd{
+		Users: []User{
+			{Name: "core", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA1 admin", "ssh-ed25519 AAAA2 ci"}, Groups: []string{"builders"}, Shell: "/bin/bash"},
+			{Name: "builder", UID: &uid},
+		},
+	}
+	got := defaults.merge(node)
+	want := Passwd{
+		Users: []User{
+			{Name: "core", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA1 admin", "ssh-ed25519 AAAA2 ci"}, Groups: []string{"docker", "builders"}, Shell: "/bin/bash"},
+			{Name: "builder", SSHAuthorizedKeys: []string{}, Groups: []string{}, UID: &uid},
+		},
+		Groups: []Group{{Name: "builders"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merge() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGetPasswd(t *testing.T) {
+	uid := 1001
+	p := Passwd{
+		Users: []User{
+			{Name: "core", SSHAuthorizedKeys: []string{"ssh-ed25519 AAAA1 admin"}},
+			{Name: "builder", UID: &uid, Groups: []string{"docker"}},
+		},
+	}
+	cases := []struct {
+		version string
+		want    string
+	}{
+		{
+			version: "2.0.0",
+			want:    `{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA1 admin"]},{"name":"builder","create":{"uid":1001,"groups":["docker"]}}]}`,
+		},
+		{
+			version: "2.1.0",
+			want:    `{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA1 admin"]},{"name":"builder","uid":1001,"groups":["docker"]}]}`,
+		},
+		{
+			version: "3.0.0",
+			want:    `{"users":[{"name":"core","sshAuthorizedKeys":["ssh-ed25519 AAAA1 admin"]},{"name":"builder","uid":1001,"groups":["docker"]}]}`,
+		},
+	}
+	for _, tt := range cases {
+		b, err := json.Marshal(p.getPasswd(tt.version))
+		if err != nil {
+			t.Fatalf("getPasswd(%q) failed to marshal: %v", tt.version, err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("getPasswd(%q) = %s, want %s", tt.version, b, tt.want)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package ignite
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type (
+	// Rollout is a staged rollout of a project version across the nodes
+	// running the project, kept in RolloutFile between steps.
+	Rollout struct {
+		// Project is the project rolled out, e.g. "hkjninfra".
+		Project ProjectName `json:"project"`
+		// Version is the version rolled out, e.g. "1.5.13".
+		Version Version `json:"version"`
+		// Stages are the nodes to move to the version at each step, in order.
+		Stages []RolloutStage `json:"stages"`
+		// Done is the number of stages rolled out.
+		Done int `json:"done"`
+		// Paused is true if the rollout shouldn't advance until resumed.
+		Paused bool `json:"paused,omitempty"`
+		// RolledBack is true if the rollout was undone.
+		RolledBack bool `json:"rolled_back,omitempty"`
+		// Previous maps the nodes of the stages done to the version they
+		// listed themselves before, or "" if they got the project from a group.
+		Previous map[string]Version `json:"previous,omitempty"`
+	}
+	// RolloutStage is a set of nodes moved to the new version together.
+	RolloutStage struct {
+		// Name describes the stage, e.g. "canary" or "wave 2 (50%)".
+		Name string `json:"name"`
+		// Nodes are the names of the nodes of the stage.
+		Nodes []string `json:"nodes"`
+	}
+)
+
+// RolloutFile is where the state of the current rollout is kept.
+const RolloutFile = "rollout.json"
+
+// matches returns true if the node is selected by selector, which is
+// either "key=value" for a label or the name of a node group.
+func (nc NodeConfig) matches(selector string) bool {
+	if i := strings.Index(selector, "="); i >= 0 {
+		v, exists := nc.Labels[selector[:i]]
+		return exists && v == selector[i+1:]
+	}
+	for _, g := range nc.Groups {
+		if g == selector {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanRollout returns a rollout of the version of the project to the
+// nodes running another version of it, from their groups or includes or
+// by themselves, first to the nodes matching canary, if set, and then to
+// the rest in waves, each reaching the percentage of them given in waves.
+func (conf Config) PlanRollout(project ProjectName, version Version, canary string, waves []int) (*Rollout, error) {
+	if _, exists := conf.ProjectConfigs[project]; !exists {
+		return nil, fmt.Errorf("unknown project %q", project)
+	}
+	canaries, rest := []string{}, []string{}
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		refs, err := conf.ProjectConfigs.expand(conf.projectRefs(nn))
+		if err != nil {
+			return nil, fmt.Errorf("node %q: %v", nn, err)
+		}
+		for _, ref := range refs {
+			if ref.pv.Name != project || ref.pv.Version == version {
+				continue
+			}
+			nc, _ := conf.effective(nn)
+			if canary != "" && nc.matches(canary) {
+				canaries = append(canaries, string(nn))
+			} else {
+				rest = append(rest, string(nn))
+			}
+		}
+	}
+	if len(canaries)+len(rest) == 0 {
+		return nil, fmt.Errorf("no nodes run %q at another version than %q", project, version)
+	}
+	result := &Rollout{Project: project, Version: version}
+	if canary != "" {
+		if len(canaries) == 0 {
+			return nil, fmt.Errorf("no nodes running %q match canary %q", project, canary)
+		}
+		result.Stages = append(result.Stages, RolloutStage{Name: "canary", Nodes: canaries})
+	}
+	if len(waves) == 0 || waves[len(waves)-1] != 100 {
+		waves = append(waves, 100)
+	}
+	done, last := 0, 0
+	for i, pct := range waves {
+		if pct <= last || pct > 100 {
+			return nil, fmt.Errorf("waves must be increasing percentages up to 100, got %v", waves)
+		}
+		last = pct
+		// Waves round up, so that every wave has nodes.
+		n := (len(rest)*pct + 99) / 100
+		if n > done {
+			result.Stages = append(result.Stages, RolloutStage{
+				Name:  fmt.Sprintf("wave %d (%d%%)", i+1, pct),
+				Nodes: rest[done:n],
+			})
+			done = n
+		}
+	}
+	return result, nil
+}
+
+// Complete returns true if all stages are rolled out.
+func (r Rollout) Complete() bool {
+	return r.Done == len(r.Stages)
+}
+
+// String returns a human-readable description of the rollout.
+func (r Rollout) String() string {
+	state := "in progress"
+	switch {
+	case r.RolledBack:
+		state = "rolled back"
+	case r.Complete():
+		state = "complete"
+	case r.Paused:
+		state = "paused"
+	}
+	lines := []string{fmt.Sprintf("%s %s: %s, %d of %d stages done", r.Project, r.Version, state, r.Done, len(r.Stages))}
+	for i, s := range r.Stages {
+		mark := " "
+		if i < r.Done && !r.RolledBack {
+			mark = "x"
+		}
+		lines = append(lines, fmt.Sprintf("  [%s] %s: %s", mark, s.Name, strings.Join(s.Nodes, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Advance rolls out the next stage, returning config.json with the
+// version set for its nodes, and the names of the nodes.
+func (r *Rollout) Advance(raw []byte) ([]byte, []string, error) {
+	switch {
+	case r.RolledBack:
+		return nil, nil, errors.New("rollout was rolled back")
+	case r.Paused:
+		return nil, nil, errors.New("rollout is paused")
+	case r.Complete():
+		return nil, nil, errors.New("rollout is already complete")
+	}
+	stage := r.Stages[r.Done]
+	versions := map[string]Version{}
+	for _, name := range stage.Nodes {
+		versions[name] = r.Version
+	}
+	result, previous, err := setProjectVersions(raw, r.Project, versions)
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.Previous == nil {
+		r.Previous = map[string]Version{}
+	}
+	for name, v := range previous {
+		r.Previous[name] = v
+	}
+	r.Done += 1
+	return result, stage.Nodes, nil
+}
+
+// Rollback undoes the stages rolled out, returning config.json with the
+// previous versions restored, and the names of the nodes.
+func (r *Rollout) Rollback(raw []byte) ([]byte, []string, error) {
+	if r.RolledBack {
+		return nil, nil, errors.New("rollout was already rolled back")
+	}
+	nodes := []string{}
+	for _, s := range r.Stages[:r.Done] {
+		nodes = append(nodes, s.Nodes...)
+	}
+	sort.Strings(nodes)
+	versions := map[string]Version{}
+	for _, name := range nodes {
+		versions[name] = r.Previous[name]
+	}
+	result, _, err := setProjectVersions(raw, r.Project, versions)
+	if err != nil {
+		return nil, nil, err
+	}
+	r.RolledBack = true
+	return result, nodes, nil
+}
+
+// findValue returns the start and end offsets in raw of the value at the
+// path of object keys, or -1 if the last key isn't in its object.
+func findValue(raw []byte, keys ...string) (int, int, error) {
+	start, end := 0, len(raw)
+	for _, key := range keys {
+		d := json.NewDecoder(bytes.NewReader(raw[start:end]))
+		if t, err := d.Token(); err != nil || t != json.Delim('{') {
+			return 0, 0, fmt.Errorf("value before %q isn't an object", key)
+		}
+		found := false
+		for d.More() {
+			t, err := d.Token()
+			if err != nil {
+				return 0, 0, err
+			}
+			v := json.RawMessage{}
+			if err := d.Decode(&v); err != nil {
+				return 0, 0, err
+			}
+			if t == key {
+				end = start + int(d.InputOffset())
+				start = end - len(v)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return -1, -1, nil
+		}
+	}
+	return start, end, nil
+}
+
+// indentAt returns the indentation of the line containing offset i of raw.
+func indentAt(raw []byte, i int) string {
+	lineStart := bytes.LastIndexByte(raw[:i], '\n') + 1
+	line := raw[lineStart:i]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// setProjectVersions returns config.json with the nodes' own entries for
+// the project set to the given versions, or removed for "", along with
+// the versions they had before.
+//
+// Only the projects of the nodes are rewritten, keeping the rest of the
+// file as it was.
+func setProjectVersions(raw []byte, project ProjectName, versions map[string]Version) ([]byte, map[string]Version, error) {
+	names := []string{}
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	previous := map[string]Version{}
+	for _, name := range names {
+		version := versions[name]
+		nstart, nend, err := findValue(raw, "nodes", name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find node %q in config.json: %v", name, err)
+		}
+		if nstart < 0 {
+			return nil, nil, fmt.Errorf("no node %q in config.json", name)
+		}
+		start, end, err := findValue(raw, "nodes", name, "projects")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find projects of node %q in config.json: %v", name, err)
+		}
+		projects := []map[string]interface{}{}
+		if start >= 0 {
+			d := json.NewDecoder(bytes.NewReader(raw[start:end]))
+			d.UseNumber()
+			if err := d.Decode(&projects); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode projects of node %q: %v", name, err)
+			}
+		}
+		result := []map[string]interface{}{}
+		found := false
+		for _, pv := range projects {
+			if pv["name"] != string(project) {
+				result = append(result, pv)
+				continue
+			}
+			found = true
+			v, _ := pv["version"].(string)
+			previous[name] = Version(v)
+			if version != "" {
+				pv["version"] = string(version)
+				result = append(result, pv)
+			}
+		}
+		if !found {
+			previous[name] = ""
+			if version != "" {
+				result = append(result, map[string]interface{}{"name": string(project), "version": string(version)})
+			}
+		}
+
+		var b bytes.Buffer
+		e := json.NewEncoder(&b)
+		e.SetEscapeHTML(false)
+		if start >= 0 {
+			e.SetIndent(indentAt(raw, start), "\t")
+			if err := e.Encode(result); err != nil {
+				return nil, nil, err
+			}
+			raw = append(append(append([]byte{}, raw[:start]...), bytes.TrimSpace(b.Bytes())...), raw[end:]...)
+			continue
+		}
+		// The node has no projects of its own, so they're added last.
+		indent := indentAt(raw, nend-1) + "\t"
+		e.SetIndent(indent, "\t")
+		if err := e.Encode(result); err != nil {
+			return nil, nil, err
+		}
+		closing := nend - 1
+		body := bytes.TrimRight(raw[:closing], " \t\n")
+		sep := ","
+		if body[len(body)-1] == '{' {
+			sep = ""
+		}
+		entry := fmt.Sprintf("%s\n%s\"projects\": %s\n%s", sep, indent, bytes.TrimSpace(b.Bytes()), indentAt(raw, closing))
+		raw = append(append(append([]byte{}, body...), entry...), raw[closing:]...)
+	}
+	return raw, previous, nil
+}
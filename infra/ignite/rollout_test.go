@@ -0,0 +1,236 @@
+package ignite
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// rolloutConfig is a config.json with nodes running hkjninfra directly
+// and through a group.
+const rolloutConfig = `{
+	"future_field": {"x": 1.50},
+	"project_configs": {"hkjninfra": {}},
+	"node_groups": {
+		"infra": {"projects": [{"name": "hkjninfra", "version": "1.5.12"}]}
+	},
+	"nodes": {
+		"a": {"labels": {"stage": "canary"}, "projects": [{"name": "hkjninfra", "version": "1.5.12"}]},
+		"b": {"groups": ["infra"]},
+		"c": {"projects": [{"name": "hkjninfra", "version": "1.5.12"}, {"name": "bitcoin", "version": "0.0.15"}]},
+		"d": {"projects": [{"name": "hkjninfra", "version": "1.5.13"}]},
+		"e": {"projects": [{"name": "hkjninfra", "version": "1.5.11"}]},
+		"f": {"projects": [{"name": "bitcoin", "version": "0.0.15"}]}
+	}
+}`
+
+func TestPlanRollout(t *testing.T) {
+	conf := Config{}
+	if err := json.Unmarshal([]byte(rolloutConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	got, err := conf.PlanRollout("hkjninfra", "1.5.13", "stage=canary", []int{50})
+	if err != nil {
+		t.Fatalf("PlanRollout() returned error: %v", err)
+	}
+	want := []RolloutStage{
+		{Name: "canary", Nodes: []string{"a"}},
+		{Name: "wave 1 (50%)", Nodes: []string{"b", "c"}},
+		{Name: "wave 2 (100%)", Nodes: []string{"e"}},
+	}
+	if !reflect.DeepEqual(got.Stages, want) {
+		t.Errorf("PlanRollout() got stages %+v, want %+v", got.Stages, want)
+	}
+
+	if _, err := conf.PlanRollout("hkjninfra", "1.5.13", "nope", nil); err == nil || !strings.Contains(err.Error(), "match canary") {
+		t.Errorf("PlanRollout() with unknown canary returned error %v", err)
+	}
+	if _, err := conf.PlanRollout("hkjninfra", "1.5.13", "", []int{50, 20}); err == nil || !strings.Contains(err.Error(), "increasing") {
+		t.Errorf("PlanRollout() with decreasing waves returned error %v", err)
+	}
+	got, err = conf.PlanRollout("hkjninfra", "1.5.13", "infra", nil)
+	if err != nil {
+		t.Fatalf("PlanRollout() returned error: %v", err)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(got.Stages[0].Nodes, want) {
+		t.Errorf("PlanRollout() with group canary got %v, want %v", got.Stages[0].Nodes, want)
+	}
+}
+
+// nodeVersions returns the versions of hkjninfra the nodes of the raw config run.
+func nodeVersions(t *testing.T, raw []byte) map[string]Version {
+	conf := Config{}
+	if err := json.Unmarshal(raw, &conf); err != nil {
+		t.Fatalf("bad config.json: %v\n%s", err, raw)
+	}
+	result := map[string]Version{}
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		nc, _ := conf.effective(nn)
+		for _, pv := range nc.ProjectVersions {
+			if pv.Name == "hkjninfra" {
+				result[string(nn)] = pv.Version
+			}
+		}
+	}
+	return result
+}
+
+func TestRolloutAdvanceRollback(t *testing.T) {
+	conf := Config{}
+	if err := json.Unmarshal([]byte(rolloutConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := conf.PlanRollout("hkjninfra", "1.5.13", "stage=canary", []int{50})
+	if err != nil {
+		t.Fatalf("PlanRollout() returned error: %v", err)
+	}
+	raw, nodes, err := r.Advance([]byte(rolloutConfig))
+	if err != nil {
+		t.Fatalf("Advance() returned error: %v", err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Advance() got nodes %v, want %v", nodes, want)
+	}
+	r.Paused = true
+	if _, _, err := r.Advance(raw); err == nil {
+		t.Errorf("Advance() of paused rollout succeeded")
+	}
+	r.Paused = false
+	raw, nodes, err = r.Advance(raw)
+	if err != nil {
+		t.Fatalf("Advance() returned error: %v", err)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Advance() got nodes %v, want %v", nodes, want)
+	}
+	want := map[string]Version{"a": "1.5.13", "b": "1.5.13", "c": "1.5.13", "d": "1.5.13", "e": "1.5.11"}
+	if got := nodeVersions(t, raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("Advance() got versions %v, want %v", got, want)
+	}
+	if !strings.Contains(string(raw), `"x": 1.50`) {
+		t.Errorf("Advance() lost unknown fields:\n%s", raw)
+	}
+
+	raw, nodes, err = r.Rollback(raw)
+	if err != nil {
+		t.Fatalf("Rollback() returned error: %v", err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Rollback() got nodes %v, want %v", nodes, want)
+	}
+	want = map[string]Version{"a": "1.5.12", "b": "1.5.12", "c": "1.5.12", "d": "1.5.13", "e": "1.5.11"}
+	if got := nodeVersions(t, raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("Rollback() got versions %v, want %v", got, want)
+	}
+	after := Config{}
+	if err := json.Unmarshal(raw, &after); err != nil {
+		t.Fatal(err)
+	}
+	if pvs := after.NodeConfigs["b"].ProjectVersions; len(pvs) > 0 {
+		t.Errorf("Rollback() kept projects %v of b, want none", pvs)
+	}
+	if _, _, err := r.Advance(raw); err == nil {
+		t.Errorf("Advance() of rolled back rollout succeeded")
+	}
+}
+
+func TestRolloutIncludes(t *testing.T) {
+	raw := []byte(`{
+	"project_configs": {
+		"hkjninfra": {},
+		"site": {"includes": [{"name": "hkjninfra", "version": "1.5.12"}]}
+	},
+	"nodes": {
+		"a": {"projects": [{"name": "hkjninfra", "version": "1.5.12"}]},
+		"g": {"projects": [{"name": "site", "version": "1.0"}]}
+	}
+}`)
+	conf := Config{}
+	if err := json.Unmarshal(raw, &conf); err != nil {
+		t.Fatal(err)
+	}
+	r, err := conf.PlanRollout("hkjninfra", "1.5.13", "", nil)
+	if err != nil {
+		t.Fatalf("PlanRollout() returned error: %v", err)
+	}
+	if want := []string{"a", "g"}; len(r.Stages) != 1 || !reflect.DeepEqual(r.Stages[0].Nodes, want) {
+		t.Fatalf("PlanRollout() got stages %+v, want a and g, which includes hkjninfra from site", r.Stages)
+	}
+	// versions returns the version of hkjninfra g runs in the raw config.
+	versions := func(raw []byte) Version {
+		conf := Config{}
+		if err := json.Unmarshal(raw, &conf); err != nil {
+			t.Fatal(err)
+		}
+		refs, err := conf.ProjectConfigs.expand(conf.projectRefs("g"))
+		if err != nil {
+			t.Fatalf("expand() returned error: %v", err)
+		}
+		for _, ref := range refs {
+			if ref.pv.Name == "hkjninfra" {
+				return ref.pv.Version
+			}
+		}
+		return ""
+	}
+	raw, _, err = r.Advance(raw)
+	if err != nil {
+		t.Fatalf("Advance() returned error: %v", err)
+	}
+	if got := versions(raw); got != "1.5.13" {
+		t.Errorf("Advance() moved g to hkjninfra %q, want 1.5.13", got)
+	}
+	raw, _, err = r.Rollback(raw)
+	if err != nil {
+		t.Fatalf("Rollback() returned error: %v", err)
+	}
+	if got := versions(raw); got != "1.5.12" {
+		t.Errorf("Rollback() moved g to hkjninfra %q, want 1.5.12 from site", got)
+	}
+}
+
+func TestGenerateNodes(t *testing.T) {
+	fsys := newTestFS(testConfig)
+	fsys["nodes.auto.tfvars.json"] = &fstest.MapFile{Data: []byte(`{"nodes": {
+		"arm": {"arch": "armv7l", "output": "ignition", "user_data": "old"},
+		"gone": {"arch": "x86_64", "output": "ignition", "user_data": "old"}
+	}}`)}
+	out, tfOut := mapSink{}, mapSink{}
+	g := NewGenerator(fsys, out)
+	g.SecretServiceHash = "123abc"
+	g.TerraformOut = tfOut
+	if _, err := g.Generate("core"); err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	if _, exists := out["arm.json"]; exists || out["core.json"] == nil {
+		t.Errorf("Generate(core) wrote %v, want only core.json", out)
+	}
+	vars := terraformVars{}
+	if err := json.Unmarshal(tfOut["nodes.auto.tfvars.json"], &vars); err != nil {
+		t.Fatal(err)
+	}
+	if len(vars.Nodes) != 2 || vars.Nodes["arm"].UserData != "old" || vars.Nodes["core"].UserData != string(out["core.json"]) {
+		t.Errorf("Generate(core) wrote variables %+v, want old arm and new core", vars.Nodes)
+	}
+	if _, err := g.Generate("nope"); err == nil || !strings.Contains(err.Error(), `no node "nope"`) {
+		t.Errorf("Generate(nope) returned error %v, want no node", err)
+	}
+}
+
+func TestSetProjectVersions(t *testing.T) {
+	raw := "{\n\t\"nodes\": {\n\t\t\"b\": {\n\t\t\t\"groups\": [\"infra\"]\n\t\t},\n\t\t\"c\": {}\n\t}\n}\n"
+	got, previous, err := setProjectVersions([]byte(raw), "hkjninfra", map[string]Version{"b": "1.5.13", "c": "1.5.13"})
+	if err != nil {
+		t.Fatalf("setProjectVersions() returned error: %v", err)
+	}
+	want := "{\n\t\"nodes\": {\n\t\t\"b\": {\n\t\t\t\"groups\": [\"infra\"],\n\t\t\t\"projects\": [\n\t\t\t\t{\n\t\t\t\t\t\"name\": \"hkjninfra\",\n\t\t\t\t\t\"version\": \"1.5.13\"\n\t\t\t\t}\n\t\t\t]\n\t\t},\n" +
+		"\t\t\"c\": {\n\t\t\t\"projects\": [\n\t\t\t\t{\n\t\t\t\t\t\"name\": \"hkjninfra\",\n\t\t\t\t\t\"version\": \"1.5.13\"\n\t\t\t\t}\n\t\t\t]\n\t\t}\n\t}\n}\n"
+	if string(got) != want {
+		t.Errorf("setProjectVersions() got\n%s\nwant\n%s", got, want)
+	}
+	if want := map[string]Version{"b": "", "c": ""}; !reflect.DeepEqual(previous, want) {
+		t.Errorf("setProjectVersions() got previous versions %v, want %v", previous, want)
+	}
+}
@@ -0,0 +1,173 @@
+package ignite
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	// ServeConfig is where the config server serves the configs of nodes
+	// with serve set.
+	ServeConfig struct {
+		// URL is the base URL of the config server, e.g. "https://ignite.hkjn.me".
+		URL string `json:"url"`
+	}
+	// Server serves the configs of served nodes, as written to ServedOut,
+	// to nodes presenting their token or a client cert naming them.
+	Server struct {
+		fsys fs.FS
+		key  []byte
+	}
+)
+
+// ServedDir is the directory next to the generated configs where those
+// of served nodes are written, e.g. "bootstrap/served".
+const ServedDir = "served"
+
+// DefaultTokenKeyPath is where the key node tokens are derived from is
+// usually kept.
+const DefaultTokenKeyPath = "/etc/secrets/ignite/token_key"
+
+// NodeToken returns the token the named node uses to fetch its config.
+func NodeToken(key []byte, name string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validate checks that the config server URL is usable by Ignition.
+func (sc ServeConfig) validate() error {
+	u, err := url.Parse(sc.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url %q must be https, since it includes the tokens of nodes", sc.URL)
+	}
+	return nil
+}
+
+// served returns true if the node is served.
+func (nc NodeConfig) served() bool {
+	return nc.Serve != nil && *nc.Serve
+}
+
+// validateServe checks that the node can be served.
+func (nc NodeConfig) validateServe(sc *ServeConfig, output string) error {
+	if !nc.served() {
+		return nil
+	}
+	if sc == nil {
+		return errors.New("node is served, but there's no serve url in config.json")
+	}
+	if output != outputIgnition {
+		return fmt.Errorf("only nodes with output %q can be served", outputIgnition)
+	}
+	return nil
+}
+
+// nodeURL returns the URL the named node fetches its config from.
+func (sc ServeConfig) nodeURL(name string, key []byte) string {
+	return fmt.Sprintf("%s/nodes/%s?token=%s", strings.TrimSuffix(sc.URL, "/"), url.PathEscape(name), NodeToken(key, name))
+}
+
+// stub returns a config replacing itself with the one at url.
+//
+// The stub doesn't pin the hash of the config, which would break nodes
+// provisioned with it on the next change to their config. The config is
+// trusted since it's fetched over HTTPS, with the node's token.
+func (o Output) stub(url string) Output {
+	result := Output{Name: o.Name}
+	if o.V3 != nil {
+		result.V3 = &IgnitionConfigV3{
+			Ignition: ignitionV3{
+				Version: o.V3.Ignition.Version,
+				Config: &ignitionConfigV3{
+					Replace: &resourceV3{Source: url},
+				},
+			},
+		}
+		return result
+	}
+	result.V2 = &IgnitionConfig{
+		Ignition: ignition{
+			Version: o.V2.Ignition.Version,
+			Config: ignitionConfig{
+				Replace: &fileContents{Source: url},
+			},
+		},
+		Storage: storage{Files: []file{}},
+		Systemd: systemd{Units: []systemdUnit{}},
+	}
+	return result
+}
+
+// writeServed writes the config data of the served node to ServedOut,
+// returning the stub fetching it.
+func (g *Generator) writeServed(conf Config, o Output, data []byte) ([]byte, error) {
+	if g.ServedOut == nil {
+		return nil, fmt.Errorf("node %q is served, but there's nowhere to write served configs", o.Name)
+	}
+	if len(g.TokenKey) == 0 {
+		return nil, fmt.Errorf("node %q is served, but no token key was given", o.Name)
+	}
+	log.Printf("Writing served %s..\n", o.FileName())
+	if err := g.ServedOut.Write(o.FileName(), data); err != nil {
+		return nil, fmt.Errorf("failed to write served config for %q: %v", o.Name, err)
+	}
+	return o.stub(conf.Serve.nodeURL(o.Name, g.TokenKey)).Marshal()
+}
+
+// NewServer returns a server of the configs in fsys, authenticating
+// nodes with tokens derived from key.
+func NewServer(fsys fs.FS, key []byte) *Server {
+	return &Server{fsys: fsys, key: key}
+}
+
+// authorized returns true if the request is from the named node, by
+// its token or a verified client cert with the node as common name.
+func (s *Server) authorized(r *http.Request, name string) bool {
+	if token := r.URL.Query().Get("token"); token != "" && len(s.key) > 0 {
+		if hmac.Equal([]byte(token), []byte(NodeToken(s.key, name))) {
+			return true
+		}
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName == name
+	}
+	return false
+}
+
+// ServeHTTP serves the config of the node named by /nodes/<name>.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/nodes/")
+	if name == r.URL.Path || name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(r, name) {
+		log.Printf("Denied config of %q to %s.\n", name, r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	b, err := fs.ReadFile(s.fsys, name+".json")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	log.Printf("Serving config of %q to %s.\n", name, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
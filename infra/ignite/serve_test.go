@@ -0,0 +1,88 @@
+package ignite
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestGenerateServed(t *testing.T) {
+	conf := strings.Replace(testConfig, `"nodes": {`, `"serve": {"url": "https://ignite.example.com/"},
+	"nodes": {`, 1)
+	conf = strings.Replace(conf, `"arch": "x86_64",`, `"arch": "x86_64",
+			"serve": true,`, 1)
+	out, served := mapSink{}, mapSink{}
+	g := NewGenerator(newTestFS(conf), out)
+	g.SecretServiceHash = "123abc"
+	g.ServedOut = served
+	if _, err := g.Generate(); err == nil || !strings.Contains(err.Error(), "no token key") {
+		t.Errorf("Generate() returned error %v, want no token key", err)
+	}
+
+	g.TokenKey = []byte("secret")
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	full, err := outputs[1].Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() returned error: %v", err)
+	}
+	if string(served["core.json"]) != string(full) {
+		t.Errorf("Generate() served %s, want %s", served["core.json"], full)
+	}
+	if _, exists := served["arm.json"]; exists {
+		t.Errorf("Generate() served config of arm, which isn't served")
+	}
+	want := fmt.Sprintf(
+		`{"ignition":{"version":"2.0.0","config":{"replace":{"source":"https://ignite.example.com/nodes/core?token=%s","verification":{}}}},"storage":{"files":[]},"systemd":{"units":[]},"networkd":{},"passwd":{}}`+"\n",
+		NodeToken([]byte("secret"), "core"),
+	)
+	if got := string(out["core.json"]); got != want {
+		t.Errorf("Generate() wrote stub\n%s\nwant\n%s", got, want)
+	}
+
+	fsys := newTestFS(conf)
+	fsys["bootstrap/core.json"] = &fstest.MapFile{Data: out["core.json"]}
+	fsys["bootstrap/served/core.json"] = &fstest.MapFile{Data: served["core.json"]}
+	fsys["bootstrap/arm.json"] = &fstest.MapFile{Data: out["arm.json"]}
+	g = NewGenerator(fsys, mapSink{})
+	g.SecretServiceHash = "123abc"
+	c, err := g.ReadConfig()
+	if err != nil {
+		t.Fatalf("ReadConfig() returned error: %v", err)
+	}
+	diffs, err := g.Diff(*c, "bootstrap")
+	if err != nil {
+		t.Fatalf("Diff() returned error: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("Diff() = %+v, want no changes", diffs)
+	}
+}
+
+func TestServer(t *testing.T) {
+	key := []byte("secret")
+	s := NewServer(fstest.MapFS{"core.json": {Data: []byte(`{"ignition":{}}`)}}, key)
+	cases := []struct {
+		url        string
+		wantStatus int
+	}{
+		{"/nodes/core?token=" + NodeToken(key, "core"), http.StatusOK},
+		{"/nodes/core?token=" + NodeToken(key, "arm"), http.StatusForbidden},
+		{"/nodes/core", http.StatusForbidden},
+		{"/nodes/arm?token=" + NodeToken(key, "arm"), http.StatusNotFound},
+		{"/nodes/../config.json?token=" + NodeToken(key, "../config.json"), http.StatusNotFound},
+		{"/core.json", http.StatusNotFound},
+	}
+	for _, tt := range cases {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.wantStatus {
+			t.Errorf("GET %s got status %d, want %d", tt.url, w.Code, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package ignite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// releaseChecksumsFile is the artifact of each release listing the
+	// sha512 checksums of the others, as written by sha512sum.
+	releaseChecksumsFile = "SHA512SUMS"
+	// releaseSignatureFile is the armored detached signature of
+	// releaseChecksumsFile, e.g. by "gpg --armor --detach-sign SHA512SUMS".
+	releaseSignatureFile = "SHA512SUMS.asc"
+)
+
+// DefaultKeysDir is where the public keys trusted to sign releases are
+// kept, relative to infra/.
+const DefaultKeysDir = "../gpg/keys"
+
+// ReadKeyring returns the keyring of the armored public keys in the
+// *.asc files of dir in fsys, e.g. "gpg/keys".
+func ReadKeyring(fsys fs.FS, dir string) (openpgp.EntityList, error) {
+	names, err := fs.Glob(fsys, path.Join(dir, "*.asc"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	result := openpgp.EntityList{}
+	for _, name := range names {
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key %q: %v", name, err)
+		}
+		result = append(result, keys...)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no public keys in %q", dir)
+	}
+	return result, nil
+}
+
+// verifySignature returns the key of the keyring that made sig, an
+// armored or binary detached signature of data.
+func verifySignature(keyring openpgp.KeyRing, data, sig []byte) (*openpgp.Entity, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		return openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+	}
+	return openpgp.CheckDetachedSignature(keyring, bytes.NewReader(data), bytes.NewReader(sig))
+}
+
+// parseReleaseChecksums returns the hex sha512 checksums of SHA512SUMS
+// data by artifact name.
+func parseReleaseChecksums(data []byte) (map[string]string, error) {
+	result := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %q", releaseChecksumsFile, line)
+		}
+		// sha512sum marks files read in binary mode with "*".
+		name := strings.TrimPrefix(parts[1], "*")
+		if b, err := hex.DecodeString(parts[0]); err != nil || len(b) != 64 {
+			return nil, fmt.Errorf("invalid sha512 checksum of %q in %s: %q", name, releaseChecksumsFile, parts[0])
+		}
+		result[name] = parts[0]
+	}
+	return result, nil
+}
+
+// GetChecksumSignatureURL returns the URL to fetch the signature of the
+// checksums of the project.
+func (pv ProjectVersion) GetChecksumSignatureURL(sources ArtifactSources, f *Fetcher) (string, error) {
+	return sources.getURL(artifact{
+		Project: pv.Name,
+		Version: pv.Version,
+		File:    releaseSignatureFile,
+	}, f)
+}
+
+// SignedChecksums returns the checksum lines of the files of the project
+// version, taken from the SHA512SUMS of its release, fetched by f, once
+// its signature is verified against keyring.
+//
+// Only the artifacts the project's files resolve to on the archs of the
+// nodes are kept, so that every line written was signed for.
+func (conf Config) SignedChecksums(f *Fetcher, pv ProjectVersion, keyring openpgp.KeyRing) (checksumlines, error) {
+	pc, exists := conf.ProjectConfigs[pv.Name]
+	if !exists {
+		return nil, fmt.Errorf("no project %q", pv.Name)
+	}
+	sources := conf.getArtifactSources(pv.Name)
+	sumsURL, err := pv.GetChecksumURL(sources, f)
+	if err != nil {
+		return nil, err
+	}
+	sigURL, err := pv.GetChecksumSignatureURL(sources, f)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Fetching %s of %s %s..\n", releaseChecksumsFile, pv.Name, pv.Version)
+	results := f.FetchAll([]FetchRequest{{URL: sumsURL}, {URL: sigURL}})
+	if results[0].Err != nil {
+		return nil, results[0].Err
+	}
+	if results[1].Err != nil {
+		return nil, fmt.Errorf("failed to fetch signature of %s of %s %s: %v", releaseChecksumsFile, pv.Name, pv.Version, results[1].Err)
+	}
+	data := results[0].Data
+	signer, err := verifySignature(keyring, data, results[1].Data)
+	if err != nil {
+		return nil, fmt.Errorf("bad signature on %s of %s %s: %v", releaseChecksumsFile, pv.Name, pv.Version, err)
+	}
+	log.Printf("Good signature on %s of %s %s from key %X\n", releaseChecksumsFile, pv.Name, pv.Version, signer.PrimaryKey.Fingerprint)
+	sums, err := parseReleaseChecksums(data)
+	if err != nil {
+		return nil, err
+	}
+	inRelease := func(name string) bool {
+		_, exists := sums[name]
+		return exists
+	}
+	archs := conf.NodeConfigs.archs()
+	result := checksumlines{}
+	for _, f := range pc.Files {
+		artifacts, err := f.artifacts(inRelease, archs)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range artifacts {
+			result = append(result, fmt.Sprintf("%s  %s\n", sums[a.name], a.key))
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package ignite
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// armoredKey returns the armored public key of the entity.
+func armoredKey(t *testing.T, e *openpgp.Entity) []byte {
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return b.Bytes()
+}
+
+func TestSignedChecksums(t *testing.T) {
+	signer, err := openpgp.NewEntity("Release Signer", "", "release@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Someone Else", "", "else@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := ReadKeyring(fstest.MapFS{
+		"gpg/keys/signer.asc": {Data: armoredKey(t, signer)},
+		"gpg/keys/README":     {Data: []byte("not a key")},
+	}, "gpg/keys")
+	if err != nil {
+		t.Fatalf("ReadKeyring() returned error: %v", err)
+	}
+
+	sums := fmt.Sprintf("%x  gather_facts\n%x  tclient_armv7l\n%x *tclient_x86_64\n%x  tserver_x86_64\n",
+		sha512.Sum512([]byte("facts")),
+		sha512.Sum512([]byte("arm")),
+		sha512.Sum512([]byte("x86")),
+		sha512.Sum512([]byte("server")),
+	)
+	sign := func(e *openpgp.Entity) []byte {
+		var b bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&b, e, strings.NewReader(sums), nil); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+	sig := sign(signer)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hkjninfra/1.5.14/SHA512SUMS":
+			fmt.Fprint(w, sums)
+		case "/hkjninfra/1.5.14/SHA512SUMS.asc":
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	conf := Config{}
+	if err := json.Unmarshal([]byte(testConfig), &conf); err != nil {
+		t.Fatal(err)
+	}
+	conf.Artifacts.URLTemplate = srv.URL + "/{{.Project}}/{{.Version}}/{{.File}}"
+	pv := ProjectVersion{Name: "hkjninfra", Version: "1.5.14"}
+	got, err := conf.SignedChecksums(NewFetcher(""), pv, keyring)
+	if err != nil {
+		t.Fatalf("SignedChecksums() returned error: %v", err)
+	}
+	want := fmt.Sprintf("%x  gather_facts\n%x  tclient_armv7l\n%x  tclient_x86_64\n",
+		sha512.Sum512([]byte("facts")),
+		sha512.Sum512([]byte("arm")),
+		sha512.Sum512([]byte("x86")),
+	)
+	if strings.Join(got, "") != want {
+		t.Errorf("SignedChecksums() got\n%s\nwant\n%s", strings.Join(got, ""), want)
+	}
+
+	sig = sign(other)
+	if _, err := conf.SignedChecksums(NewFetcher(""), pv, keyring); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("SignedChecksums() signed by unknown key returned error %v, want bad signature", err)
+	}
+	sig = sign(signer)
+	sums = strings.Replace(sums, "tserver", "tclient", 1)
+	if _, err := conf.SignedChecksums(NewFetcher(""), pv, keyring); err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Errorf("SignedChecksums() of modified SHA512SUMS returned error %v, want bad signature", err)
+	}
+	if _, err := ReadKeyring(fstest.MapFS{}, "gpg/keys"); err == nil {
+		t.Errorf("ReadKeyring() of no keys succeeded")
+	}
+}
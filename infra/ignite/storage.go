@@ -0,0 +1,369 @@
+package ignite
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+type (
+	// NodeStorage declares the disks, filesystems, directories and links of a node.
+	NodeStorage struct {
+		Disks       []Disk       `json:"disks,omitempty"`
+		Filesystems []Filesystem `json:"filesystems,omitempty"`
+		Directories []Directory  `json:"directories,omitempty"`
+		Links       []Link       `json:"links,omitempty"`
+	}
+	// Disk is a disk to partition, e.g. "/dev/sdb".
+	Disk struct {
+		// Device is the path of the disk.
+		Device string `json:"device"`
+		// WipeTable is true if any existing partition table should be wiped.
+		WipeTable bool `json:"wipe_table,omitempty"`
+		// Partitions are the partitions to create on the disk.
+		Partitions []Partition `json:"partitions,omitempty"`
+	}
+	// Partition is a partition of a disk.
+	Partition struct {
+		// Label is the GPT partition label, making it available as /dev/disk/by-partlabel/<label>.
+		Label string `json:"label,omitempty"`
+		// Number is the partition number, or 0 for the next available one.
+		Number int `json:"number,omitempty"`
+		// SizeMiB is the size of the partition in MiB, or 0 to fill the disk.
+		SizeMiB int `json:"size_mib,omitempty"`
+		// StartMiB is where the partition starts in MiB, or 0 for the default.
+		StartMiB int `json:"start_mib,omitempty"`
+		// TypeGUID is the GPT partition type, if not the default Linux filesystem type.
+		TypeGUID string `json:"type_guid,omitempty"`
+	}
+	// Filesystem is a filesystem to create and mount on a node.
+	Filesystem struct {
+		// Device is the path of the device, e.g. "/dev/disk/by-partlabel/data".
+		Device string `json:"device"`
+		// Format is the type of filesystem, e.g. "xfs" or "ext4".
+		Format string `json:"format"`
+		// Label is the filesystem label.
+		Label string `json:"label,omitempty"`
+		// WipeFilesystem is true if any existing filesystem should be
+		// wiped, rather than reused if it matches.
+		WipeFilesystem bool `json:"wipe_filesystem,omitempty"`
+		// Path is where the filesystem is mounted, using a generated
+		// mount unit, or empty if it shouldn't be mounted.
+		Path string `json:"path,omitempty"`
+		// MountOptions are the options of the mount unit, e.g. ["noatime"].
+		MountOptions []string `json:"mount_options,omitempty"`
+	}
+	// Directory is a directory to create on a node.
+	Directory struct {
+		Path string `json:"path"`
+		// Mode is the mode of the directory, defaulting to 0755.
+		Mode  int    `json:"mode,omitempty"`
+		User  *Owner `json:"user,omitempty"`
+		Group *Owner `json:"group,omitempty"`
+	}
+	// Link is a symbolic or hard link to create on a node.
+	Link struct {
+		Path   string `json:"path"`
+		Target string `json:"target"`
+		Hard   bool   `json:"hard,omitempty"`
+	}
+
+	// The types below are the spec 2.x layout of the storage section.
+	partition struct {
+		Label    string `json:"label,omitempty"`
+		Number   int    `json:"number"`
+		Size     int    `json:"size,omitempty"`
+		Start    int    `json:"start,omitempty"`
+		TypeGUID string `json:"typeGuid,omitempty"`
+	}
+	disk struct {
+		Device     string      `json:"device"`
+		WipeTable  bool        `json:"wipeTable,omitempty"`
+		Partitions []partition `json:"partitions,omitempty"`
+	}
+	// mountCreate is how spec 2.0.0 formats filesystems.
+	mountCreate struct {
+		Force   bool     `json:"force,omitempty"`
+		Options []string `json:"options,omitempty"`
+	}
+	mount struct {
+		Device         string       `json:"device"`
+		Format         string       `json:"format"`
+		WipeFilesystem bool         `json:"wipeFilesystem,omitempty"`
+		Label          string       `json:"label,omitempty"`
+		Create         *mountCreate `json:"create,omitempty"`
+	}
+	filesystem struct {
+		Name  string `json:"name,omitempty"`
+		Mount mount  `json:"mount"`
+	}
+	directory struct {
+		Filesystem string `json:"filesystem"`
+		Path       string `json:"path"`
+		Mode       int    `json:"mode"`
+		User       owner  `json:"user"`
+		Group      owner  `json:"group"`
+	}
+	link struct {
+		Filesystem string `json:"filesystem"`
+		Path       string `json:"path"`
+		Target     string `json:"target"`
+		Hard       bool   `json:"hard,omitempty"`
+	}
+
+	// The types below are the spec 3.x layout of disks and filesystems.
+	partitionV3 struct {
+		Label    string `json:"label,omitempty"`
+		Number   int    `json:"number,omitempty"`
+		SizeMiB  *int   `json:"sizeMiB,omitempty"`
+		StartMiB *int   `json:"startMiB,omitempty"`
+		TypeGUID string `json:"typeGuid,omitempty"`
+	}
+	diskV3 struct {
+		Device     string        `json:"device"`
+		WipeTable  bool          `json:"wipeTable,omitempty"`
+		Partitions []partitionV3 `json:"partitions,omitempty"`
+	}
+	filesystemV3 struct {
+		Device         string `json:"device"`
+		Format         string `json:"format"`
+		WipeFilesystem bool   `json:"wipeFilesystem,omitempty"`
+		Label          string `json:"label,omitempty"`
+	}
+)
+
+// sectorsPerMiB is the number of 512 byte sectors in a MiB, which is the
+// unit of partition sizes in spec 2.x.
+const sectorsPerMiB = 2048
+
+// defaultDirectoryMode is the mode of directories that don't set one.
+const defaultDirectoryMode = 0755
+
+// getDisks returns the spec 2.x form of the disks.
+func (s NodeStorage) getDisks() []disk {
+	result := []disk{}
+	for _, d := range s.Disks {
+		nd := disk{Device: d.Device, WipeTable: d.WipeTable}
+		for _, p := range d.Partitions {
+			nd.Partitions = append(nd.Partitions, partition{
+				Label:    p.Label,
+				Number:   p.Number,
+				Size:     p.SizeMiB * sectorsPerMiB,
+				Start:    p.StartMiB * sectorsPerMiB,
+				TypeGUID: p.TypeGUID,
+			})
+		}
+		result = append(result, nd)
+	}
+	return result
+}
+
+// getFilesystems returns the spec 2.x form of the filesystems for the Ignition spec version.
+func (s NodeStorage) getFilesystems(version string) []filesystem {
+	result := []filesystem{}
+	for _, f := range s.Filesystems {
+		m := mount{Device: f.Device, Format: f.Format}
+		if version == ignitionVersionV2 {
+			m.Create = &mountCreate{Force: f.WipeFilesystem}
+			if f.Label != "" {
+				m.Create.Options = []string{"-L", f.Label}
+			}
+		} else {
+			m.WipeFilesystem = f.WipeFilesystem
+			m.Label = f.Label
+		}
+		result = append(result, filesystem{Name: f.Label, Mount: m})
+	}
+	return result
+}
+
+// getDirectories returns the spec 2.x form of the directories.
+func (s NodeStorage) getDirectories() []directory {
+	result := []directory{}
+	for _, d := range s.Directories {
+		mode := d.Mode
+		if mode == 0 {
+			mode = defaultDirectoryMode
+		}
+		result = append(result, directory{
+			Filesystem: "root",
+			Path:       d.Path,
+			Mode:       mode,
+			User:       d.User.toOwner(),
+			Group:      d.Group.toOwner(),
+		})
+	}
+	return result
+}
+
+// getLinks returns the spec 2.x form of the links.
+func (s NodeStorage) getLinks() []link {
+	result := []link{}
+	for _, l := range s.Links {
+		result = append(result, link{
+			Filesystem: "root",
+			Path:       l.Path,
+			Target:     l.Target,
+			Hard:       l.Hard,
+		})
+	}
+	return result
+}
+
+// getDisksV3 returns the spec 3.x form of the disks.
+func (s NodeStorage) getDisksV3() []diskV3 {
+	result := []diskV3{}
+	for _, d := range s.Disks {
+		nd := diskV3{Device: d.Device, WipeTable: d.WipeTable}
+		for _, p := range d.Partitions {
+			np := partitionV3{
+				Label:    p.Label,
+				Number:   p.Number,
+				TypeGUID: p.TypeGUID,
+			}
+			if p.SizeMiB != 0 {
+				size := p.SizeMiB
+				np.SizeMiB = &size
+			}
+			if p.StartMiB != 0 {
+				start := p.StartMiB
+				np.StartMiB = &start
+			}
+			nd.Partitions = append(nd.Partitions, np)
+		}
+		result = append(result, nd)
+	}
+	return result
+}
+
+// getFilesystemsV3 returns the spec 3.x form of the filesystems.
+func (s NodeStorage) getFilesystemsV3() []filesystemV3 {
+	result := []filesystemV3{}
+	for _, f := range s.Filesystems {
+		result = append(result, filesystemV3{
+			Device:         f.Device,
+			Format:         f.Format,
+			WipeFilesystem: f.WipeFilesystem,
+			Label:          f.Label,
+		})
+	}
+	return result
+}
+
+// mountUnitName returns the name of the systemd mount unit for the path,
+// escaped the way systemd-escape --path does, e.g. "var-lib-docker.mount".
+func mountUnitName(p string) string {
+	p = strings.Trim(path.Clean(p), "/")
+	if p == "" {
+		return "-.mount"
+	}
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c == '.' && i == 0:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.', c == ':':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		}
+	}
+	return b.String() + ".mount"
+}
+
+// getMountUnits returns mount units for the filesystems that have a path.
+func (s NodeStorage) getMountUnits() []systemdUnit {
+	result := []systemdUnit{}
+	for _, f := range s.Filesystems {
+		if f.Path == "" {
+			continue
+		}
+		lines := []string{
+			"[Unit]",
+			"Before=local-fs.target",
+			"",
+			"[Mount]",
+			fmt.Sprintf("What=%s", f.Device),
+			fmt.Sprintf("Where=%s", path.Clean(f.Path)),
+			fmt.Sprintf("Type=%s", f.Format),
+		}
+		if len(f.MountOptions) > 0 {
+			lines = append(lines, fmt.Sprintf("Options=%s", strings.Join(f.MountOptions, ",")))
+		}
+		lines = append(lines,
+			"",
+			"[Install]",
+			"RequiredBy=local-fs.target",
+		)
+		result = append(result, systemdUnit{
+			Enable:   true,
+			Name:     mountUnitName(f.Path),
+			Contents: strings.Join(lines, "\n") + "\n",
+		})
+	}
+	return result
+}
+
+// validate checks the storage of the node at path, and that its mount
+// units don't clash with the given units of its projects.
+func (s NodeStorage) validate(path string, units map[string]ProjectName, problems *Problems) {
+	for i, d := range s.Disks {
+		dpath := fmt.Sprintf("%s.disks[%d]", path, i)
+		if d.Device == "" {
+			problems.add(dpath+".device", "disk has no device")
+		}
+		numbers := map[int]bool{}
+		for j, p := range d.Partitions {
+			ppath := fmt.Sprintf("%s.partitions[%d]", dpath, j)
+			if p.Number != 0 && numbers[p.Number] {
+				problems.add(ppath+".number", "partition number %d is used more than once", p.Number)
+			}
+			numbers[p.Number] = true
+			if p.SizeMiB < 0 || p.StartMiB < 0 {
+				problems.add(ppath, "partition size and start can't be negative")
+			}
+		}
+	}
+	mounts := map[string]bool{}
+	for i, f := range s.Filesystems {
+		fpath := fmt.Sprintf("%s.filesystems[%d]", path, i)
+		if f.Device == "" {
+			problems.add(fpath+".device", "filesystem has no device")
+		}
+		if f.Format == "" {
+			problems.add(fpath+".format", "filesystem has no format")
+		}
+		if f.Path == "" {
+			continue
+		}
+		if !strings.HasPrefix(f.Path, "/") {
+			problems.add(fpath+".path", "mount path %q isn't absolute", f.Path)
+			continue
+		}
+		name := mountUnitName(f.Path)
+		if mounts[name] {
+			problems.add(fpath+".path", "%q is mounted more than once", f.Path)
+		}
+		mounts[name] = true
+		if p, exists := units[name]; exists {
+			problems.add(fpath+".path", "mount unit %s is also a unit of project %q", name, p)
+		}
+	}
+	for i, d := range s.Directories {
+		if !strings.HasPrefix(d.Path, "/") {
+			problems.add(fmt.Sprintf("%s.directories[%d].path", path, i), "directory path %q isn't absolute", d.Path)
+		}
+	}
+	for i, l := range s.Links {
+		lpath := fmt.Sprintf("%s.links[%d]", path, i)
+		if !strings.HasPrefix(l.Path, "/") {
+			problems.add(lpath+".path", "link path %q isn't absolute", l.Path)
+		}
+		if l.Target == "" {
+			problems.add(lpath+".target", "link has no target")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package ignite
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMountUnitName(t *testing.T) {
+	cases := map[string]string{
+		"/":                "-.mount",
+		"/containers":      "containers.mount",
+		"/var/lib/docker/": "var-lib-docker.mount",
+		"/mnt/data-1":      `mnt-data\x2d1.mount`,
+		"/srv/.cache":      "srv-.cache.mount",
+		"/.hidden":         `\x2ehidden.mount`,
+	}
+	for p, want := range cases {
+		if got := mountUnitName(p); got != want {
+			t.Errorf("mountUnitName(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+// testStorage is the storage of the nodes in TestGenerateStorage.
+const testStorage = `"storage": {
+				"disks": [{
+					"device": "/dev/sdb",
+					"wipe_table": true,
+					"partitions": [{"label": "data", "number": 1, "size_mib": 1024}]
+				}],
+				"filesystems": [{
+					"device": "/dev/disk/by-partlabel/data",
+					"format": "xfs",
+					"label": "data",
+					"path": "/containers",
+					"mount_options": ["noatime"]
+				}],
+				"directories": [{"path": "/containers/docker", "mode": 448}],
+				"links": [{"path": "/var/lib/docker", "target": "/containers/docker"}]
+			},`
+
+func TestGenerateStorage(t *testing.T) {
+	conf := strings.Replace(testConfig, `"arch": "armv7l",`, `"arch": "armv7l",`+testStorage, 1)
+	conf = strings.Replace(conf, `"arch": "x86_64",`, `"arch": "x86_64", "ignition_version": "2.2.0",`+testStorage, 1)
+	g := NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+
+	core := outputs[1].V2
+	b, err := json.Marshal(core.Storage.Disks)
+	if err != nil {
+		t.Fatalf("failed to marshal disks: %v", err)
+	}
+	if want := `[{"device":"/dev/sdb","wipeTable":true,"partitions":[{"label":"data","number":1,"size":2097152}]}]`; string(b) != want {
+		t.Errorf("Generate() for core got disks %s, want %s", b, want)
+	}
+	if got := core.Storage.Filesystems[0].Mount; got.Label != "data" || got.Create != nil {
+		t.Errorf("Generate() for core got mount %+v, want label and no create block", got)
+	}
+	if got := core.Storage.Directories[0]; got.Path != "/containers/docker" || got.Mode != 0700 {
+		t.Errorf("Generate() for core got directory %+v, want /containers/docker with mode 0700", got)
+	}
+	mountUnit := core.Systemd.Units[len(core.Systemd.Units)-1]
+	wantUnit := "[Unit]\nBefore=local-fs.target\n\n[Mount]\nWhat=/dev/disk/by-partlabel/data\nWhere=/containers\nType=xfs\nOptions=noatime\n\n[Install]\nRequiredBy=local-fs.target\n"
+	if mountUnit.Name != "containers.mount" || mountUnit.Contents != wantUnit || !mountUnit.Enable {
+		t.Errorf("Generate() for core got last unit %+v, want enabled containers.mount", mountUnit)
+	}
+
+	arm := outputs[0].V3
+	b, err = json.Marshal(arm.Storage.Disks)
+	if err != nil {
+		t.Fatalf("failed to marshal disks: %v", err)
+	}
+	if want := `[{"device":"/dev/sdb","wipeTable":true,"partitions":[{"label":"data","number":1,"sizeMiB":1024}]}]`; string(b) != want {
+		t.Errorf("Generate() for arm got disks %s, want %s", b, want)
+	}
+	if want := []linkV3{{Path: "/var/lib/docker", Target: "/containers/docker"}}; !reflect.DeepEqual(arm.Storage.Links, want) {
+		t.Errorf("Generate() for arm got links %+v, want %+v", arm.Storage.Links, want)
+	}
+}
@@ -0,0 +1,83 @@
+package ignite
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+)
+
+type (
+	// TemplateNode is the node a unit is rendered for.
+	TemplateNode struct {
+		// Name is the name of the node, e.g. "builder".
+		Name string
+		// Arch is the CPU architecture of the node, e.g. "x86_64".
+		Arch string
+		// Labels are the labels of the node.
+		Labels map[string]string
+	}
+	// TemplateData is the data systemd units and dropins are rendered
+	// with, e.g. "Environment=REPORT_ADDR={{.Vars.report_addr}}".
+	TemplateData struct {
+		// Node is the node the unit is rendered for.
+		Node TemplateNode
+		// Project is the name and version of the project the unit is part of.
+		Project ProjectVersion
+		// Vars are the variables of the project, overridden by those of the node.
+		Vars map[string]string
+	}
+)
+
+// newTemplateData returns the data to render units of project version pv with on the node.
+func newTemplateData(name nodeName, nc NodeConfig, pv ProjectVersion, pc projectConfig) TemplateData {
+	vars := map[string]string{}
+	for k, v := range pc.Vars {
+		vars[k] = v
+	}
+	for k, v := range nc.Vars {
+		vars[k] = v
+	}
+	return TemplateData{
+		Node: TemplateNode{
+			Name:   string(name),
+			Arch:   nc.Arch,
+			Labels: nc.Labels,
+		},
+		Project: pv,
+		Vars:    vars,
+	}
+}
+
+// render returns the contents of the named unit or dropin rendered with data.
+//
+// Referring to variables that aren't set is an error.
+func (data TemplateData) render(name, contents string) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(contents)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render for node %q: %v", data.Node.Name, err)
+	}
+	return buf.String(), nil
+}
+
+// renderUnits renders the contents of the units and their dropins with data.
+func (data TemplateData) renderUnits(units []systemdUnit) error {
+	for i, u := range units {
+		contents, err := data.render(u.Name, u.Contents)
+		if err != nil {
+			return err
+		}
+		units[i].Contents = contents
+		for j, d := range u.Dropins {
+			contents, err := data.render(d.Name, d.Contents)
+			if err != nil {
+				return err
+			}
+			units[i].Dropins[j].Contents = contents
+		}
+	}
+	return nil
+}
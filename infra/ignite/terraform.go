@@ -0,0 +1,104 @@
+package ignite
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+type (
+	// terraformNode is what Terraform gets to know about a node.
+	terraformNode struct {
+		// Arch is the CPU architecture of the node, e.g. "x86_64".
+		Arch string `json:"arch"`
+		// Provider is where the node runs, e.g. "gcp", or "" if it's not
+		// provisioned with Terraform.
+		Provider string `json:"provider"`
+		// Output is "ignition" or "cloud-init", the format of UserData.
+		Output string `json:"output"`
+		// UserData is the generated config of the node.
+		UserData string `json:"user_data"`
+		// Labels are the labels of the node.
+		Labels map[string]string `json:"labels"`
+	}
+	// terraformVars are the contents of terraformVarsFile.
+	terraformVars struct {
+		Nodes map[string]terraformNode `json:"nodes"`
+	}
+)
+
+// terraformVarsFile is the name of the file setting var.nodes, which
+// Terraform loads automatically.
+const terraformVarsFile = "nodes.auto.tfvars.json"
+
+// providers are the Terraform providers nodes can run on.
+var providers = map[string]bool{
+	"digitalocean": true,
+	"gcp":          true,
+	"scaleway":     true,
+}
+
+// validateProvider checks that the node's provider is known.
+func (nc NodeConfig) validateProvider() error {
+	if nc.Provider != "" && !providers[nc.Provider] {
+		return fmt.Errorf("unknown provider %q", nc.Provider)
+	}
+	return nil
+}
+
+// readTerraformVars returns the variables of the nodes in conf from the
+// existing terraformVarsFile in the generator's fs.FS, if any.
+func (g *Generator) readTerraformVars(conf Config) (map[string]terraformNode, error) {
+	result := map[string]terraformNode{}
+	b, err := fs.ReadFile(g.fsys, terraformVarsFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	vars := terraformVars{}
+	if err := json.Unmarshal(b, &vars); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", terraformVarsFile, err)
+	}
+	for name, n := range vars.Nodes {
+		if _, exists := conf.NodeConfigs.Get(name); exists {
+			result[name] = n
+		}
+	}
+	return result, nil
+}
+
+// marshalTerraformVars returns the Terraform variables of the nodes,
+// mapping their names to the user data written for them, their arch and
+// provider, along with the existing variables of other nodes.
+func marshalTerraformVars(conf Config, userData map[string][]byte, existing map[string]terraformNode) ([]byte, error) {
+	vars := terraformVars{Nodes: map[string]terraformNode{}}
+	for name, n := range existing {
+		vars.Nodes[name] = n
+	}
+	for name, b := range userData {
+		nc, _ := conf.NodeConfigs.Get(name)
+		output, err := nc.getOutput()
+		if err != nil {
+			return nil, err
+		}
+		labels := nc.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		vars.Nodes[name] = terraformNode{
+			Arch:     nc.Arch,
+			Provider: nc.Provider,
+			Output:   output,
+			UserData: string(b),
+			Labels:   labels,
+		}
+	}
+	b, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,43 @@
+package ignite
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateTerraformVars(t *testing.T) {
+	conf := strings.Replace(testConfig, `"arch": "x86_64",`, `"arch": "x86_64",
+			"provider": "gcp",
+			"labels": {"stage": "canary"},`, 1)
+	out, tfOut := mapSink{}, mapSink{}
+	g := NewGenerator(newTestFS(conf), out)
+	g.SecretServiceHash = "123abc"
+	g.TerraformOut = tfOut
+	if _, err := g.Generate(); err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	got := terraformVars{}
+	if err := json.Unmarshal(tfOut["nodes.auto.tfvars.json"], &got); err != nil {
+		t.Fatalf("Generate() wrote bad nodes.auto.tfvars.json: %v", err)
+	}
+	want := terraformVars{Nodes: map[string]terraformNode{
+		"arm": {
+			Arch:     "armv7l",
+			Output:   "ignition",
+			UserData: string(out["arm.json"]),
+			Labels:   map[string]string{},
+		},
+		"core": {
+			Arch:     "x86_64",
+			Provider: "gcp",
+			Output:   "ignition",
+			UserData: string(out["core.json"]),
+			Labels:   map[string]string{"stage": "canary"},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Generate() wrote %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,323 @@
+package ignite
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// UnitChecks configures how the paths systemd units refer to are checked
+// against the files delivered to nodes.
+type UnitChecks struct {
+	// Strict makes references to paths that aren't delivered errors
+	// rather than warnings, failing generation.
+	Strict bool `json:"strict,omitempty"`
+	// OSPaths are paths the OS image provides, in addition to
+	// defaultOSPaths. Paths ending in "/" include everything under them.
+	OSPaths []string `json:"os_paths,omitempty"`
+}
+
+// defaultOSPaths are the paths provided by all OS images we run.
+var defaultOSPaths = []string{
+	"/bin/",
+	"/dev/",
+	"/lib/",
+	"/lib64/",
+	"/proc/",
+	"/run/",
+	"/sbin/",
+	"/sys/",
+	"/usr/",
+}
+
+// defaultOSMounts are the mount units provided by all OS images we run.
+var defaultOSMounts = []string{
+	"-.mount",
+	"boot.mount",
+	"dev-hugepages.mount",
+	"dev-mqueue.mount",
+	"proc-sys-fs-binfmt_misc.mount",
+	"sys-kernel-debug.mount",
+	"tmp.mount",
+	"usr.mount",
+	"var.mount",
+}
+
+// execKeys are the directives whose first word is the binary to run.
+var execKeys = map[string]bool{
+	"ExecCondition": true,
+	"ExecReload":    true,
+	"ExecStart":     true,
+	"ExecStartPost": true,
+	"ExecStartPre":  true,
+	"ExecStop":      true,
+	"ExecStopPost":  true,
+}
+
+// dependencyKeys are the directives naming other units.
+var dependencyKeys = map[string]bool{
+	"After":    true,
+	"BindsTo":  true,
+	"Requires": true,
+	"Wants":    true,
+}
+
+// certSuffixes are the extensions of paths in Environment= that we expect
+// to be delivered, e.g. "REPORT_TLS_CERT=/etc/ssl/client.pem".
+var certSuffixes = []string{".pem", ".crt", ".cert", ".key"}
+
+// delivered is what's put on a node, for checking references in units.
+type delivered struct {
+	// paths are the files, directories and links on the node.
+	paths map[string]bool
+	// dirs are the directories and mount points on the node, everything under which is assumed to exist.
+	dirs []string
+	// units are the systemd units of the node.
+	units map[string]bool
+	// osPaths are paths provided by the OS image.
+	osPaths []string
+}
+
+// newDelivered returns an empty set of delivered paths, with the OS paths of checks.
+func newDelivered(checks UnitChecks) *delivered {
+	d := &delivered{
+		paths:   map[string]bool{},
+		units:   map[string]bool{},
+		osPaths: append(append([]string{}, defaultOSPaths...), checks.OSPaths...),
+	}
+	for _, m := range defaultOSMounts {
+		d.units[m] = true
+	}
+	for _, p := range checks.OSPaths {
+		d.units[mountUnitName(p)] = true
+	}
+	return d
+}
+
+// addStorage records the directories, links and mounts of the storage.
+func (d *delivered) addStorage(s NodeStorage) {
+	for _, dir := range s.Directories {
+		d.paths[path.Clean(dir.Path)] = true
+		d.dirs = append(d.dirs, path.Clean(dir.Path))
+	}
+	for _, l := range s.Links {
+		d.paths[path.Clean(l.Path)] = true
+	}
+	for _, f := range s.Filesystems {
+		if f.Path != "" {
+			d.dirs = append(d.dirs, path.Clean(f.Path))
+		}
+	}
+}
+
+// has returns true if p is delivered or provided by the OS.
+func (d *delivered) has(p string) bool {
+	p = path.Clean(p)
+	if d.paths[p] {
+		return true
+	}
+	for _, dir := range d.dirs {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			return true
+		}
+	}
+	for _, op := range d.osPaths {
+		if p == op || (strings.HasSuffix(op, "/") && strings.HasPrefix(p, op)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unitLines returns the directives of the unit as key and value, joining
+// continued lines and skipping comments and section headers.
+func unitLines(contents string) [][2]string {
+	result := [][2]string{}
+	line := ""
+	for _, l := range strings.Split(contents, "\n") {
+		l = strings.TrimSpace(l)
+		if strings.HasSuffix(l, "\\") {
+			line += strings.TrimSuffix(l, "\\") + " "
+			continue
+		}
+		line += l
+		if line != "" && line[0] != '#' && line[0] != ';' && line[0] != '[' {
+			if i := strings.Index(line, "="); i > 0 {
+				result = append(result, [2]string{strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])})
+			}
+		}
+		line = ""
+	}
+	return result
+}
+
+// splitQuoted returns the words of s, keeping double-quoted words together without the quotes.
+func splitQuoted(s string) []string {
+	result := []string{}
+	word, quoted, inWord := "", false, false
+	for _, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				result = append(result, word)
+			}
+			word, inWord = "", false
+		default:
+			word += string(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		result = append(result, word)
+	}
+	return result
+}
+
+// check returns descriptions of the paths and units the named unit
+// refers to that aren't delivered.
+func (d *delivered) check(name, contents string) []string {
+	result := []string{}
+	for _, kv := range unitLines(contents) {
+		key, value := kv[0], kv[1]
+		switch {
+		case execKeys[key]:
+			bin := strings.TrimLeft(value, "-@:+!")
+			if fields := strings.Fields(bin); len(fields) > 0 && strings.HasPrefix(fields[0], "/") && !d.has(fields[0]) {
+				result = append(result, fmt.Sprintf("%s runs %s, which the node doesn't deliver", name, fields[0]))
+			}
+		case key == "EnvironmentFile":
+			if strings.HasPrefix(value, "/") && !d.has(value) {
+				result = append(result, fmt.Sprintf("%s reads environment file %s, which the node doesn't deliver", name, value))
+			}
+		case key == "Environment":
+			for _, assignment := range splitQuoted(value) {
+				i := strings.Index(assignment, "=")
+				if i < 0 {
+					continue
+				}
+				p := assignment[i+1:]
+				if !strings.HasPrefix(p, "/") {
+					continue
+				}
+				for _, suffix := range certSuffixes {
+					if strings.HasSuffix(p, suffix) && !d.has(p) {
+						result = append(result, fmt.Sprintf("%s refers to %s, which the node doesn't deliver", name, p))
+					}
+				}
+			}
+		case dependencyKeys[key]:
+			for _, u := range strings.Fields(value) {
+				if strings.HasSuffix(u, ".mount") && !d.units[u] {
+					result = append(result, fmt.Sprintf("%s depends on %s, which isn't a unit of the node", name, u))
+				}
+			}
+		}
+	}
+	return result
+}
+
+// getDelivered returns what's delivered to the node.
+func (n node) getDelivered(checks UnitChecks) *delivered {
+	d := newDelivered(checks)
+	for _, f := range n.getFiles() {
+		d.paths[path.Clean(f.Path)] = true
+	}
+	for _, u := range n.networkdUnits {
+		d.paths[path.Join(networkdDir, u.Name)] = true
+	}
+	d.addStorage(n.storage)
+	for _, u := range n.systemdUnits {
+		d.units[u.Name] = true
+	}
+	return d
+}
+
+// checkUnits returns descriptions of the paths and units the node's
+// systemd units and dropins refer to that aren't delivered.
+func (n node) checkUnits(checks UnitChecks) []string {
+	d := n.getDelivered(checks)
+	result := []string{}
+	for _, u := range n.systemdUnits {
+		result = append(result, d.check(u.Name, u.Contents)...)
+		for _, dropin := range u.Dropins {
+			result = append(result, d.check(fmt.Sprintf("%s/%s", u.Name, dropin.Name), dropin.Contents)...)
+		}
+	}
+	return result
+}
+
+// declaredNode returns the node as generation delivers it, but with only
+// the paths of its files and names of its units and networkd units, taken
+// from its config without fetching or checksumming anything.
+func declaredNode(conf Config, nc NodeConfig, refs []projectRef, updateFiles []file) node {
+	n := node{
+		networkdUnits: []networkdUnit{},
+		storage:       nc.Storage,
+		updateFiles:   updateFiles,
+		systemdUnits:  nc.Storage.getMountUnits(),
+	}
+	for _, u := range nc.Networkd {
+		n.networkdUnits = append(n.networkdUnits, networkdUnit{Name: u.Name})
+	}
+	if nc.Wireguard != nil {
+		if m, err := conf.WireguardMeshes.get(nc.Wireguard.Mesh); err == nil {
+			netdev, network := m.unitNames()
+			n.networkdUnits = append(n.networkdUnits, networkdUnit{Name: netdev}, networkdUnit{Name: network})
+			n.secrets = append(n.secrets, binary{path: m.keyPath()})
+		}
+	}
+	for _, ref := range refs {
+		pc := conf.ProjectConfigs[ref.pv.Name]
+		for _, f := range pc.Files {
+			n.binaries = append(n.binaries, binary{path: f.Path})
+		}
+		for _, s := range pc.Secrets {
+			n.secrets = append(n.secrets, binary{path: s.Path})
+		}
+		for _, u := range pc.Units {
+			n.systemdUnits = append(n.systemdUnits, systemdUnit{Name: u})
+		}
+	}
+	return n
+}
+
+// validateUnitPaths checks the paths and units that the units and dropins
+// of the node's projects refer to, recording problems at the project.
+func (g *Generator) validateUnitPaths(conf Config, name nodeName, nc NodeConfig, refs []projectRef, updateFiles []file, problems *Problems) {
+	d := declaredNode(conf, nc, refs, updateFiles).getDelivered(conf.UnitChecks)
+	report := problems.warn
+	if conf.UnitChecks.Strict {
+		report = problems.add
+	}
+	for _, ref := range refs {
+		pc, exists := conf.ProjectConfigs[ref.pv.Name]
+		if !exists {
+			continue
+		}
+		data := newTemplateData(name, nc, ref.pv, pc)
+		ppath := jsonPath("project_configs", string(ref.pv.Name))
+		check := func(p, unitName, file string) {
+			b, err := fs.ReadFile(g.fsys, path.Join("units", file))
+			if err != nil {
+				return
+			}
+			contents, err := data.render(file, string(b))
+			if err != nil {
+				return
+			}
+			for _, msg := range d.check(unitName, contents) {
+				report(p, "on node %q: %s", name, msg)
+			}
+		}
+		for i, u := range pc.Units {
+			check(fmt.Sprintf("%s.units[%d]", ppath, i), u, u)
+		}
+		for i, dropin := range pc.Dropins {
+			check(fmt.Sprintf("%s.dropins[%d]", ppath, i), fmt.Sprintf("%s/%s", dropin.Unit, dropin.Dropin), dropin.Dropin)
+		}
+	}
+}
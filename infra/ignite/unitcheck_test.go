@@ -0,0 +1,61 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeliveredCheck(t *testing.T) {
+	d := newDelivered(UnitChecks{OSPaths: []string{"/etc/os-release", "/opt/vendor/"}})
+	d.paths["/opt/bin/tclient"] = true
+	d.paths["/etc/ssl/client.pem"] = true
+	d.units["containers.mount"] = true
+	d.addStorage(NodeStorage{Filesystems: []Filesystem{{Device: "/dev/sdb", Format: "xfs", Path: "/data"}}})
+
+	contents := strings.Join([]string{
+		"[Unit]",
+		"After=network-online.target containers.mount",
+		"Requires=etc-secrets.mount",
+		"",
+		"[Service]",
+		"# ExecStart=/opt/bin/commented",
+		`Environment="OPTS=-g /data/docker" REPORT_TLS_CERT=/etc/ssl/client.pem`,
+		"Environment=REPORT_TLS_KEY=/etc/ssl/client-key.pem",
+		"Environment=REPORT_FACTS_PATH=/etc/report_facts.json",
+		"EnvironmentFile=-/etc/optional.env",
+		"EnvironmentFile=/etc/tclient.env",
+		`ExecStartPre=-/bin/bash -c "/opt/bin/gather_facts"`,
+		"ExecStartPre=/opt/vendor/setup",
+		"ExecStart=/opt/bin/tclient \\",
+		"  -addr mon.example.com:50051",
+		"ExecStop=/opt/bin/tclient_stop",
+		"ExecStopPost=/data/cleanup.sh",
+	}, "\n")
+	got := d.check("tclient.service", contents)
+	want := []string{
+		"tclient.service depends on etc-secrets.mount, which isn't a unit of the node",
+		"tclient.service refers to /etc/ssl/client-key.pem, which the node doesn't deliver",
+		"tclient.service reads environment file /etc/tclient.env, which the node doesn't deliver",
+		"tclient.service runs /opt/bin/tclient_stop, which the node doesn't deliver",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("check() got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestUnitChecks(t *testing.T) {
+	conf := strings.Replace(testConfig, `{"name": "tclient", "path": "/opt/bin/tclient"}`, `{"name": "tclient", "path": "/opt/bin/tclient2"}`, 1)
+	g := NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	if _, err := g.Generate(); err != nil {
+		t.Errorf("Generate() returned error %v, want only warnings", err)
+	}
+	conf = strings.Replace(conf, `"nodes": {`, `"unit_checks": {"strict": true},
+	"nodes": {`, 1)
+	g = NewGenerator(newTestFS(conf), mapSink{})
+	g.SecretServiceHash = "123abc"
+	if _, err := g.Generate(); err == nil || !strings.Contains(err.Error(), "tclient.service runs /opt/bin/tclient") {
+		t.Errorf("Generate() returned error %v, want tclient.service error", err)
+	}
+}
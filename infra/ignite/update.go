@@ -0,0 +1,291 @@
+package ignite
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type (
+	// Update is the policy for automatic OS updates and reboots of nodes.
+	Update struct {
+		// OS is the image the node runs: "container-linux", "flatcar" or
+		// "fedora-coreos". Defaults to "container-linux" for Ignition spec
+		// 2.x and "fedora-coreos" for spec 3.x.
+		OS string `json:"os,omitempty"`
+		// Channel is the update channel, e.g. "stable" or "beta". Fedora
+		// CoreOS follows the stream of its image instead.
+		Channel string `json:"channel,omitempty"`
+		// RebootStrategy is how nodes reboot into updates: "reboot" to do
+		// so right away (or in the window, if one is set), "etcd-lock" or
+		// "best-effort" to use locksmith, "fleet-lock" to take a lock from
+		// the HTTP lock service at LockURL, or "off".
+		RebootStrategy string `json:"reboot_strategy,omitempty"`
+		// Window is the maintenance window nodes reboot in, if any.
+		Window *UpdateWindow `json:"window,omitempty"`
+		// LockURL is the base URL of the fleet lock service, for the "fleet-lock" strategy.
+		LockURL string `json:"lock_url,omitempty"`
+		// EtcdEndpoints are the etcd URLs locksmith takes its reboot lock
+		// from, for the "etcd-lock" strategy. Defaults to locksmith's own
+		// default, the etcd on the node itself.
+		EtcdEndpoints []string `json:"etcd_endpoints,omitempty"`
+	}
+	// UpdateWindow is a maintenance window for reboots.
+	UpdateWindow struct {
+		// Days are the days of the week of the window, e.g. ["Sat", "Sun"],
+		// or empty for every day.
+		Days []string `json:"days,omitempty"`
+		// Start is the time the window starts, e.g. "04:00".
+		Start string `json:"start"`
+		// LengthMinutes is the length of the window.
+		LengthMinutes int `json:"length_minutes"`
+	}
+)
+
+const (
+	osContainerLinux = "container-linux"
+	osFlatcar        = "flatcar"
+	osFedoraCoreOS   = "fedora-coreos"
+)
+
+// weekdays are the days of the week, in the form update agents accept.
+var weekdays = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// merge returns the update policy u, with the fields set in override replacing its own.
+func (u *Update) merge(override *Update) *Update {
+	if u == nil {
+		return override
+	}
+	result := *u
+	if override == nil {
+		return &result
+	}
+	if override.OS != "" {
+		result.OS = override.OS
+	}
+	if override.Channel != "" {
+		result.Channel = override.Channel
+	}
+	if override.RebootStrategy != "" {
+		result.RebootStrategy = override.RebootStrategy
+	}
+	if override.Window != nil {
+		result.Window = override.Window
+	}
+	if override.LockURL != "" {
+		result.LockURL = override.LockURL
+	}
+	if len(override.EtcdEndpoints) > 0 {
+		result.EtcdEndpoints = override.EtcdEndpoints
+	}
+	return &result
+}
+
+// forOS returns the fields of the update policy of all nodes that apply
+// to nodes running the OS image, so that a policy meant for Container
+// Linux doesn't break Fedora CoreOS nodes, and the other way around.
+// The window is dropped along with a reboot strategy that doesn't apply.
+func (u Update) forOS(image string) Update {
+	result := u
+	switch image {
+	case osFedoraCoreOS:
+		result.Channel = ""
+		result.EtcdEndpoints = nil
+		if u.RebootStrategy == "etcd-lock" || u.RebootStrategy == "best-effort" {
+			result.RebootStrategy = ""
+			result.Window = nil
+		}
+	case osContainerLinux, osFlatcar:
+		if u.RebootStrategy == "fleet-lock" {
+			result.RebootStrategy = ""
+		}
+		result.LockURL = ""
+	}
+	return result
+}
+
+// getUpdate returns the update policy of the node using the Ignition spec
+// version: the fields of the policy of all nodes that apply to its OS,
+// with those of its own policy replacing them.
+func (conf Config) getUpdate(nc NodeConfig, version string) *Update {
+	if conf.Update == nil {
+		return nc.Update
+	}
+	defaults := conf.Update.forOS(conf.Update.merge(nc.Update).getOS(version))
+	return defaults.merge(nc.Update)
+}
+
+// getOS returns the OS image of a node using the Ignition spec version.
+func (u Update) getOS(version string) string {
+	if u.OS != "" {
+		return u.OS
+	}
+	if isV3(version) {
+		return osFedoraCoreOS
+	}
+	return osContainerLinux
+}
+
+// validate checks the days, start and length of the window.
+func (w UpdateWindow) validate() error {
+	for _, d := range w.Days {
+		valid := false
+		for _, wd := range weekdays {
+			if d == wd {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid day %q in window, want one of %s", d, strings.Join(weekdays, ", "))
+		}
+	}
+	var hour, minute int
+	if _, err := fmt.Sscanf(w.Start, "%d:%d", &hour, &minute); err != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return fmt.Errorf("invalid window start %q, want e.g. \"04:00\"", w.Start)
+	}
+	if w.LengthMinutes <= 0 {
+		return fmt.Errorf("window length_minutes must be positive")
+	}
+	return nil
+}
+
+// getFiles returns the files configuring updates on a node using the
+// Ignition spec version.
+func (u Update) getFiles(version string) ([]file, error) {
+	if u.Window != nil {
+		if err := u.Window.validate(); err != nil {
+			return nil, err
+		}
+	}
+	switch image := u.getOS(version); image {
+	case osContainerLinux:
+		return u.getLocksmithFiles("/etc/coreos/update.conf")
+	case osFlatcar:
+		return u.getLocksmithFiles("/etc/flatcar/update.conf")
+	case osFedoraCoreOS:
+		return u.getZincatiFiles()
+	default:
+		return nil, fmt.Errorf("unknown update os %q, want %s, %s or %s", image, osContainerLinux, osFlatcar, osFedoraCoreOS)
+	}
+}
+
+// getLocksmithFiles returns the update.conf at path read by update_engine
+// and locksmith on Container Linux and Flatcar.
+func (u Update) getLocksmithFiles(path string) ([]file, error) {
+	lines := []string{}
+	if u.Channel != "" {
+		lines = append(lines, fmt.Sprintf("GROUP=%s", u.Channel))
+	}
+	switch u.RebootStrategy {
+	case "":
+	case "reboot", "etcd-lock", "best-effort", "off":
+		lines = append(lines, fmt.Sprintf("REBOOT_STRATEGY=%q", u.RebootStrategy))
+	case "fleet-lock":
+		return nil, fmt.Errorf("reboot_strategy %q isn't supported by locksmith, use \"etcd-lock\"", u.RebootStrategy)
+	default:
+		return nil, fmt.Errorf("unknown reboot_strategy %q", u.RebootStrategy)
+	}
+	if len(u.EtcdEndpoints) > 0 && u.RebootStrategy != "etcd-lock" {
+		return nil, fmt.Errorf("etcd_endpoints need reboot_strategy \"etcd-lock\"")
+	}
+	for _, e := range u.EtcdEndpoints {
+		if eu, err := url.Parse(e); err != nil || (eu.Scheme != "http" && eu.Scheme != "https") || eu.Host == "" {
+			return nil, fmt.Errorf("invalid etcd endpoint %q, want e.g. \"https://etcd.example.com:2379\"", e)
+		}
+	}
+	if u.Window != nil {
+		start := u.Window.Start
+		switch len(u.Window.Days) {
+		case 0:
+		case 1:
+			start = fmt.Sprintf("%s %s", u.Window.Days[0], start)
+		default:
+			return nil, fmt.Errorf("locksmith only supports windows on a single day or every day, not %s", strings.Join(u.Window.Days, ", "))
+		}
+		lines = append(lines,
+			fmt.Sprintf("REBOOT_WINDOW_START=%q", start),
+			fmt.Sprintf("REBOOT_WINDOW_LENGTH=\"%dm\"", u.Window.LengthMinutes),
+		)
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return []file{newDataFile(path, strings.Join(lines, "\n"))}, nil
+}
+
+// getUnits returns the systemd units of the update policy of a node using
+// the Ignition spec version: for the "etcd-lock" strategy on Container
+// Linux and Flatcar, locksmithd, with a dropin pointing it at the etcd
+// endpoints if any are set.
+func (u Update) getUnits(version string) []systemdUnit {
+	if image := u.getOS(version); u.RebootStrategy != "etcd-lock" || (image != osContainerLinux && image != osFlatcar) {
+		return nil
+	}
+	unit := systemdUnit{Enable: true, Name: "locksmithd.service"}
+	if len(u.EtcdEndpoints) > 0 {
+		unit.Dropins = []systemdDropin{{
+			Name:     "40-etcd-lock.conf",
+			Contents: fmt.Sprintf("[Service]\nEnvironment=\"LOCKSMITHD_ENDPOINT=%s\"\n", strings.Join(u.EtcdEndpoints, ",")),
+		}}
+	}
+	return []systemdUnit{unit}
+}
+
+// getZincatiFiles returns the zincati config on Fedora CoreOS.
+func (u Update) getZincatiFiles() ([]file, error) {
+	if u.Channel != "" {
+		return nil, fmt.Errorf("channel can't be set for %s, which follows the stream of its image", osFedoraCoreOS)
+	}
+	switch u.RebootStrategy {
+	case "":
+		if u.Window != nil {
+			return nil, fmt.Errorf("window needs reboot_strategy \"reboot\" on %s", osFedoraCoreOS)
+		}
+		return nil, nil
+	case "off":
+		return []file{newDataFile("/etc/zincati/config.d/90-disable-auto-updates.toml", "[updates]\nenabled = false\n")}, nil
+	case "reboot":
+		if u.Window == nil {
+			return []file{newDataFile("/etc/zincati/config.d/55-updates-strategy.toml", "[updates]\nstrategy = \"immediate\"\n")}, nil
+		}
+		days := u.Window.Days
+		if len(days) == 0 {
+			days = weekdays
+		}
+		quoted := []string{}
+		for _, d := range days {
+			quoted = append(quoted, fmt.Sprintf("%q", d))
+		}
+		contents := strings.Join([]string{
+			"[updates]",
+			"strategy = \"periodic\"",
+			"",
+			"[[updates.periodic.window]]",
+			fmt.Sprintf("days = [ %s ]", strings.Join(quoted, ", ")),
+			fmt.Sprintf("start_time = %q", u.Window.Start),
+			fmt.Sprintf("length_minutes = %d", u.Window.LengthMinutes),
+			"",
+		}, "\n")
+		return []file{newDataFile("/etc/zincati/config.d/55-updates-strategy.toml", contents)}, nil
+	case "fleet-lock":
+		if u.LockURL == "" {
+			return nil, fmt.Errorf("reboot_strategy \"fleet-lock\" needs a lock_url")
+		}
+		if u.Window != nil {
+			return nil, fmt.Errorf("window can't be combined with reboot_strategy \"fleet-lock\"")
+		}
+		contents := strings.Join([]string{
+			"[updates]",
+			"strategy = \"fleet_lock\"",
+			"",
+			"[updates.fleet_lock]",
+			fmt.Sprintf("base_url = %q", u.LockURL),
+			"",
+		}, "\n")
+		return []file{newDataFile("/etc/zincati/config.d/55-updates-strategy.toml", contents)}, nil
+	case "etcd-lock", "best-effort":
+		return nil, fmt.Errorf("reboot_strategy %q needs locksmith, which %s doesn't have", u.RebootStrategy, osFedoraCoreOS)
+	default:
+		return nil, fmt.Errorf("unknown reboot_strategy %q", u.RebootStrategy)
+	}
+}
@@ -0,0 +1,210 @@
+package ignite
+
+import (
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdateGetFiles(t *testing.T) {
+	cases := []struct {
+		desc     string
+		update   Update
+		version  string
+		wantPath string
+		want     string
+		wantErr  string
+	}{
+		{
+			desc:     "container linux",
+			update:   Update{Channel: "beta", RebootStrategy: "etcd-lock"},
+			version:  "2.0.0",
+			wantPath: "/etc/coreos/update.conf",
+			want:     "GROUP=beta\nREBOOT_STRATEGY=\"etcd-lock\"",
+		},
+		{
+			desc:     "flatcar with window",
+			update:   Update{OS: "flatcar", RebootStrategy: "reboot", Window: &UpdateWindow{Days: []string{"Thu"}, Start: "04:00", LengthMinutes: 60}},
+			version:  "3.0.0",
+			wantPath: "/etc/flatcar/update.conf",
+			want:     "REBOOT_STRATEGY=\"reboot\"\nREBOOT_WINDOW_START=\"Thu 04:00\"\nREBOOT_WINDOW_LENGTH=\"60m\"",
+		},
+		{
+			desc:     "fedora coreos with window",
+			update:   Update{RebootStrategy: "reboot", Window: &UpdateWindow{Days: []string{"Sat", "Sun"}, Start: "22:30", LengthMinutes: 90}},
+			version:  "3.0.0",
+			wantPath: "/etc/zincati/config.d/55-updates-strategy.toml",
+			want:     "[updates]\nstrategy = \"periodic\"\n\n[[updates.periodic.window]]\ndays = [ \"Sat\", \"Sun\" ]\nstart_time = \"22:30\"\nlength_minutes = 90\n",
+		},
+		{
+			desc:     "fedora coreos with fleet lock",
+			update:   Update{RebootStrategy: "fleet-lock", LockURL: "http://lock.example.com"},
+			version:  "3.0.0",
+			wantPath: "/etc/zincati/config.d/55-updates-strategy.toml",
+			want:     "[updates]\nstrategy = \"fleet_lock\"\n\n[updates.fleet_lock]\nbase_url = \"http://lock.example.com\"\n",
+		},
+		{
+			desc:    "etcd lock on fedora coreos",
+			update:  Update{RebootStrategy: "etcd-lock"},
+			version: "3.0.0",
+			wantErr: `reboot_strategy "etcd-lock" needs locksmith`,
+		},
+		{
+			desc:    "locksmith window on several days",
+			update:  Update{RebootStrategy: "reboot", Window: &UpdateWindow{Days: []string{"Sat", "Sun"}, Start: "04:00", LengthMinutes: 60}},
+			version: "2.0.0",
+			wantErr: "locksmith only supports windows on a single day",
+		},
+		{
+			desc:    "etcd endpoints without etcd lock",
+			update:  Update{RebootStrategy: "reboot", EtcdEndpoints: []string{"https://etcd.example.com:2379"}},
+			version: "2.0.0",
+			wantErr: `etcd_endpoints need reboot_strategy "etcd-lock"`,
+		},
+		{
+			desc:    "bad etcd endpoint",
+			update:  Update{RebootStrategy: "etcd-lock", EtcdEndpoints: []string{"etcd.example.com:2379"}},
+			version: "2.0.0",
+			wantErr: `invalid etcd endpoint "etcd.example.com:2379"`,
+		},
+		{
+			desc:    "bad window start",
+			update:  Update{RebootStrategy: "reboot", Window: &UpdateWindow{Start: "4pm", LengthMinutes: 60}},
+			version: "2.0.0",
+			wantErr: `invalid window start "4pm"`,
+		},
+	}
+	for _, tt := range cases {
+		files, err := tt.update.getFiles(tt.version)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: getFiles() returned error %v, want %q", tt.desc, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: getFiles() returned error: %v", tt.desc, err)
+			continue
+		}
+		if len(files) != 1 || files[0].Path != tt.wantPath {
+			t.Errorf("%s: getFiles() = %+v, want a single file at %s", tt.desc, files, tt.wantPath)
+			continue
+		}
+		got, err := url.PathUnescape(strings.TrimPrefix(files[0].Contents.Source, "data:,"))
+		if err != nil {
+			t.Errorf("%s: getFiles() returned bad data URL %q: %v", tt.desc, files[0].Contents.Source, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: getFiles() got contents %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateGetUnits(t *testing.T) {
+	cases := []struct {
+		desc    string
+		update  Update
+		version string
+		want    []systemdUnit
+	}{
+		{
+			desc:    "etcd lock with endpoints",
+			update:  Update{RebootStrategy: "etcd-lock", EtcdEndpoints: []string{"https://etcd0.example.com:2379", "https://etcd1.example.com:2379"}},
+			version: "2.0.0",
+			want: []systemdUnit{{
+				Enable: true,
+				Name:   "locksmithd.service",
+				Dropins: []systemdDropin{{
+					Name:     "40-etcd-lock.conf",
+					Contents: "[Service]\nEnvironment=\"LOCKSMITHD_ENDPOINT=https://etcd0.example.com:2379,https://etcd1.example.com:2379\"\n",
+				}},
+			}},
+		},
+		{
+			desc:    "etcd lock on flatcar with the default endpoint",
+			update:  Update{OS: "flatcar", RebootStrategy: "etcd-lock"},
+			version: "3.0.0",
+			want:    []systemdUnit{{Enable: true, Name: "locksmithd.service"}},
+		},
+		{
+			desc:    "reboot without a lock",
+			update:  Update{RebootStrategy: "reboot"},
+			version: "2.0.0",
+		},
+	}
+	for _, tt := range cases {
+		if got := tt.update.getUnits(tt.version); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: getUnits() = %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestGetUpdate(t *testing.T) {
+	fleet := &Update{Channel: "beta", RebootStrategy: "etcd-lock", Window: &UpdateWindow{Start: "04:00", LengthMinutes: 60}}
+	cases := []struct {
+		desc    string
+		node    *Update
+		version string
+		want    *Update
+	}{
+		{
+			desc:    "container linux gets the fleet policy",
+			version: "2.0.0",
+			want:    fleet,
+		},
+		{
+			desc:    "fedora coreos drops the channel and locksmith strategy",
+			version: "3.0.0",
+			want:    &Update{},
+		},
+		{
+			desc:    "fedora coreos with its own strategy",
+			node:    &Update{RebootStrategy: "fleet-lock", LockURL: "https://lock.example.com"},
+			version: "3.0.0",
+			want:    &Update{RebootStrategy: "fleet-lock", LockURL: "https://lock.example.com"},
+		},
+		{
+			desc:    "flatcar on spec 3.x keeps the fleet policy",
+			node:    &Update{OS: "flatcar"},
+			version: "3.0.0",
+			want:    &Update{OS: "flatcar", Channel: "beta", RebootStrategy: "etcd-lock", Window: fleet.Window},
+		},
+	}
+	for _, tt := range cases {
+		conf := Config{Update: fleet}
+		got := conf.getUpdate(NodeConfig{Update: tt.node}, tt.version)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: getUpdate() = %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+// TestUpdateConfigV3 checks that the nodes of the real config.json can
+// switch to Ignition spec 3.x without overriding the update policy of
+// all nodes.
+func TestUpdateConfigV3(t *testing.T) {
+	g := NewGenerator(os.DirFS(".."), mapSink{})
+	g.SecretServiceHash = "123abc"
+	conf, err := g.ReadConfig()
+	if err != nil {
+		t.Fatalf("ReadConfig() returned error: %v", err)
+	}
+	if conf.Update == nil || conf.Update.Channel == "" {
+		t.Fatalf("ReadConfig() got update policy %+v, want one with a channel", conf.Update)
+	}
+	for name, nc := range conf.NodeConfigs {
+		nc.IgnitionVersion = "3.0.0"
+		conf.NodeConfigs[name] = nc
+	}
+	outputs, err := g.Build(*conf)
+	if err != nil {
+		t.Fatalf("Build() with spec 3.x nodes returned error: %v", err)
+	}
+	for _, o := range outputs {
+		if o.V3 == nil {
+			t.Errorf("Build() for %s = %+v, want spec 3.x config", o.Name, o)
+		}
+	}
+}
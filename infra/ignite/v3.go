@@ -0,0 +1,196 @@
+package ignite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The types below model the Ignition spec 3.x layout, which is what
+// current Fedora CoreOS and Flatcar images accept. Compared to spec
+// 2.x, files no longer name a filesystem, units are "enabled" rather
+// than "enable", and directories and links are first-class entries.
+type (
+	verificationV3 struct {
+		Hash string `json:"hash,omitempty"`
+	}
+	resourceV3 struct {
+		Source       string         `json:"source,omitempty"`
+		Verification verificationV3 `json:"verification"`
+	}
+	ownerV3 struct {
+		ID   *int   `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
+	}
+	fileV3 struct {
+		Path      string     `json:"path"`
+		Overwrite bool       `json:"overwrite"`
+		Contents  resourceV3 `json:"contents"`
+		Mode      int        `json:"mode"`
+		User      *ownerV3   `json:"user,omitempty"`
+		Group     *ownerV3   `json:"group,omitempty"`
+	}
+	directoryV3 struct {
+		Path  string   `json:"path"`
+		Mode  int      `json:"mode"`
+		User  *ownerV3 `json:"user,omitempty"`
+		Group *ownerV3 `json:"group,omitempty"`
+	}
+	linkV3 struct {
+		Path   string `json:"path"`
+		Target string `json:"target"`
+		Hard   bool   `json:"hard,omitempty"`
+	}
+	storageV3 struct {
+		Disks       []diskV3       `json:"disks,omitempty"`
+		Filesystems []filesystemV3 `json:"filesystems,omitempty"`
+		Files       []fileV3       `json:"files,omitempty"`
+		Directories []directoryV3  `json:"directories,omitempty"`
+		Links       []linkV3       `json:"links,omitempty"`
+	}
+	dropinV3 struct {
+		Name     string `json:"name"`
+		Contents string `json:"contents"`
+	}
+	unitV3 struct {
+		Name     string     `json:"name"`
+		Enabled  *bool      `json:"enabled,omitempty"`
+		Contents string     `json:"contents,omitempty"`
+		Dropins  []dropinV3 `json:"dropins,omitempty"`
+	}
+	systemdV3 struct {
+		Units []unitV3 `json:"units,omitempty"`
+	}
+	// ignitionConfigV3 points at a config to use instead of this one.
+	ignitionConfigV3 struct {
+		Replace *resourceV3 `json:"replace,omitempty"`
+	}
+	ignitionV3 struct {
+		Version string            `json:"version"`
+		Config  *ignitionConfigV3 `json:"config,omitempty"`
+	}
+	// IgnitionConfigV3 is an Ignition config in the spec 3.x layout.
+	IgnitionConfigV3 struct {
+		Ignition ignitionV3 `json:"ignition"`
+		Storage  storageV3  `json:"storage"`
+		Systemd  systemdV3  `json:"systemd"`
+		Passwd   passwd     `json:"passwd"`
+	}
+)
+
+const (
+	// ignitionVersionV2 is the spec 2.x version we emit by default.
+	ignitionVersionV2 = "2.0.0"
+	// ignitionVersionV3 is the spec 3.x version used when a node asks for "3".
+	ignitionVersionV3 = "3.0.0"
+)
+
+// supportedIgnitionVersions are the Ignition spec versions we can emit.
+var supportedIgnitionVersions = map[string]bool{
+	"2.0.0": true,
+	"2.1.0": true,
+	"2.2.0": true,
+	"2.3.0": true,
+	"3.0.0": true,
+	"3.1.0": true,
+	"3.2.0": true,
+	"3.3.0": true,
+	"3.4.0": true,
+}
+
+// getIgnitionVersion returns the Ignition spec version to emit for the node.
+func (nc NodeConfig) getIgnitionVersion() (string, error) {
+	switch nc.IgnitionVersion {
+	case "", "2":
+		return ignitionVersionV2, nil
+	case "3":
+		return ignitionVersionV3, nil
+	}
+	if !supportedIgnitionVersions[nc.IgnitionVersion] {
+		return "", fmt.Errorf("unsupported ignition_version %q", nc.IgnitionVersion)
+	}
+	return nc.IgnitionVersion, nil
+}
+
+// isV3 returns true if the Ignition spec version is 3.x.
+func isV3(version string) bool {
+	return strings.HasPrefix(version, "3.")
+}
+
+// toV3 returns the spec 3.x form of the owner, or nil if it's unset.
+func (o owner) toV3() *ownerV3 {
+	if o.ID == nil && o.Name == "" {
+		return nil
+	}
+	return &ownerV3{ID: o.ID, Name: o.Name}
+}
+
+// toV3 returns the spec 3.x form of the file.
+func (f file) toV3() fileV3 {
+	return fileV3{
+		Path:      f.Path,
+		Overwrite: true,
+		Contents: resourceV3{
+			Source:       f.Contents.Source,
+			Verification: verificationV3{Hash: f.Contents.Verification.Hash},
+		},
+		Mode:  f.Mode,
+		User:  f.User.toV3(),
+		Group: f.Group.toV3(),
+	}
+}
+
+// toV3 returns the spec 3.x form of the systemd unit.
+func (u systemdUnit) toV3() unitV3 {
+	result := unitV3{
+		Name:     u.Name,
+		Contents: u.Contents,
+	}
+	if u.Enable {
+		enabled := true
+		result.Enabled = &enabled
+	}
+	for _, d := range u.Dropins {
+		result.Dropins = append(result.Dropins, dropinV3{
+			Name:     d.Name,
+			Contents: d.Contents,
+		})
+	}
+	return result
+}
+
+// getIgnitionConfigV3 returns the spec 3.x ignition config for the node.
+func (n node) getIgnitionConfigV3() IgnitionConfigV3 {
+	conf := IgnitionConfigV3{
+		Ignition: ignitionV3{
+			Version: n.ignitionVersion,
+		},
+	}
+	for _, f := range n.getFiles() {
+		conf.Storage.Files = append(conf.Storage.Files, f.toV3())
+	}
+	for _, u := range n.networkdUnits {
+		conf.Storage.Files = append(conf.Storage.Files, u.toFile().toV3())
+	}
+	conf.Storage.Disks = n.storage.getDisksV3()
+	conf.Storage.Filesystems = n.storage.getFilesystemsV3()
+	for _, d := range n.storage.getDirectories() {
+		conf.Storage.Directories = append(conf.Storage.Directories, directoryV3{
+			Path:  d.Path,
+			Mode:  d.Mode,
+			User:  d.User.toV3(),
+			Group: d.Group.toV3(),
+		})
+	}
+	for _, l := range n.storage.getLinks() {
+		conf.Storage.Links = append(conf.Storage.Links, linkV3{
+			Path:   l.Path,
+			Target: l.Target,
+			Hard:   l.Hard,
+		})
+	}
+	for _, u := range n.systemdUnits {
+		conf.Systemd.Units = append(conf.Systemd.Units, u.toV3())
+	}
+	conf.Passwd = n.passwd.getPasswd(n.ignitionVersion)
+	return conf
+}
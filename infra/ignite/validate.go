@@ -0,0 +1,331 @@
+package ignite
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type (
+	// Problem is a single issue found when validating the config.
+	Problem struct {
+		// Path is where the problem is, e.g. "nodes.builder.projects[0].name".
+		Path string `json:"path"`
+		// Message describes the problem.
+		Message string `json:"message"`
+		// Warning is true if the problem doesn't prevent generating configs.
+		Warning bool `json:"warning,omitempty"`
+	}
+	// Problems are all issues found when validating the config.
+	Problems []Problem
+)
+
+// identRE matches keys that can be written as .key in a path.
+var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// jsonPath returns the path to key under prefix, e.g. `nodes.builder` or
+// `project_configs["decenter.world"]`.
+func jsonPath(prefix, key string) string {
+	if identRE.MatchString(key) {
+		return fmt.Sprintf("%s.%s", prefix, key)
+	}
+	return fmt.Sprintf("%s[%q]", prefix, key)
+}
+
+// String returns a human-readable description of the problem.
+func (p Problem) String() string {
+	if p.Warning {
+		return fmt.Sprintf("%s: warning: %s", p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// Errors returns the number of problems that aren't warnings.
+func (ps Problems) Errors() int {
+	n := 0
+	for _, p := range ps {
+		if !p.Warning {
+			n += 1
+		}
+	}
+	return n
+}
+
+// add records an error at path.
+func (ps *Problems) add(path, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// warn records a warning at path.
+func (ps *Problems) warn(path, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// nodeNames returns the names of the node configs in sorted order.
+func (conf NodeConfigs) nodeNames() []nodeName {
+	names := []nodeName{}
+	for name := range conf {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// checksumKey returns the key to look up the file in checksum files.
+func (f NodeFile) checksumKey() string {
+	if f.ChecksumKey != "" {
+		return f.ChecksumKey
+	}
+	return f.Name
+}
+
+// Validate checks the config against units/ and checksums/ and returns
+// all problems found, sorted by path.
+func (g *Generator) Validate(conf Config) Problems {
+	problems := Problems{}
+	conf.Artifacts.validate("artifacts", &problems)
+	conf.Passwd.validate("passwd", &problems)
+	conf.NodeGroups.validate(&problems)
+	conf.WireguardMeshes.validate(&problems)
+	if conf.Serve != nil {
+		if err := conf.Serve.validate(); err != nil {
+			problems.add("serve.url", "%v", err)
+		}
+	}
+	for _, name := range conf.ProjectConfigs.Names() {
+		conf.ProjectConfigs[name].validate(g.fsys, jsonPath("project_configs", string(name)), &problems)
+	}
+	// used is the checksum keys used by each project version, for the archs
+	// of the nodes running it.
+	used := map[ProjectVersion]map[string]bool{}
+	// checked is the set of project versions and archs whose checksums we've looked at.
+	checked := map[pvArch]bool{}
+	// effective is the config of each node with its groups applied, to
+	// find the other members of its WireGuard mesh.
+	effective := map[nodeName]NodeConfig{}
+	for nn := range conf.NodeConfigs {
+		effective[nn], _ = conf.effective(nn)
+	}
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		npath := jsonPath("nodes", string(nn))
+		nc, unknown := conf.effective(nn)
+		for _, gn := range unknown {
+			problems.add(npath+".groups", "unknown group %q", gn)
+		}
+		version, versionErr := nc.getIgnitionVersion()
+		if versionErr != nil {
+			problems.add(npath+".ignition_version", "%v", versionErr)
+		}
+		output, err := nc.getOutput()
+		if err != nil {
+			problems.add(npath+".output", "%v", err)
+		}
+		if output == outputCloudInit {
+			if err := nc.validateCloudInit(); err != nil {
+				problems.add(npath+".storage", "%v", err)
+			}
+		}
+		if err := nc.validateServe(conf.Serve, output); err != nil {
+			problems.add(npath+".serve", "%v", err)
+		}
+		if err := nc.validateProvider(); err != nil {
+			problems.add(npath+".provider", "%v", err)
+		}
+		nc.Passwd.validate(npath+".passwd", &problems)
+		nc.validateNetworkd(g.fsys, npath, newTemplateData(nn, nc, ProjectVersion{}, projectConfig{}), &problems)
+		g.validateWireguard(conf, effective, nn, npath, &problems)
+		if nc.Wireguard != nil && output == outputIgnition && version == ignitionVersionV2 {
+			problems.add(npath+".wireguard", "the private key is owned by group %q, which needs ignition_version 2.1.0 or later", networkdGroup)
+		}
+		refs, err := conf.ProjectConfigs.expand(conf.projectRefs(nn))
+		if err != nil {
+			problems.add(npath+".projects", "%v", err)
+			continue
+		}
+		problems = append(problems, conf.ProjectConfigs.conflicts(refs)...)
+		// units maps the systemd units of the node's projects to the project.
+		units := map[string]ProjectName{}
+		for _, ref := range refs {
+			for _, u := range conf.ProjectConfigs[ref.pv.Name].Units {
+				units[u] = ref.pv.Name
+			}
+		}
+		nc.Storage.validate(npath+".storage", units, &problems)
+		if output == outputIgnition && version == ignitionVersionV2 && (len(nc.Storage.Directories) > 0 || len(nc.Storage.Links) > 0) {
+			problems.add(npath+".storage", "directories and links need ignition_version 2.1.0 or later")
+		}
+		// updatePaths are the paths of the files written by the update policy.
+		updatePaths := map[string]bool{}
+		var updateFiles []file
+		if update := conf.getUpdate(nc, version); update != nil && versionErr == nil && output == outputIgnition {
+			updateFiles, err = update.getFiles(version)
+			if err != nil {
+				problems.add(npath+".update", "%v", err)
+			}
+			for _, f := range updateFiles {
+				updatePaths[f.Path] = true
+			}
+			for _, u := range update.getUnits(version) {
+				if pn, exists := units[u.Name]; exists {
+					problems.add(npath+".update", "unit %s is also a unit of project %q", u.Name, pn)
+				}
+			}
+		}
+		g.validateUnitPaths(conf, nn, nc, refs, updateFiles, &problems)
+		for _, ref := range refs {
+			pv, ppath := ref.pv, ref.path
+			pc, exists := conf.ProjectConfigs[pv.Name]
+			if !exists {
+				problems.add(ppath+".name", "unknown project %q", pv.Name)
+				continue
+			}
+			pc.validateTemplates(
+				g.fsys,
+				jsonPath("project_configs", string(pv.Name)),
+				newTemplateData(nn, nc, pv, pc),
+				&problems,
+			)
+			for _, f := range append(append(NodeFiles{}, pc.Files...), pc.Secrets...) {
+				if updatePaths[f.Path] {
+					problems.add(ppath, "path %q is also written by the update policy", f.Path)
+				}
+			}
+			if checked[pvArch{pv, nc.Arch}] {
+				continue
+			}
+			checked[pvArch{pv, nc.Arch}] = true
+			if used[pv] == nil {
+				used[pv] = map[string]bool{}
+			}
+			pc.validateChecksums(g.fsys, pv, nc.Arch, ppath, used[pv], &problems)
+		}
+	}
+	warnUnusedChecksums(g.fsys, used, &problems)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+	// Problems in projects included by several nodes are found once per node.
+	result := Problems{}
+	seen := map[Problem]bool{}
+	for _, p := range problems {
+		if !seen[p] {
+			result = append(result, p)
+			seen[p] = true
+		}
+	}
+	return result
+}
+
+// validate checks that the units and dropins of the project exist.
+func (pc projectConfig) validate(fsys fs.FS, path string, problems *Problems) {
+	if pc.Artifacts != nil {
+		pc.Artifacts.validate(path+".artifacts", problems)
+	}
+	for i, u := range pc.Units {
+		if _, err := fs.Stat(fsys, fmt.Sprintf("units/%s", u)); err != nil {
+			problems.add(fmt.Sprintf("%s.units[%d]", path, i), "missing unit file units/%s", u)
+		}
+	}
+	for i, d := range pc.Dropins {
+		dpath := fmt.Sprintf("%s.dropins[%d]", path, i)
+		if d.Unit == "" {
+			problems.add(dpath+".unit", "no unit for dropin %q", d.Dropin)
+		}
+		if _, err := fs.Stat(fsys, fmt.Sprintf("units/%s", d.Dropin)); err != nil {
+			problems.add(dpath+".dropin", "missing dropin file units/%s", d.Dropin)
+		}
+	}
+}
+
+// validateTemplates checks that the project's units and dropins render
+// with the data of a node.
+func (pc projectConfig) validateTemplates(fsys fs.FS, path string, data TemplateData, problems *Problems) {
+	for i, u := range pc.Units {
+		b, err := fs.ReadFile(fsys, fmt.Sprintf("units/%s", u))
+		if err != nil {
+			continue
+		}
+		if _, err := data.render(u, string(b)); err != nil {
+			problems.add(fmt.Sprintf("%s.units[%d]", path, i), "%v", err)
+		}
+	}
+	for i, d := range pc.Dropins {
+		b, err := fs.ReadFile(fsys, fmt.Sprintf("units/%s", d.Dropin))
+		if err != nil {
+			continue
+		}
+		if _, err := data.render(d.Dropin, string(b)); err != nil {
+			problems.add(fmt.Sprintf("%s.dropins[%d]", path, i), "%v", err)
+		}
+	}
+}
+
+// pvArch is a project version running on a specific arch.
+type pvArch struct {
+	pv   ProjectVersion
+	arch string
+}
+
+// validateChecksums checks that the project's files and secrets have
+// checksums for the version on arch, recording the keys in used.
+func (pc projectConfig) validateChecksums(fsys fs.FS, pv ProjectVersion, arch, path string, used map[string]bool, problems *Problems) {
+	checksumFile := fmt.Sprintf("checksums/%s_%s.sha512", pv.Name, pv.Version)
+	sums, err := pv.getChecksums(fsys)
+	if err != nil {
+		problems.add(path+".version", "%v", err)
+		return
+	}
+	for i, f := range pc.Files {
+		fpath := fmt.Sprintf("%s.files[%d]", jsonPath("project_configs", string(pv.Name)), i)
+		name, key, err := f.resolve(pv, arch, sums)
+		if err != nil {
+			problems.add(fpath, "%v", err)
+			continue
+		}
+		if name == f.Name && arch != "" && len(f.Arch) == 0 && !f.ArchIndependent {
+			problems.warn(fpath, "no %q artifact for arch %q, so %q is used; mark the file arch_independent if it runs on any arch", f.Name+"_"+arch, arch, f.Name)
+		}
+		used[key] = true
+	}
+	for i, s := range pc.Secrets {
+		key := s.checksumKey()
+		used[key] = true
+		if _, exists := sums[key]; !exists {
+			problems.add(
+				fmt.Sprintf("%s.secrets[%d]", jsonPath("project_configs", string(pv.Name)), i),
+				"no checksum for secret %q in %s",
+				key,
+				checksumFile,
+			)
+		}
+	}
+}
+
+// warnUnusedChecksums records warnings for checksums of the project
+// versions that no file or secret uses.
+func warnUnusedChecksums(fsys fs.FS, used map[ProjectVersion]map[string]bool, problems *Problems) {
+	for pv, keys := range used {
+		sums, err := pv.getChecksums(fsys)
+		if err != nil {
+			continue
+		}
+		unused := []string{}
+		for key := range sums {
+			if !keys[key] {
+				unused = append(unused, key)
+			}
+		}
+		sort.Strings(unused)
+		if len(unused) > 0 {
+			problems.warn(
+				fmt.Sprintf("checksums/%s_%s.sha512", pv.Name, pv.Version),
+				"unused checksums for %s",
+				strings.Join(unused, ", "),
+			)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package ignite
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// validateCase is a config.json to validate, and the problems it should have.
+type validateCase struct {
+	desc string
+	conf string
+	// fsys are the inputs, defaulting to newTestFS(conf).
+	fsys fstest.MapFS
+	// files are added to the inputs, or removed from them if nil.
+	files map[string]*fstest.MapFile
+	// want are the problems, as by Problem.String.
+	want []string
+}
+
+// run validates the config of the case, reporting problems that aren't
+// the ones wanted.
+func (tt validateCase) run(t *testing.T) {
+	t.Helper()
+	fsys := tt.fsys
+	if fsys == nil {
+		fsys = newTestFS(tt.conf)
+	}
+	fsys["config.json"] = &fstest.MapFile{Data: []byte(tt.conf)}
+	for name, f := range tt.files {
+		if f == nil {
+			delete(fsys, name)
+			continue
+		}
+		fsys[name] = f
+	}
+	g := NewGenerator(fsys, mapSink{})
+	_, problems, err := g.ValidateConfig()
+	if err != nil {
+		t.Fatalf("%s: ValidateConfig() returned error: %v", tt.desc, err)
+	}
+	got := []string{}
+	for _, p := range problems {
+		got = append(got, p.String())
+	}
+	if !reflect.DeepEqual(got, tt.want) {
+		t.Errorf("%s: ValidateConfig() got problems\n%s\nwant\n%s", tt.desc, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	served := strings.Replace(testConfig, `"arch": "x86_64",`, `"arch": "x86_64",
+			"serve": true,`, 1)
+	cases := []validateCase{
+		{
+			desc: "valid",
+			conf: testConfig,
+			want: []string{},
+		},
+		{
+			desc: "unknown project and missing unit",
+			conf: strings.NewReplacer(
+				`"units": ["tclient.service"]`, `"units": ["tclient.service", "missing.service"]`,
+				`{"name": "bitcoin", "version": "0.0.15"}`, `{"name": "bitcoin", "version": "0.0.15"}, {"name": "nope", "version": "1"}`,
+			).Replace(testConfig),
+			want: []string{
+				`nodes.core.projects[2].name: unknown project "nope"`,
+				`project_configs.hkjninfra.units[1]: missing unit file units/missing.service`,
+			},
+		},
+		{
+			desc: "unsupported ignition version",
+			conf: strings.Replace(testConfig, `"3.0.0"`, `"4.0.0"`, 1),
+			want: []string{
+				`nodes.arm.ignition_version: unsupported ignition_version "4.0.0"`,
+			},
+		},
+		{
+			desc: "dropin without unit or file",
+			conf: strings.Replace(testConfig, `{"unit": "docker.service", "dropin": "10_override_storage.conf"}`, `{"dropin": "20_missing.conf"}`, 1),
+			want: []string{
+				`project_configs.bitcoin.dropins[0].dropin: missing dropin file units/20_missing.conf`,
+				`project_configs.bitcoin.dropins[0].unit: no unit for dropin "20_missing.conf"`,
+			},
+		},
+		{
+			desc: "missing checksums",
+			conf: strings.Replace(testConfig, `{"name": "hkjninfra", "version": "1.5.13"}]`, `{"name": "hkjninfra", "version": "1.5.14"}]`, 1),
+			want: []string{
+				`checksums/hkjninfra_1.5.13.sha512: warning: unused checksums for tclient_armv7l`,
+				`nodes.arm.projects[0].version: unable to read checksums for "hkjninfra" version "1.5.14": open checksums/hkjninfra_1.5.14.sha512: file does not exist`,
+			},
+		},
+		{
+			desc: "missing secret checksum and unused checksums",
+			conf: testConfig,
+			files: map[string]*fstest.MapFile{
+				"checksums/hkjninfra_1.5.13.sha512": {Data: []byte("aaa  tclient_armv7l\nbbb  tclient_x86_64\nccc  gather_facts\neee  old_tool\n")},
+			},
+			want: []string{
+				`checksums/hkjninfra_1.5.13.sha512: warning: unused checksums for old_tool`,
+				`project_configs.hkjninfra.secrets[0]: no checksum for secret "client.pem" in checksums/hkjninfra_1.5.13.sha512`,
+			},
+		},
+		{
+			desc: "bad ssh key and duplicate user",
+			conf: strings.Replace(testConfig, `"nodes": {`, `"passwd": {
+		"users": [
+			{"name": "core", "ssh_authorized_keys": ["AAAAC3NzaC1lZDI1NTE5"]},
+			{"name": "core"}
+		]
+	},
+	"nodes": {`, 1),
+			want: []string{
+				`passwd.users[0].ssh_authorized_keys[0]: doesn't look like an SSH public key`,
+				`passwd.users[1].name: user "core" is declared more than once`,
+			},
+		},
+		{
+			desc: "bad networkd units",
+			conf: strings.Replace(testConfig, `"arch": "armv7l",`, `"arch": "armv7l",
+			"networkd": [
+				{"name": "wg0.conf", "contents": "[NetDev]\n"},
+				{"name": "10-static.network"}
+			],`, 1),
+			want: []string{
+				`nodes.arm.networkd[0].name: networkd unit "wg0.conf" doesn't end in .network, .netdev, .link`,
+				`nodes.arm.networkd[1]: missing networkd file networkd/10-static.network`,
+			},
+		},
+		{
+			desc: "storage needing a later ignition version, and a clashing mount unit",
+			conf: strings.NewReplacer(
+				`"units": ["tclient.service"]`, `"units": ["tclient.service", "containers.mount"]`,
+				`"arch": "x86_64",`, `"arch": "x86_64",`+testStorage,
+			).Replace(testConfig),
+			files: map[string]*fstest.MapFile{
+				"units/containers.mount": {Data: []byte("[Mount]\n")},
+			},
+			want: []string{
+				`nodes.core.storage: directories and links need ignition_version 2.1.0 or later`,
+				`nodes.core.storage.filesystems[0].path: mount unit containers.mount is also a unit of project "hkjninfra"`,
+			},
+		},
+		{
+			desc: "include at two versions",
+			conf: strings.Replace(withBase(testConfig), `"dropins": [`, `"includes": [{"name": "base", "version": "2.0"}],
+			"units": ["tclient.service"],
+			"dropins": [`, 1),
+			files: map[string]*fstest.MapFile{
+				"checksums/base_1.0.sha512": {Data: []byte("")},
+			},
+			// core is skipped after the error, so its checksums are unused.
+			want: []string{
+				`checksums/hkjninfra_1.5.13.sha512: warning: unused checksums for tclient_x86_64`,
+				`nodes.core.projects: project "base" would run at both version "1.0" and "2.0"`,
+			},
+		},
+		{
+			desc: "unit delivered by an include too",
+			conf: strings.Replace(withBase(testConfig), `"dropins": [`, `"includes": [{"name": "base", "version": "1.0"}],
+			"units": ["tclient.service"],
+			"dropins": [`, 1),
+			files: map[string]*fstest.MapFile{
+				"checksums/base_1.0.sha512": {Data: []byte("")},
+			},
+			want: []string{
+				`nodes.core.projects[1]: unit "tclient.service" is also delivered by project "base"`,
+			},
+		},
+		{
+			desc: "unknown and nested groups",
+			conf: strings.NewReplacer(
+				`"nodes": {`, `"node_groups": {"infra": {"groups": ["other"]}},
+	"nodes": {`,
+				`"arch": "x86_64",`, `"arch": "x86_64",
+			"groups": ["infra", "nope"],`,
+			).Replace(testConfig),
+			want: []string{
+				`node_groups.infra.groups: groups can't join other groups`,
+				`nodes.core.groups: unknown group "nope"`,
+			},
+		},
+		{
+			desc: "unit running an undelivered binary",
+			conf: strings.Replace(testConfig, `{"name": "tclient", "path": "/opt/bin/tclient"}`, `{"name": "tclient", "path": "/opt/bin/tclient2"}`, 1),
+			want: []string{
+				`project_configs.hkjninfra.units[0]: warning: on node "arm": tclient.service runs /opt/bin/tclient, which the node doesn't deliver`,
+				`project_configs.hkjninfra.units[0]: warning: on node "core": tclient.service runs /opt/bin/tclient, which the node doesn't deliver`,
+			},
+		},
+		{
+			desc: "partitions with cloud-init, and unknown output",
+			conf: strings.NewReplacer(
+				`"ignition_version": "3.0.0",`, `"output": "cloudinit",`,
+				`"arch": "x86_64",`, `"arch": "x86_64",
+			"output": "cloud-init",
+			"storage": {"disks": [{"device": "/dev/sdb", "partitions": [{"label": "data"}]}]},`,
+			).Replace(testConfig),
+			want: []string{
+				`nodes.arm.output: unsupported output "cloudinit", want "ignition" or "cloud-init"`,
+				`nodes.core.storage: disks can't be partitioned with output "cloud-init"`,
+			},
+		},
+		{
+			desc: "unknown provider",
+			conf: strings.Replace(testConfig, `"arch": "x86_64",`, `"arch": "x86_64",
+			"provider": "aws",`, 1),
+			want: []string{
+				`nodes.core.provider: unknown provider "aws"`,
+			},
+		},
+		{
+			desc: "served node without serve url",
+			conf: served,
+			want: []string{
+				`nodes.core.serve: node is served, but there's no serve url in config.json`,
+			},
+		},
+		{
+			desc: "serve url without https",
+			conf: strings.Replace(served, `"nodes": {`, `"serve": {"url": "http://ignite.example.com"},
+	"nodes": {`, 1),
+			want: []string{
+				`serve.url: url "http://ignite.example.com" must be https, since it includes the tokens of nodes`,
+			},
+		},
+		{
+			desc: "bad wireguard meshes and members",
+			conf: strings.NewReplacer(
+				`"address": "10.8.0.2/24"`, `"address": "10.8.0.1/24"`,
+				`"ignition_version": "2.1.0",`, ``,
+				`"wireguard_meshes": {"wg0": {"persistent_keepalive": 25}},`, `"wireguard_meshes": {
+		"wg0": {"persistent_keepalive": 25},
+		"wg1": {"interface": "a-very-long-interface", "port": 70000}
+	},`,
+			).Replace(wireguardConfig),
+			fsys: newWireguardFS(t),
+			files: map[string]*fstest.MapFile{
+				PublicKeyFile("wg0", "arm"):      nil,
+				"checksums/wireguard_wg0.sha512": {Data: []byte(WireguardKey{Node: "arm"}.ChecksumLine())},
+			},
+			want: []string{
+				`nodes.arm.wireguard: no public key for node "arm" in wireguard mesh "wg0", generate keys with "ignite wireguard": open wireguard/wg0/arm.pub: file does not exist`,
+				`nodes.arm.wireguard.address: address 10.8.0.1 is also used by node "core" in mesh "wg0"`,
+				`nodes.core.wireguard: missing checksum for private key "core.key" in checksums/wireguard_wg0.sha512`,
+				`nodes.core.wireguard: the private key is owned by group "systemd-network", which needs ignition_version 2.1.0 or later`,
+				`nodes.core.wireguard.address: address 10.8.0.1 is also used by node "arm" in mesh "wg0"`,
+				`wireguard_meshes.wg1.interface: invalid interface name "a-very-long-interface"`,
+				`wireguard_meshes.wg1.port: invalid port 70000`,
+			},
+		},
+		{
+			desc: "locksmithd delivered by a project too",
+			conf: strings.Replace(testConfig, `"units": ["tclient.service"]`, `"units": ["tclient.service", "locksmithd.service"]`, 1),
+			files: map[string]*fstest.MapFile{
+				"units/locksmithd.service": {Data: []byte("[Service]\n")},
+			},
+			want: []string{
+				`nodes.core.update: unit locksmithd.service is also a unit of project "hkjninfra"`,
+			},
+		},
+		{
+			desc: "file falling back to its name on each arch",
+			conf: strings.Replace(testConfig, `, "arch_independent": true`, ``, 1),
+			want: []string{
+				`project_configs.hkjninfra.files[0]: warning: no "gather_facts_armv7l" artifact for arch "armv7l", so "gather_facts" is used; mark the file arch_independent if it runs on any arch`,
+				`project_configs.hkjninfra.files[0]: warning: no "gather_facts_x86_64" artifact for arch "x86_64", so "gather_facts" is used; mark the file arch_independent if it runs on any arch`,
+			},
+		},
+		{
+			desc: "checksum keys per arch, and with an arch mapping",
+			conf: strings.NewReplacer(
+				`"arch_independent": true`, `"arch": {"armv7l": "gather_facts", "x86_64": "gather_facts"}, "checksum_key": "gf"`,
+				`{"name": "tclient", "path": "/opt/bin/tclient"}`, `{"name": "tclient", "path": "/opt/bin/tclient", "checksum_key": "tc"}`,
+			).Replace(testConfig),
+			files: map[string]*fstest.MapFile{
+				"checksums/hkjninfra_1.5.13.sha512": {Data: []byte("aaa  tc_armv7l\nbbb  tc_x86_64\nccc  gather_facts\nddd  client.pem\n")},
+			},
+			want: []string{
+				`checksums/hkjninfra_1.5.13.sha512: warning: unused checksums for gather_facts`,
+				`project_configs.hkjninfra.files[0]: file "gather_facts" can't have both an arch mapping and a checksum_key, since its artifacts are checksummed by their mapped names`,
+			},
+		},
+	}
+	for _, tt := range cases {
+		tt.run(t)
+	}
+}
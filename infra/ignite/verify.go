@@ -0,0 +1,240 @@
+package ignite
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+type (
+	// SourceCheck is the result of checking a source of a generated
+	// config against its hash.
+	SourceCheck struct {
+		// Path is the path of the file on the node, or "ignition.config.replace"
+		// for the config a stub points at.
+		Path string `json:"path"`
+		// Source is the URL of the contents.
+		Source string `json:"source"`
+		// Hash is the hash the contents must have, if any.
+		Hash string `json:"hash,omitempty"`
+		// Error is why the check failed, if it did.
+		Error string `json:"error,omitempty"`
+	}
+	// NodeCheck is the result of verifying the generated config of a node.
+	NodeCheck struct {
+		// Node is the name of the node.
+		Node string `json:"node"`
+		// Role is "stub" for the bootstrap config of a served node, and
+		// "served" for the config it's served, or "" for other nodes.
+		Role string `json:"role,omitempty"`
+		// File is the config checked, e.g. "bootstrap/core.json".
+		File string `json:"file"`
+		// OK is true if the config parsed and all its sources checked out.
+		OK bool `json:"ok"`
+		// Sources are the checks of the sources of the config.
+		Sources []SourceCheck `json:"sources"`
+		// Error is why the config couldn't be checked, if it couldn't.
+		Error string `json:"error,omitempty"`
+	}
+	// NodeChecks are the results of verifying the configs of all nodes.
+	NodeChecks []NodeCheck
+)
+
+// replacePath is the Path of the SourceCheck of a stub's replace source.
+const replacePath = "ignition.config.replace"
+
+// decodeDataURL returns the contents of a data URL, as in RFC 2397.
+func decodeDataURL(u string) ([]byte, error) {
+	i := strings.Index(u, ",")
+	if !strings.HasPrefix(u, "data:") || i < 0 {
+		return nil, fmt.Errorf("invalid data URL")
+	}
+	header, data := u[len("data:"):i], u[i+1:]
+	if strings.HasSuffix(header, ";base64") {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	s, err := url.PathUnescape(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data URL: %v", err)
+	}
+	return []byte(s), nil
+}
+
+// sources returns the checks to make of the sources of the config,
+// without results, sorted by path.
+func (o Output) sources() []SourceCheck {
+	result := []SourceCheck{}
+	var replace *fileContents
+	if o.V3 != nil {
+		if r := o.V3.Ignition.Config; r != nil && r.Replace != nil {
+			replace = &fileContents{Source: r.Replace.Source, Verification: fileVerification{Hash: r.Replace.Verification.Hash}}
+		}
+	} else {
+		replace = o.V2.Ignition.Config.Replace
+	}
+	if replace != nil {
+		result = append(result, SourceCheck{Path: replacePath, Source: replace.Source, Hash: replace.Verification.Hash})
+	}
+	files := o.state().files
+	paths := []string{}
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if files[p].source == "" {
+			continue
+		}
+		result = append(result, SourceCheck{Path: p, Source: files[p].source, Hash: files[p].hash})
+	}
+	return result
+}
+
+// Verify checks the generated configs in dir of the generator's fs.FS,
+// e.g. "bootstrap", and those under ServedDir in it, by fetching every
+// source in them with f and comparing the contents to their hashes.
+//
+// Only the configs of the named nodes are checked, if any are given.
+// cloud-init configs aren't checked, since their files are only fetched
+// by their runcmd.
+func (g *Generator) Verify(f *Fetcher, dir string, names ...string) (NodeChecks, error) {
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	files := []string{}
+	for _, d := range []string{dir, path.Join(dir, ServedDir)} {
+		matches, err := fs.Glob(g.fsys, path.Join(d, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	// served are the nodes with a served config.
+	served := map[string]bool{}
+	for _, p := range files {
+		if path.Dir(p) == path.Join(dir, ServedDir) {
+			served[strings.TrimSuffix(path.Base(p), ".json")] = true
+		}
+	}
+	result := NodeChecks{}
+	found := map[string]bool{}
+	urls := map[string]bool{}
+	for _, p := range files {
+		name := strings.TrimSuffix(path.Base(p), ".json")
+		if len(wanted) > 0 && !wanted[name] {
+			continue
+		}
+		found[name] = true
+		check := NodeCheck{Node: name, File: p, Sources: []SourceCheck{}}
+		if path.Dir(p) == path.Join(dir, ServedDir) {
+			check.Role = "served"
+		} else if served[name] {
+			check.Role = "stub"
+		}
+		data, err := fs.ReadFile(g.fsys, p)
+		if err != nil {
+			return nil, err
+		}
+		o, err := ParseOutput(name, data)
+		if err != nil {
+			check.Error = err.Error()
+			result = append(result, check)
+			continue
+		}
+		check.Sources = o.sources()
+		for _, s := range check.Sources {
+			if !strings.HasPrefix(s.Source, "data:") {
+				urls[s.Source] = true
+			}
+		}
+		result = append(result, check)
+	}
+	for _, name := range names {
+		if !found[name] {
+			return nil, fmt.Errorf("no config for node %q in %s", name, dir)
+		}
+	}
+
+	reqs := []FetchRequest{}
+	for u := range urls {
+		reqs = append(reqs, FetchRequest{URL: u})
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].URL < reqs[j].URL })
+	fetched := map[string]FetchResult{}
+	for _, r := range f.FetchAll(reqs) {
+		fetched[r.URL] = r
+	}
+	for i := range result {
+		c := &result[i]
+		for j := range c.Sources {
+			s := &c.Sources[j]
+			var data []byte
+			var err error
+			switch u, perr := url.Parse(s.Source); {
+			case strings.HasPrefix(s.Source, "data:"):
+				data, err = decodeDataURL(s.Source)
+			case perr != nil:
+				err = perr
+			case u.Scheme != "http" && u.Scheme != "https":
+				err = fmt.Errorf("unsupported scheme %q", u.Scheme)
+			default:
+				data, err = fetched[s.Source].Data, fetched[s.Source].Err
+			}
+			if err == nil {
+				err = checkHash(data, s.Hash)
+			}
+			if err != nil {
+				s.Error = err.Error()
+			}
+		}
+		c.OK = c.Error == ""
+		for _, s := range c.Sources {
+			if s.Error != "" {
+				c.OK = false
+			}
+		}
+	}
+	return result, nil
+}
+
+// OK returns true if all configs checked out.
+func (cs NodeChecks) OK() bool {
+	for _, c := range cs {
+		if !c.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// label returns the name of the node, with the role of the config if
+// it's served, e.g. "core (stub)".
+func (c NodeCheck) label() string {
+	if c.Role == "" {
+		return c.Node
+	}
+	return fmt.Sprintf("%s (%s)", c.Node, c.Role)
+}
+
+// String returns a human-readable description of the check.
+func (c NodeCheck) String() string {
+	if c.Error != "" {
+		return fmt.Sprintf("FAIL %s (%s): %s", c.label(), c.File, c.Error)
+	}
+	failed := []string{}
+	for _, s := range c.Sources {
+		if s.Error != "" {
+			failed = append(failed, fmt.Sprintf("  %s: %s", s.Path, s.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return fmt.Sprintf("ok   %s (%s): %d sources match", c.label(), c.File, len(c.Sources))
+	}
+	lines := []string{fmt.Sprintf("FAIL %s (%s): %d of %d sources failed", c.label(), c.File, len(failed), len(c.Sources))}
+	return strings.Join(append(lines, failed...), "\n")
+}
@@ -0,0 +1,83 @@
+package ignite
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestVerify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tclient", "/tampered":
+			fmt.Fprint(w, "tclient")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	hash := fmt.Sprintf("sha512-%x", sha512.Sum512([]byte("tclient")))
+	dataHash := fmt.Sprintf("sha512-%x", sha512.Sum512([]byte("GROUP=beta\n")))
+	good := fmt.Sprintf(`{"ignition": {"version": "2.0.0"}, "storage": {"files": [
+		{"path": "/opt/bin/tclient", "contents": {"source": "%s/tclient", "verification": {"hash": "%s"}}},
+		{"path": "/etc/coreos/update.conf", "contents": {"source": "data:,GROUP%%3Dbeta%%0A", "verification": {"hash": "%s"}}},
+		{"path": "/etc/motd", "contents": {"source": "data:text/plain;base64,aGk=", "verification": {}}}
+	]}}`, srv.URL, hash, dataHash)
+	bad := fmt.Sprintf(`{"ignition": {"version": "3.0.0"}, "storage": {"files": [
+		{"path": "/opt/bin/tclient", "contents": {"source": "%s/tampered", "verification": {"hash": "sha512-abc"}}},
+		{"path": "/opt/bin/gone", "contents": {"source": "%s/gone", "verification": {}}}
+	]}}`, srv.URL, srv.URL)
+	fsys := fstest.MapFS{
+		"bootstrap/arm.json":        {Data: []byte(good)},
+		"bootstrap/core.json":       {Data: []byte(bad)},
+		"bootstrap/broken.json":     {Data: []byte("{")},
+		"bootstrap/scw1.yaml":       {Data: []byte("#cloud-config\n")},
+		"bootstrap/served/arm.json": {Data: []byte(good)},
+	}
+	g := NewGenerator(fsys, mapSink{})
+	checks, err := g.Verify(NewFetcher(""), "bootstrap")
+	if err != nil {
+		t.Fatalf("Verify() returned error: %v", err)
+	}
+	got := []string{}
+	for _, c := range checks {
+		got = append(got, fmt.Sprintf("%s %s %v", c.label(), c.File, c.OK))
+	}
+	want := []string{
+		"arm (stub) bootstrap/arm.json true",
+		"broken bootstrap/broken.json false",
+		"core bootstrap/core.json false",
+		"arm (served) bootstrap/served/arm.json true",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Verify() got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if checks.OK() {
+		t.Errorf("OK() = true, want false")
+	}
+	if n := len(checks[0].Sources); n != 3 {
+		t.Errorf("Verify() checked %d sources of arm, want 3", n)
+	}
+	core := checks[2].String()
+	for _, want := range []string{"FAIL core (bootstrap/core.json): 2 of 2 sources failed", "/opt/bin/gone: unexpected status code", "/opt/bin/tclient: got hash sha512-"} {
+		if !strings.Contains(core, want) {
+			t.Errorf("Verify() got core result\n%s\nwant it to contain %q", core, want)
+		}
+	}
+
+	checks, err = g.Verify(NewFetcher(""), "bootstrap", "arm")
+	if err != nil {
+		t.Fatalf("Verify(arm) returned error: %v", err)
+	}
+	if len(checks) != 2 || !checks.OK() {
+		t.Errorf("Verify(arm) = %+v, want two passing configs", checks)
+	}
+	if _, err := g.Verify(NewFetcher(""), "bootstrap", "nope"); err == nil {
+		t.Errorf("Verify(nope) succeeded")
+	}
+}
@@ -0,0 +1,382 @@
+package ignite
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+type (
+	// WireguardMesh is a WireGuard network in which every member node
+	// peers with every other one.
+	WireguardMesh struct {
+		// Interface is the name of the interface on the nodes, defaulting
+		// to the name of the mesh.
+		Interface string `json:"interface,omitempty"`
+		// Port is the UDP port the nodes listen on, defaulting to 51820.
+		Port int `json:"port,omitempty"`
+		// PersistentKeepalive is the seconds between keepalives sent to
+		// peers, for nodes behind NAT, or 0 for none.
+		PersistentKeepalive int `json:"persistent_keepalive,omitempty"`
+	}
+	// WireguardMeshes are the WireGuard meshes by name, e.g. "wg0".
+	WireguardMeshes map[string]WireguardMesh
+	// NodeWireguard is the membership of a node in a WireGuard mesh.
+	NodeWireguard struct {
+		// Mesh is the name of the mesh in wireguard_meshes.
+		Mesh string `json:"mesh"`
+		// Address is the address of the node in the mesh, with the prefix
+		// of the mesh network, e.g. "10.8.0.2/24".
+		Address string `json:"address"`
+		// Endpoint is the host and optional port where peers reach the
+		// node, e.g. "core.hkjn.me". Nodes without one only connect out.
+		Endpoint string `json:"endpoint,omitempty"`
+	}
+	// WireguardKey is a new keypair of a node in a WireGuard mesh.
+	WireguardKey struct {
+		// Mesh is the name of the mesh.
+		Mesh string
+		// Node is the name of the node.
+		Node string
+		// Private is the private key, as written by "wg genkey".
+		Private string
+		// Public is the public key, as written by "wg pubkey".
+		Public string
+	}
+	// meshPeer is another member of a node's mesh.
+	meshPeer struct {
+		name      nodeName
+		publicKey string
+		allowedIP string
+		endpoint  string
+	}
+)
+
+const (
+	// defaultWireguardPort is the port nodes listen on unless the mesh sets one.
+	defaultWireguardPort = 51820
+	// wireguardProject is the project secret service URLs and checksum
+	// files of private keys are under, with the mesh as version, e.g.
+	// "checksums/wireguard_wg0.sha512".
+	wireguardProject = ProjectName("wireguard")
+	// wireguardKeyDir is where private keys are written on nodes.
+	wireguardKeyDir = "/etc/wireguard"
+	// networkdGroup is the group systemd-networkd reads private keys as.
+	networkdGroup = "systemd-network"
+)
+
+// PublicKeyFile returns the path of the public key of the named node in
+// the mesh, e.g. "wireguard/wg0/core.pub".
+func PublicKeyFile(mesh, name string) string {
+	return path.Join("wireguard", mesh, name+".pub")
+}
+
+// MeshVersion returns the project version the private keys of the mesh
+// are kept under by the secret service and in checksums/.
+func MeshVersion(mesh string) ProjectVersion {
+	return ProjectVersion{Name: wireguardProject, Version: Version(mesh)}
+}
+
+// PrivateKeyName returns the name of the secret holding the private key
+// of the named node.
+func PrivateKeyName(name string) string {
+	return name + ".key"
+}
+
+// NewWireguardKey returns a new private key and its public key, encoded
+// as by "wg genkey" and "wg pubkey".
+func NewWireguardKey() (string, string, error) {
+	var private [curve25519.ScalarSize]byte
+	if _, err := rand.Read(private[:]); err != nil {
+		return "", "", err
+	}
+	// Clamp the key, as "wg genkey" does.
+	private[0] &= 248
+	private[31] = (private[31] & 127) | 64
+	public, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private[:]), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// NewWireguardKeys returns new keypairs for the members of the meshes of
+// conf that have no public key in the generator's fs.FS, in sorted order.
+func (g *Generator) NewWireguardKeys(conf Config) ([]WireguardKey, error) {
+	result := []WireguardKey{}
+	for _, nn := range conf.NodeConfigs.nodeNames() {
+		w := conf.NodeConfigs[nn].Wireguard
+		if w == nil {
+			continue
+		}
+		if _, err := conf.WireguardMeshes.get(w.Mesh); err != nil {
+			return nil, fmt.Errorf("node %q: %v", nn, err)
+		}
+		if _, err := fs.Stat(g.fsys, PublicKeyFile(w.Mesh, string(nn))); err == nil {
+			continue
+		}
+		private, public, err := NewWireguardKey()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, WireguardKey{Mesh: w.Mesh, Node: string(nn), Private: private, Public: public})
+	}
+	return result, nil
+}
+
+// PrivateKeyData returns the contents of the secret holding the private key.
+func (k WireguardKey) PrivateKeyData() []byte {
+	return []byte(k.Private + "\n")
+}
+
+// ChecksumLine returns the line of the private key in the checksum file
+// of the mesh.
+func (k WireguardKey) ChecksumLine() string {
+	return checksumLine(PrivateKeyName(k.Node), k.PrivateKeyData())
+}
+
+// checkPublicKey checks that key is a base64-encoded curve25519 public key.
+func checkPublicKey(key string) error {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != curve25519.PointSize {
+		return fmt.Errorf("invalid public key %q", key)
+	}
+	return nil
+}
+
+// get returns the named mesh, with defaults applied.
+func (ms WireguardMeshes) get(name string) (WireguardMesh, error) {
+	m, exists := ms[name]
+	if !exists {
+		return m, fmt.Errorf("unknown wireguard mesh %q", name)
+	}
+	if m.Interface == "" {
+		m.Interface = name
+	}
+	if m.Port == 0 {
+		m.Port = defaultWireguardPort
+	}
+	return m, nil
+}
+
+// validate checks the meshes, adding any problems found.
+func (ms WireguardMeshes) validate(problems *Problems) {
+	for name := range ms {
+		m, _ := ms.get(name)
+		mpath := jsonPath("wireguard_meshes", name)
+		if len(m.Interface) > 15 || strings.ContainsAny(m.Interface, "/ ") {
+			problems.add(mpath+".interface", "invalid interface name %q", m.Interface)
+		}
+		if m.Port < 1 || m.Port > 65535 {
+			problems.add(mpath+".port", "invalid port %d", m.Port)
+		}
+	}
+}
+
+// keyPath returns the path of the private key on members of the mesh.
+func (m WireguardMesh) keyPath() string {
+	return path.Join(wireguardKeyDir, m.Interface+".key")
+}
+
+// unitNames returns the names of the networkd .netdev and .network units
+// of the interface on members of the mesh.
+func (m WireguardMesh) unitNames() (string, string) {
+	return fmt.Sprintf("50-%s.netdev", m.Interface), fmt.Sprintf("50-%s.network", m.Interface)
+}
+
+// allowedIP returns the single address of the node's mesh address, e.g.
+// "10.8.0.2/32" for "10.8.0.2/24".
+func (w NodeWireguard) allowedIP() (string, error) {
+	ip, _, err := net.ParseCIDR(w.Address)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q, want an address with prefix like \"10.8.0.2/24\"", w.Address)
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// endpoint returns the endpoint of the node, with the mesh port if it
+// doesn't name one.
+func (w NodeWireguard) endpoint(m WireguardMesh) string {
+	if w.Endpoint == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(w.Endpoint); err == nil {
+		return w.Endpoint
+	}
+	return net.JoinHostPort(strings.Trim(w.Endpoint, "[]"), fmt.Sprintf("%d", m.Port))
+}
+
+// meshMembers returns the names of the nodes in the mesh, in sorted order.
+func meshMembers(configs map[nodeName]NodeConfig, mesh string) []nodeName {
+	result := []nodeName{}
+	for nn, nc := range configs {
+		if nc.Wireguard != nil && nc.Wireguard.Mesh == mesh {
+			result = append(result, nn)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// readPublicKey returns the public key of the named node in the mesh, from fsys.
+func readPublicKey(fsys fs.FS, mesh string, name nodeName) (string, error) {
+	b, err := fs.ReadFile(fsys, PublicKeyFile(mesh, string(name)))
+	if err != nil {
+		return "", fmt.Errorf("no public key for node %q in wireguard mesh %q, generate keys with \"ignite wireguard\": %v", name, mesh, err)
+	}
+	key := strings.TrimSpace(string(b))
+	if err := checkPublicKey(key); err != nil {
+		return "", fmt.Errorf("%s: %v", PublicKeyFile(mesh, string(name)), err)
+	}
+	return key, nil
+}
+
+// getPeers returns the other members of the node's mesh.
+func (conf Config) getPeers(fsys fs.FS, name nodeName, m WireguardMesh) ([]meshPeer, error) {
+	result := []meshPeer{}
+	mesh := conf.NodeConfigs[name].Wireguard.Mesh
+	for _, nn := range meshMembers(conf.NodeConfigs, mesh) {
+		if nn == name {
+			continue
+		}
+		w := conf.NodeConfigs[nn].Wireguard
+		key, err := readPublicKey(fsys, mesh, nn)
+		if err != nil {
+			return nil, err
+		}
+		allowedIP, err := w.allowedIP()
+		if err != nil {
+			return nil, fmt.Errorf("peer %q: %v", nn, err)
+		}
+		result = append(result, meshPeer{name: nn, publicKey: key, allowedIP: allowedIP, endpoint: w.endpoint(m)})
+	}
+	return result, nil
+}
+
+// getWireguard returns the networkd units of the node's mesh interface,
+// and the secret holding its private key, verified against the checksums
+// of the mesh.
+func (g *Generator) getWireguard(conf Config, name nodeName) ([]networkdUnit, *binary, error) {
+	w := conf.NodeConfigs[name].Wireguard
+	if w == nil {
+		return nil, nil, nil
+	}
+	m, err := conf.WireguardMeshes.get(w.Mesh)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := w.allowedIP(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := readPublicKey(g.fsys, w.Mesh, name); err != nil {
+		return nil, nil, err
+	}
+	peers, err := conf.getPeers(g.fsys, name, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	pv := MeshVersion(w.Mesh)
+	sums, err := pv.getChecksums(g.fsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyName := PrivateKeyName(string(name))
+	checksum, exists := sums[keyName]
+	if !exists {
+		return nil, nil, fmt.Errorf("missing checksum for private key %q in %s", keyName, pv.ChecksumFile())
+	}
+	if g.SecretServiceHash == "" || conf.SecretServiceDomain == "" {
+		return nil, nil, fmt.Errorf("node is in wireguard mesh %q, but no secret service hash or secretservice_domain was given", w.Mesh)
+	}
+	keyPath := m.keyPath()
+	key := &binary{
+		url:      Secret{Name: keyName}.GetURL(conf.SecretServiceDomain, g.SecretServiceHash, pv),
+		checksum: checksum,
+		path:     keyPath,
+		mode:     0640,
+		group:    &Owner{Name: networkdGroup},
+	}
+
+	netdev := []string{
+		"[NetDev]",
+		"Name=" + m.Interface,
+		"Kind=wireguard",
+		fmt.Sprintf("Description=WireGuard mesh %s", w.Mesh),
+		"",
+		"[WireGuard]",
+		"PrivateKeyFile=" + keyPath,
+		fmt.Sprintf("ListenPort=%d", m.Port),
+	}
+	for _, p := range peers {
+		netdev = append(netdev,
+			"",
+			"[WireGuardPeer]",
+			fmt.Sprintf("# %s", p.name),
+			"PublicKey="+p.publicKey,
+			"AllowedIPs="+p.allowedIP,
+		)
+		if p.endpoint != "" {
+			netdev = append(netdev, "Endpoint="+p.endpoint)
+		}
+		if m.PersistentKeepalive > 0 {
+			netdev = append(netdev, fmt.Sprintf("PersistentKeepalive=%d", m.PersistentKeepalive))
+		}
+	}
+	network := []string{
+		"[Match]",
+		"Name=" + m.Interface,
+		"",
+		"[Network]",
+		"Address=" + w.Address,
+	}
+	netdevName, networkName := m.unitNames()
+	units := []networkdUnit{
+		{Name: netdevName, Contents: strings.Join(netdev, "\n") + "\n"},
+		{Name: networkName, Contents: strings.Join(network, "\n") + "\n"},
+	}
+	return units, key, nil
+}
+
+// validateWireguard checks the node's membership of its mesh, adding any
+// problems found at npath.
+func (g *Generator) validateWireguard(conf Config, effective map[nodeName]NodeConfig, nn nodeName, npath string, problems *Problems) {
+	w := effective[nn].Wireguard
+	if w == nil {
+		return
+	}
+	wpath := npath + ".wireguard"
+	if _, err := conf.WireguardMeshes.get(w.Mesh); err != nil {
+		problems.add(wpath+".mesh", "%v", err)
+		return
+	}
+	if _, err := w.allowedIP(); err != nil {
+		problems.add(wpath+".address", "%v", err)
+	} else {
+		ip, _, _ := net.ParseCIDR(w.Address)
+		for _, other := range meshMembers(effective, w.Mesh) {
+			oip, _, err := net.ParseCIDR(effective[other].Wireguard.Address)
+			if other != nn && err == nil && oip.Equal(ip) {
+				problems.add(wpath+".address", "address %s is also used by node %q in mesh %q", ip, other, w.Mesh)
+			}
+		}
+	}
+	if _, err := readPublicKey(g.fsys, w.Mesh, nn); err != nil {
+		problems.add(wpath, "%v", err)
+	}
+	pv := MeshVersion(w.Mesh)
+	if sums, err := pv.getChecksums(g.fsys); err != nil {
+		problems.add(wpath, "%v", err)
+	} else if _, exists := sums[PrivateKeyName(string(nn))]; !exists {
+		problems.add(wpath, "missing checksum for private key %q in %s", PrivateKeyName(string(nn)), pv.ChecksumFile())
+	}
+}
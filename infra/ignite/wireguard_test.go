@@ -0,0 +1,173 @@
+package ignite
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// wireguardConfig is testConfig with arm and core in mesh wg0.
+var wireguardConfig = strings.NewReplacer(
+	`"secretservice_domain": "secrets.example.com",`, `"secretservice_domain": "secrets.example.com",
+	"wireguard_meshes": {"wg0": {"persistent_keepalive": 25}},`,
+	`"ignition_version": "3.0.0",`, `"ignition_version": "3.0.0",
+			"wireguard": {"mesh": "wg0", "address": "10.8.0.2/24"},`,
+	`"arch": "x86_64",`, `"arch": "x86_64",
+			"ignition_version": "2.1.0",
+			"wireguard": {"mesh": "wg0", "address": "10.8.0.1/24", "endpoint": "core.example.com"},`,
+).Replace(testConfig)
+
+// newWireguardFS returns the inputs of wireguardConfig, with keys for its
+// members.
+func newWireguardFS(t *testing.T) fstest.MapFS {
+	fsys := newTestFS(wireguardConfig)
+	lines := []string{}
+	for _, name := range []string{"arm", "core"} {
+		private, public, err := NewWireguardKey()
+		if err != nil {
+			t.Fatalf("NewWireguardKey() returned error: %v", err)
+		}
+		fsys[PublicKeyFile("wg0", name)] = &fstest.MapFile{Data: []byte(public + "\n")}
+		lines = append(lines, WireguardKey{Mesh: "wg0", Node: name, Private: private, Public: public}.ChecksumLine())
+	}
+	fsys["checksums/wireguard_wg0.sha512"] = &fstest.MapFile{Data: []byte(strings.Join(lines, ""))}
+	return fsys
+}
+
+func TestNewWireguardKey(t *testing.T) {
+	private, public, err := NewWireguardKey()
+	if err != nil {
+		t.Fatalf("NewWireguardKey() returned error: %v", err)
+	}
+	priv, err := base64.StdEncoding.DecodeString(private)
+	if err != nil || len(priv) != 32 {
+		t.Fatalf("NewWireguardKey() got private key %q, want 32 bytes of base64", private)
+	}
+	if priv[0]&7 != 0 || priv[31]&128 != 0 || priv[31]&64 == 0 {
+		t.Errorf("NewWireguardKey() got unclamped private key %x", priv)
+	}
+	want, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		t.Fatalf("X25519() returned error: %v", err)
+	}
+	if got := base64.StdEncoding.EncodeToString(want); public != got {
+		t.Errorf("NewWireguardKey() got public key %q, want %q", public, got)
+	}
+}
+
+func TestGenerateWireguard(t *testing.T) {
+	fsys := newWireguardFS(t)
+	g := NewGenerator(fsys, mapSink{})
+	g.SecretServiceHash = "123abc"
+	outputs, err := g.Generate()
+	if err != nil {
+		t.Fatalf("Generate() returned error: %v", err)
+	}
+	corePub := strings.TrimSpace(string(fsys[PublicKeyFile("wg0", "core")].Data))
+	armPub := strings.TrimSpace(string(fsys[PublicKeyFile("wg0", "arm")].Data))
+
+	arm := outputs[0].state()
+	key, exists := arm.files["/etc/wireguard/wg0.key"]
+	if !exists {
+		t.Fatalf("Generate() for arm got no private key in files %v", arm.files)
+	}
+	sums, err := MeshVersion("wg0").getChecksums(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKey := fileState{
+		source: "https://secrets.example.com/123abc/files/wireguard/wg0/certs/arm.key",
+		hash:   "sha512-" + sums["arm.key"],
+		group:  networkdGroup,
+		mode:   0640,
+	}
+	if key != wantKey {
+		t.Errorf("Generate() for arm got private key %+v, want %+v", key, wantKey)
+	}
+	netdev, err := decodeDataURL(arm.files["/etc/systemd/network/50-wg0.netdev"].source)
+	if err != nil {
+		t.Fatalf("Generate() for arm got bad netdev: %v", err)
+	}
+	wantNetdev := fmt.Sprintf(`[NetDev]
+Name=wg0
+Kind=wireguard
+Description=WireGuard mesh wg0
+
+[WireGuard]
+PrivateKeyFile=/etc/wireguard/wg0.key
+ListenPort=51820
+
+[WireGuardPeer]
+# core
+PublicKey=%s
+AllowedIPs=10.8.0.1/32
+Endpoint=core.example.com:51820
+PersistentKeepalive=25
+`, corePub)
+	if string(netdev) != wantNetdev {
+		t.Errorf("Generate() for arm got netdev\n%s\nwant\n%s", netdev, wantNetdev)
+	}
+
+	core := outputs[1].state()
+	wantNetwork := "[Match]\nName=wg0\n\n[Network]\nAddress=10.8.0.1/24\n"
+	if got := core.networkd["50-wg0.network"]; got != wantNetwork {
+		t.Errorf("Generate() for core got network %q, want %q", got, wantNetwork)
+	}
+	if got := core.networkd["50-wg0.netdev"]; !strings.Contains(got, "# arm\nPublicKey="+armPub+"\nAllowedIPs=10.8.0.2/32\nPersistentKeepalive=25\n") {
+		t.Errorf("Generate() for core got netdev without arm as peer:\n%s", got)
+	}
+}
+
+func TestNewWireguardKeys(t *testing.T) {
+	fsys := newWireguardFS(t)
+	delete(fsys, PublicKeyFile("wg0", "core"))
+	g := NewGenerator(fsys, mapSink{})
+	conf, err := g.ReadConfigWithoutChecksums()
+	if err != nil {
+		t.Fatalf("ReadConfigWithoutChecksums() returned error: %v", err)
+	}
+	keys, err := g.NewWireguardKeys(*conf)
+	if err != nil {
+		t.Fatalf("NewWireguardKeys() returned error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Mesh != "wg0" || keys[0].Node != "core" {
+		t.Fatalf("NewWireguardKeys() = %+v, want a key for core in wg0", keys)
+	}
+	want := fmt.Sprintf("%x  core.key\n", sha512.Sum512([]byte(keys[0].Private+"\n")))
+	if got := keys[0].ChecksumLine(); got != want {
+		t.Errorf("ChecksumLine() = %q, want %q", got, want)
+	}
+}
+
+func TestWireguardUnitChecks(t *testing.T) {
+	fsys := newWireguardFS(t)
+	conf := strings.Replace(wireguardConfig, `"nodes": {`, `"unit_checks": {"strict": true},
+	"nodes": {`, 1)
+	fsys["config.json"] = &fstest.MapFile{Data: []byte(conf)}
+	fsys["units/tclient.service"] = &fstest.MapFile{Data: []byte(strings.Join([]string{
+		"[Unit]",
+		"After=network-online.target",
+		"",
+		"[Service]",
+		"Environment=WG_KEY=/etc/wireguard/wg0.key",
+		"ExecStart=/opt/bin/tclient -addr {{.Vars.report_addr}}",
+		"",
+	}, "\n"))}
+	g := NewGenerator(fsys, mapSink{})
+	_, problems, err := g.ValidateConfig()
+	if err != nil {
+		t.Fatalf("ValidateConfig() returned error: %v", err)
+	}
+	if len(problems) > 0 {
+		t.Errorf("ValidateConfig() got problems %v, want none", problems)
+	}
+	g.SecretServiceHash = "123abc"
+	if _, err := g.Generate(); err != nil {
+		t.Errorf("Generate() returned error: %v", err)
+	}
+}
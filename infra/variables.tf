@@ -114,3 +114,18 @@ variable "blockpress_me_enabled" {
 }
 
 variable "infra_version" {}
+
+# The nodes in config.json, with their generated user data, as written to
+# nodes.auto.tfvars.json by generate_ignite_configs.go. There's no default,
+# so that plans fail if the file wasn't generated, instead of failing on
+# the first node looked up in an empty map.
+variable "nodes" {
+  description = "The nodes in config.json, from nodes.auto.tfvars.json; run 'go run generate_ignite_configs.go' to write it."
+  type = map(object({
+    arch      = string
+    provider  = string
+    output    = string
+    user_data = string
+    labels    = map(string)
+  }))
+}